@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Deleting accounts.
+
+When a user asks to delete the account we only set
+users.deletion_requested_at, log them out everywhere and hide their public
+notes. During accountDeletionGracePeriod they can log in again and cancel
+the deletion (logging in redirects to /account/data).
+
+After the grace period deleteExpiredAccounts (run daily) deletes the users
+row, unless the deletion was cancelled in the meantime. Notes, versions,
+logins, sessions etc. are deleted by ON DELETE CASCADE. Then we delete content that is no longer referenced by any version (the
+same content can be shared by notes of different users) and forget cached
+data of the user.
+
+Pages:
+GET  /account/data               : export data and delete account
+POST /account/data/delete        : request deletion, confirm=${handle}
+POST /account/data/delete/cancel : cancel deletion
+*/
+
+const (
+	accountDeletionGracePeriod = 30 * 24 * time.Hour
+	maxSha1sPerQuery           = 1000
+)
+
+func dbSetDeletionRequestedAt(userID int, t *time.Time) error {
+	db := getDbMust()
+	q := `UPDATE users SET deletion_requested_at = ? WHERE id = ?`
+	_, err := db.Exec(q, t, userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	clearCachedDbUser(userID)
+	clearCachedUserInfo(userID)
+	return err
+}
+
+// dbGetUsersToDelete returns ids of users who requested deletion before t
+func dbGetUsersToDelete(t time.Time) ([]int, error) {
+	db := getDbMust()
+	q := `SELECT id FROM users WHERE deletion_requested_at < ?`
+	rows, err := db.Query(q, t)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+// dbGetUserContentSha1s returns sha1 of content of all versions of notes
+// of a user
+func dbGetUserContentSha1s(userID int) ([][]byte, error) {
+	db := getDbMust()
+	q := `
+SELECT DISTINCT v.content_sha1
+FROM versions v
+INNER JOIN notes n ON v.note_id = n.id
+WHERE n.user_id = ?`
+	rows, err := db.Query(q, userID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res [][]byte
+	for rows.Next() {
+		var sha1 []byte
+		if err = rows.Scan(&sha1); err != nil {
+			return nil, err
+		}
+		res = append(res, sha1)
+	}
+	return res, rows.Err()
+}
+
+// dbGetReferencedContent returns which of sha1s are used by any version
+func dbGetReferencedContent(sha1s [][]byte) (map[string]bool, error) {
+	res := map[string]bool{}
+	for len(sha1s) > 0 {
+		n := len(sha1s)
+		if n > maxSha1sPerQuery {
+			n = maxSha1sPerQuery
+		}
+		err := dbAddReferencedContent(sha1s[:n], res)
+		if err != nil {
+			return nil, err
+		}
+		sha1s = sha1s[n:]
+	}
+	return res, nil
+}
+
+func dbAddReferencedContent(sha1s [][]byte, res map[string]bool) error {
+	db := getDbMust()
+	var args []interface{}
+	for _, sha1 := range sha1s {
+		args = append(args, sha1)
+	}
+	q := `SELECT DISTINCT content_sha1 FROM versions WHERE content_sha1 IN (?` + strings.Repeat(", ?", len(sha1s)-1) + `)`
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sha1 []byte
+		if err = rows.Scan(&sha1); err != nil {
+			return err
+		}
+		res[string(sha1)] = true
+	}
+	return rows.Err()
+}
+
+// getUnreferencedContent returns sha1s that are not used by any version
+func getUnreferencedContent(sha1s [][]byte) ([][]byte, error) {
+	referenced, err := dbGetReferencedContent(sha1s)
+	if err != nil {
+		return nil, err
+	}
+	var res [][]byte
+	for _, sha1 := range sha1s {
+		if !referenced[string(sha1)] {
+			res = append(res, sha1)
+		}
+	}
+	return res, nil
+}
+
+// dbDeleteUser deletes the user if they requested deletion before t.
+// Returns false if the user doesn't exist or cancelled the deletion
+func dbDeleteUser(userID int, t time.Time) (bool, error) {
+	db := getDbMust()
+	q := `DELETE FROM users WHERE id = ? AND deletion_requested_at < ?`
+	res, err := db.Exec(q, userID, t)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// deleteUnreferencedContent deletes content that is not used by any version.
+// muContentRefs is only locked while deleting content from local store, so
+// that a note with the same content can't be saved at the same time. If it
+// was saved after that, we put the content back into google storage
+func deleteUnreferencedContent(sha1s [][]byte) (int, error) {
+	sha1s, err := getUnreferencedContent(sha1s)
+	if err != nil || len(sha1s) == 0 {
+		return 0, err
+	}
+
+	muContentRefs.Lock()
+	// might have been referenced by a version saved after the query above
+	sha1s, err = getUnreferencedContent(sha1s)
+	if err == nil {
+		for _, sha1 := range sha1s {
+			err = localStore.DeleteContent(sha1)
+			if err != nil {
+				break
+			}
+			mu.Lock()
+			delete(contentCache, string(sha1))
+			mu.Unlock()
+		}
+	}
+	muContentRefs.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sha1 := range sha1s {
+		err = deleteNoteFromGoogleStorage(sha1)
+		if err != nil {
+			return 0, err
+		}
+	}
+	referenced, err := dbGetReferencedContent(sha1s)
+	if err != nil {
+		return 0, err
+	}
+	for sha1 := range referenced {
+		d, err := localStore.GetContentBySha1([]byte(sha1))
+		if err == nil {
+			err = saveNoteToGoogleStorage([]byte(sha1), d)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sha1s) - len(referenced), nil
+}
+
+// requestAccountDeletion schedules deletion of the account
+func requestAccountDeletion(userID int) error {
+	now := time.Now()
+	err := dbSetDeletionRequestedAt(userID, &now)
+	if err != nil {
+		return err
+	}
+	err = revokeSessions(userID, nil)
+	if err != nil {
+		return err
+	}
+	publicNotesChanged()
+	log.Infof("user %d requested deletion of the account\n", userID)
+	return nil
+}
+
+func cancelAccountDeletion(userID int) error {
+	err := dbSetDeletionRequestedAt(userID, nil)
+	if err != nil {
+		return err
+	}
+	publicNotesChanged()
+	log.Infof("user %d cancelled deletion of the account\n", userID)
+	return nil
+}
+
+// deleteUser permanently deletes the user and all their data if they
+// requested deletion before t. Does nothing if they cancelled it
+func deleteUser(userID int, t time.Time) error {
+	sha1s, err := dbGetUserContentSha1s(userID)
+	if err != nil {
+		return err
+	}
+	err = revokeSessions(userID, nil)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := dbDeleteUser(userID, t)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		log.Infof("user %d was not deleted, deletion was cancelled\n", userID)
+		return nil
+	}
+	clearCachedUserInfo(userID)
+	clearCachedDbUser(userID)
+	deleteDataExport(userID)
+	if searchIndex != nil {
+		err = searchIndex.DeleteUser(userID)
+		if err != nil {
+			log.Errorf("searchIndex.DeleteUser(%d) failed with '%s'\n", userID, err)
+		}
+	}
+	nDeleted, err := deleteUnreferencedContent(sha1s)
+	log.Infof("deleted user %d and %d of %d contents\n", userID, nDeleted, len(sha1s))
+	return err
+}
+
+// deleteExpiredAccounts deletes accounts whose grace period is over. Called
+// from dailyTasksLoop
+func deleteExpiredAccounts() error {
+	t := time.Now().Add(-accountDeletionGracePeriod)
+	ids, err := dbGetUsersToDelete(t)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = deleteUser(id, t)
+		if err != nil {
+			log.Errorf("deleteUser(%d) failed with '%s'\n", id, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func redirectToAccountData(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	v := url.Values{}
+	if msg != "" {
+		v.Set("msg", msg)
+	}
+	if err != nil {
+		v.Set("error", err.Error())
+	}
+	uri := "/account/data"
+	if len(v) > 0 {
+		uri += "?" + v.Encode()
+	}
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// url: GET /account/data
+func handleAccountData(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	user, err := dbGetUserByIDCached(ctx.User.id)
+	if err != nil || user == nil {
+		httpErrorf(w, "dbGetUserByIDCached() failed with '%s'", err)
+		return
+	}
+	model := struct {
+		LoggedUser *UserSummary
+		Export     *DataExport
+		// zero if deletion was not requested
+		DeleteAt  time.Time
+		Message   string
+		Error     string
+		CSRFToken string
+	}{
+		LoggedUser: ctx.User,
+		Export:     getDataExport(ctx.User.id),
+		Message:    r.FormValue("msg"),
+		Error:      r.FormValue("error"),
+		CSRFToken:  csrfToken(w, r),
+	}
+	if user.DeletionRequestedAt != nil {
+		model.DeleteAt = user.DeletionRequestedAt.Add(accountDeletionGracePeriod)
+	}
+	serveTemplate(w, tmplAccountData, model)
+}
+
+// url: POST /account/data/delete
+func handleAccountDataDelete(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	confirm := strings.TrimSpace(r.FormValue("confirm"))
+	if confirm != ctx.User.Handle {
+		redirectToAccountData(w, r, "", fmt.Errorf("type '%s' to confirm deleting the account", ctx.User.Handle))
+		return
+	}
+	err := requestAccountDeletion(ctx.User.id)
+	if err != nil {
+		redirectToAccountData(w, r, "", err)
+		return
+	}
+	// all sessions, including this one, are revoked
+	deleteSecureCookie(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// url: POST /account/data/delete/cancel
+func handleAccountDataDeleteCancel(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	err := cancelAccountDeletion(ctx.User.id)
+	if err != nil {
+		redirectToAccountData(w, r, "", err)
+		return
+	}
+	redirectToAccountData(w, r, "Your account will not be deleted.", nil)
+}
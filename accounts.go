@@ -0,0 +1,640 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+E-mail / password accounts.
+
+An account is a user with login "email:${email}" (e-mail lower-cased) and a
+row in email_accounts with argon2id hash of the password. Logging in requires
+verifying the e-mail first, by following a link sent after signing up.
+Signing up with an e-mail that already has an account looks the same as
+signing up with a new one; we e-mail the owner of the account instead.
+
+Tokens for e-mail verification and password reset links are random and only
+their sha256 is stored (in email_verification_tokens and
+password_reset_tokens) so that a leaked database can't be used to take over
+accounts. Tokens are single-use and expire.
+
+Pages:
+GET  /loginemail?redir=${redirect}   : log in / sign up / forgot password form
+POST /loginemail                     : action is login, signup or forgot
+GET  /verifyemail?token=${token}     : verify e-mail and log in
+GET  /resetpassword?token=${token}   : form for setting new password
+POST /resetpassword                  : set new password and log in
+*/
+
+const (
+	emailLoginPrefix = "email:"
+
+	minPasswordLen = 8
+	// in bytes, to limit work done hashing
+	maxPasswordLen = 1024
+	maxEmailLen    = 255
+
+	verifyEmailTokenTTL   = time.Hour * 48
+	resetPasswordTokenTTL = time.Hour
+
+	tableVerificationTokens  = "email_verification_tokens"
+	tablePasswordResetTokens = "password_reset_tokens"
+
+	// argon2id parameters, as recommended in RFC 9106 for
+	// memory-constrained environments
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+var (
+	errAccountExists   = errors.New("account with this e-mail already exists")
+	errInvalidLogin    = errors.New("invalid e-mail or password")
+	errNotVerified     = errors.New("e-mail is not verified")
+	errInvalidToken    = errors.New("the link is invalid or has expired")
+	errMailNotEnabled  = errors.New("sending e-mails is not configured")
+	errInvalidPassword = fmt.Errorf("password must have at least %d characters", minPasswordLen)
+
+	// used for comparing when a user doesn't exist, so that response time
+	// doesn't tell if an account exists
+	dummyPasswordHash = hashPassword(randomToken())
+)
+
+// parseEmail returns e-mail address from e.g. "Foo <foo@bar.com>"
+func parseEmail(s string) (string, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
+
+// normalizeEmail validates e-mail entered by the user and lower-cases it
+func normalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	addr, err := parseEmail(s)
+	if err != nil || addr != s || len(s) > maxEmailLen {
+		return "", fmt.Errorf("'%s' is not a valid e-mail address", s)
+	}
+	return strings.ToLower(s), nil
+}
+
+func validatePassword(pwd string) error {
+	if utf8.RuneCountInString(pwd) < minPasswordLen {
+		return errInvalidPassword
+	}
+	if len(pwd) > maxPasswordLen {
+		return fmt.Errorf("password must have at most %d characters", maxPasswordLen)
+	}
+	return nil
+}
+
+// hashPassword returns argon2id hash of password, encoded as
+// $argon2id$v=19$m=65536,t=3,p=4$${salt}$${hash}
+func hashPassword(pwd string) string {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		panic(err)
+	}
+	key := argon2.IDKey([]byte(pwd), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads, enc.EncodeToString(salt), enc.EncodeToString(key))
+}
+
+// verifyPassword returns true if pwd matches encoded hash from hashPassword.
+// Parameters are read from the hash so that they can be changed later
+func verifyPassword(pwd string, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := enc.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	key2 := argon2.IDKey([]byte(pwd), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, key2) == 1
+}
+
+func emailFromLogin(login string) string {
+	return strings.TrimPrefix(login, emailLoginPrefix)
+}
+
+// we only store sha256 of tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// EmailAccount is password and verification state of e-mail account
+type EmailAccount struct {
+	userID       int
+	passwordHash string
+	VerifiedAt   *time.Time
+}
+
+func dbGetEmailAccount(userID int) (*EmailAccount, error) {
+	db := getDbMust()
+	q := `SELECT password_hash, verified_at FROM email_accounts WHERE user_id = ?`
+	acc := &EmailAccount{userID: userID}
+	var verifiedAt sql.NullTime
+	err := db.QueryRow(q, userID).Scan(&acc.passwordHash, &verifiedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("db.QueryRow('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	if verifiedAt.Valid {
+		acc.VerifiedAt = &verifiedAt.Time
+	}
+	return acc, nil
+}
+
+// dbCreateEmailAccount creates a user with not yet verified e-mail account.
+// User, identity and e-mail account are created in one transaction so that
+// a failure doesn't leave an account without a password
+func dbCreateEmailAccount(email, fullName, pwd string) (*DbUser, error) {
+	// hash before checking if the account exists so that both cases take
+	// the same time
+	passwordHash := hashPassword(pwd)
+	login := emailLoginPrefix + email
+	user, err := dbGetUserByLogin(login)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		return nil, errAccountExists
+	}
+
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	userID, err := txCreateUser(tx, login, fullName)
+	if err != nil {
+		return nil, err
+	}
+	q := `UPDATE users SET email = ? WHERE id = ?`
+	_, err = tx.Exec(q, email, userID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	q = `INSERT INTO email_accounts (user_id, password_hash) VALUES (?, ?)`
+	_, err = tx.Exec(q, userID, passwordHash)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return nil, err
+	}
+
+	user, err = dbGetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	err = addWelcomeNote(user)
+	return user, err
+}
+
+// dbSetPassword sets password of e-mail account, creating the account if
+// needed. Only called after the user proved owning the e-mail so also marks
+// it as verified
+func dbSetPassword(userID int, pwd string) error {
+	db := getDbMust()
+	q := `
+INSERT INTO email_accounts (user_id, password_hash, verified_at) VALUES (?, ?, ?)
+ON DUPLICATE KEY UPDATE password_hash = VALUES(password_hash), verified_at = COALESCE(verified_at, VALUES(verified_at))`
+	_, err := db.Exec(q, userID, hashPassword(pwd), time.Now())
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+func dbMarkEmailVerified(userID int) error {
+	db := getDbMust()
+	q := `UPDATE email_accounts SET verified_at = ? WHERE user_id = ? AND verified_at IS NULL`
+	_, err := db.Exec(q, time.Now(), userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+// dbCreateToken creates a token valid for ttl and stores its hash in table
+func dbCreateToken(table string, userID int, ttl time.Duration) (string, error) {
+	token := randomToken()
+	db := getDbMust()
+	q := fmt.Sprintf(`INSERT INTO %s (token_hash, user_id, expires_at) VALUES (?, ?, ?)`, table)
+	_, err := db.Exec(q, hashToken(token), userID, time.Now().Add(ttl))
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return "", err
+	}
+	return token, nil
+}
+
+// dbUseToken deletes the token and returns id of the user it was created
+// for. Returns errInvalidToken if token doesn't exist or expired
+func dbUseToken(table string, token string) (int, error) {
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	h := hashToken(token)
+	var userID int
+	var expiresAt time.Time
+	q := fmt.Sprintf(`SELECT user_id, expires_at FROM %s WHERE token_hash = ? FOR UPDATE`, table)
+	err = tx.QueryRow(q, h).Scan(&userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidToken
+	}
+	if err != nil {
+		log.Errorf("tx.QueryRow('%s') failed with '%s'\n", q, err)
+		return 0, err
+	}
+	q = fmt.Sprintf(`DELETE FROM %s WHERE token_hash = ? OR expires_at < ?`, table)
+	_, err = tx.Exec(q, h, time.Now())
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return 0, err
+	}
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(expiresAt) {
+		return 0, errInvalidToken
+	}
+	return userID, nil
+}
+
+// dbDeleteUserTokens invalidates all tokens of the user in table
+func dbDeleteUserTokens(table string, userID int) error {
+	db := getDbMust()
+	q := fmt.Sprintf(`DELETE FROM %s WHERE user_id = ?`, table)
+	_, err := db.Exec(q, userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+// authenticateEmailAccount returns user if e-mail and password match
+func authenticateEmailAccount(email, pwd string) (*DbUser, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, errInvalidLogin
+	}
+	user, err := dbGetUserByLogin(emailLoginPrefix + email)
+	if err != nil {
+		return nil, err
+	}
+	var acc *EmailAccount
+	if user != nil {
+		acc, err = dbGetEmailAccount(user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if acc == nil {
+		verifyPassword(pwd, dummyPasswordHash)
+		return nil, errInvalidLogin
+	}
+	if !verifyPassword(pwd, acc.passwordHash) {
+		return nil, errInvalidLogin
+	}
+	if acc.VerifiedAt == nil {
+		return user, errNotVerified
+	}
+	return user, nil
+}
+
+func sendVerificationEmail(user *DbUser) error {
+	if mailer == nil {
+		return errMailNotEnabled
+	}
+	token, err := dbCreateToken(tableVerificationTokens, user.ID, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+to finish signing up for QuickNotes, verify your e-mail by opening:
+
+%s/verifyemail?token=%s
+
+The link expires in %d hours. If you didn't sign up, ignore this e-mail.
+`, user.FullName.String, config.SiteURL, token, int(verifyEmailTokenTTL.Hours()))
+	return mailer.Send(&MailMessage{
+		To:      emailFromLogin(user.Login),
+		Subject: "Verify your e-mail for QuickNotes",
+		Body:    body,
+	})
+}
+
+// sendAccountExistsEmail tells the owner of an e-mail that someone tried to
+// sign up with it, instead of telling that to whoever is signing up
+func sendAccountExistsEmail(user *DbUser) error {
+	if mailer == nil {
+		return errMailNotEnabled
+	}
+	acc, err := dbGetEmailAccount(user.ID)
+	if err != nil {
+		return err
+	}
+	if acc != nil && acc.VerifiedAt == nil {
+		return sendVerificationEmail(user)
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+someone tried to sign up for QuickNotes with this e-mail, but you already
+have an account. You can log in at:
+
+%s/loginemail
+
+If you forgot your password, you can set a new one there. If you didn't try
+to sign up, ignore this e-mail.
+`, user.FullName.String, config.SiteURL)
+	return mailer.Send(&MailMessage{
+		To:      emailFromLogin(user.Login),
+		Subject: "You already have a QuickNotes account",
+		Body:    body,
+	})
+}
+
+func sendPasswordResetEmail(user *DbUser) error {
+	if mailer == nil {
+		return errMailNotEnabled
+	}
+	token, err := dbCreateToken(tablePasswordResetTokens, user.ID, resetPasswordTokenTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+to set a new password for your QuickNotes account, open:
+
+%s/resetpassword?token=%s
+
+The link expires in %d minutes. If you didn't ask for it, ignore this e-mail.
+`, user.FullName.String, config.SiteURL, token, int(resetPasswordTokenTTL.Minutes()))
+	return mailer.Send(&MailMessage{
+		To:      emailFromLogin(user.Login),
+		Subject: "Reset your QuickNotes password",
+		Body:    body,
+	})
+}
+
+// only allow redirecting to our own pages
+func sanitizeRedir(redir string) string {
+	if !strings.HasPrefix(redir, "/") || strings.HasPrefix(redir, "//") || strings.HasPrefix(redir, "/\\") {
+		return "/"
+	}
+	return redir
+}
+
+// EmailLoginModel is a model for login_email.html
+type EmailLoginModel struct {
+	// login, signup, forgot or reset
+	Action      string
+	Redir       string
+	Email       string
+	FullName    string
+	Token       string
+	MailEnabled bool
+	Error       string
+	Message     string
+	CSRFToken   string
+}
+
+func serveEmailLogin(w http.ResponseWriter, r *http.Request, m *EmailLoginModel) {
+	m.MailEnabled = mailer != nil
+	m.CSRFToken = csrfToken(w, r)
+	serveTemplate(w, tmplLoginEmail, m)
+}
+
+// url: GET | POST /loginemail
+func handleLoginEmail(w http.ResponseWriter, r *http.Request) {
+	m := &EmailLoginModel{
+		Action:   r.FormValue("action"),
+		Redir:    sanitizeRedir(strings.TrimSpace(r.FormValue("redir"))),
+		Email:    strings.TrimSpace(r.FormValue("email")),
+		FullName: strings.TrimSpace(r.FormValue("fullname")),
+	}
+	if m.Action == "" {
+		m.Action = "login"
+	}
+	if r.Method != http.MethodPost {
+		serveEmailLogin(w, r, m)
+		return
+	}
+	if !checkCSRF(w, r) {
+		serveCSRFError(w, r, false)
+		return
+	}
+	pwd := r.FormValue("password")
+
+	switch m.Action {
+	case "login":
+		user, err := authenticateEmailAccount(m.Email, pwd)
+		if err == errNotVerified {
+			err = sendVerificationEmail(user)
+			if err != nil {
+				log.Errorf("sendVerificationEmail() failed with '%s'\n", err)
+			}
+			m.Error = "Your e-mail is not verified yet. We've sent you a new verification link."
+		} else if err == errInvalidLogin {
+			m.Error = err.Error()
+		} else if err != nil {
+			log.Errorf("authenticateEmailAccount('%s') failed with '%s'\n", m.Email, err)
+			m.Error = "Something went wrong, please try again."
+		} else {
+			logInDbUser(w, r, user, m.Redir)
+			return
+		}
+
+	case "signup":
+		email, err := normalizeEmail(m.Email)
+		if err == nil {
+			err = validatePassword(pwd)
+		}
+		if err == nil && mailer == nil {
+			err = errMailNotEnabled
+		}
+		if err != nil {
+			m.Error = err.Error()
+			break
+		}
+		fullName := m.FullName
+		if fullName == "" {
+			fullName = nameFromEmail(email)
+		}
+		// to not reveal which e-mails have accounts, we show the same
+		// message and e-mail the owner if the account already exists
+		user, err := dbCreateEmailAccount(email, fullName, pwd)
+		if err == errAccountExists {
+			user, err = dbGetUserByLogin(emailLoginPrefix + email)
+			if err == nil && user != nil {
+				err = sendAccountExistsEmail(user)
+			}
+		} else if err == nil {
+			err = sendVerificationEmail(user)
+		}
+		if err != nil {
+			log.Errorf("signing up '%s' failed with '%s'\n", email, err)
+			m.Error = "Something went wrong, please try again."
+			break
+		}
+		m.Action = "login"
+		m.Message = fmt.Sprintf("We've sent a verification link to %s. Open it to finish signing up.", email)
+
+	case "forgot":
+		if mailer == nil {
+			m.Error = errMailNotEnabled.Error()
+			break
+		}
+		// to not reveal which e-mails have accounts, we show the same
+		// message whether we sent the e-mail or not
+		m.Message = "If there's an account for this e-mail, we've sent a link for setting a new password."
+		email, err := normalizeEmail(m.Email)
+		if err != nil {
+			m.Message = ""
+			m.Error = err.Error()
+			break
+		}
+		user, err := dbGetUserByLogin(emailLoginPrefix + email)
+		if err != nil || user == nil {
+			break
+		}
+		err = sendPasswordResetEmail(user)
+		if err != nil {
+			log.Errorf("sendPasswordResetEmail('%s') failed with '%s'\n", email, err)
+		}
+
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+	serveEmailLogin(w, r, m)
+}
+
+// url: GET /verifyemail?token=${token}
+func handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	userID, err := dbUseToken(tableVerificationTokens, r.FormValue("token"))
+	if err == nil {
+		err = dbMarkEmailVerified(userID)
+	}
+	var user *DbUser
+	if err == nil {
+		user, err = dbGetUserByIDCached(userID)
+	}
+	if err != nil || user == nil {
+		if err != errInvalidToken {
+			log.Errorf("verifying e-mail failed with '%v'\n", err)
+		}
+		serveEmailLogin(w, r, &EmailLoginModel{Action: "login", Redir: "/", Error: errInvalidToken.Error()})
+		return
+	}
+	log.Verbosef("verified e-mail of user %d\n", userID)
+	logInDbUser(w, r, user, "/")
+}
+
+// url: GET | POST /resetpassword?token=${token}
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	m := &EmailLoginModel{
+		Action: "reset",
+		Redir:  "/",
+		Token:  r.FormValue("token"),
+	}
+	if r.Method != http.MethodPost {
+		serveEmailLogin(w, r, m)
+		return
+	}
+	if !checkCSRF(w, r) {
+		serveCSRFError(w, r, false)
+		return
+	}
+	pwd := r.FormValue("password")
+	if err := validatePassword(pwd); err != nil {
+		m.Error = err.Error()
+		serveEmailLogin(w, r, m)
+		return
+	}
+	userID, err := dbUseToken(tablePasswordResetTokens, m.Token)
+	if err == nil {
+		err = dbSetPassword(userID, pwd)
+	}
+	if err == nil {
+		// other reset links are no longer needed
+		err = dbDeleteUserTokens(tablePasswordResetTokens, userID)
+	}
+	if err == nil {
+		// in case the password was reset because someone else knew it
+		err = revokeSessions(userID, nil)
+	}
+	var user *DbUser
+	if err == nil {
+		user, err = dbGetUserByIDCached(userID)
+	}
+	if err != nil || user == nil {
+		if err != errInvalidToken {
+			log.Errorf("resetting password failed with '%v'\n", err)
+		}
+		serveEmailLogin(w, r, &EmailLoginModel{Action: "forgot", Redir: "/", Error: errInvalidToken.Error()})
+		return
+	}
+	log.Verbosef("reset password of user %d\n", userID)
+	logInDbUser(w, r, user, "/")
+}
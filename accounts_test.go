@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	h := hashPassword("correct horse")
+	if !strings.HasPrefix(h, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Fatalf("unexpected hash format '%s'", h)
+	}
+	if h == hashPassword("correct horse") {
+		t.Fatalf("hashes of the same password should use different salt")
+	}
+	if !verifyPassword("correct horse", h) {
+		t.Fatalf("password doesn't match its hash")
+	}
+	for _, s := range []string{"correct horsE", "", h} {
+		if verifyPassword(s, h) {
+			t.Fatalf("'%s' should not match", s)
+		}
+	}
+	for _, s := range []string{"", "$argon2i$v=19$m=65536,t=3,p=4$YQ$YQ", "$argon2id$v=19$m=65536,t=3,p=4$YQ$"} {
+		if verifyPassword("", s) {
+			t.Fatalf("invalid hash '%s' should not match", s)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	valid := map[string]string{
+		"Jane@Acme.com":   "jane@acme.com",
+		" j.doe@acme.io ": "j.doe@acme.io",
+	}
+	for s, exp := range valid {
+		got, err := normalizeEmail(s)
+		if err != nil || got != exp {
+			t.Fatalf("normalizeEmail('%s'): expected '%s', got '%s' (%v)", s, exp, got, err)
+		}
+	}
+	for _, s := range []string{"", "jane", "Jane <jane@acme.com>", "jane@acme.com, joe@acme.com"} {
+		if _, err := normalizeEmail(s); err == nil {
+			t.Fatalf("'%s' should be invalid", s)
+		}
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qn-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &MailConfig{From: "QuickNotes <noreply@quicknotes.io>", DropDir: dir}
+	if err = validateMailConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	m := newMailer(conf)
+	err = m.Send(&MailMessage{
+		To:      "jane@acme.com",
+		Subject: "Hello\r\nBcc: evil@acme.com",
+		Body:    "line 1\nline 2\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 e-mail, got %v", files)
+	}
+	d, _ := ioutil.ReadFile(files[0])
+	s := string(d)
+	for _, exp := range []string{"To: jane@acme.com\r\n", "\r\n\r\nline 1\r\nline 2\r\n"} {
+		if !strings.Contains(s, exp) {
+			t.Fatalf("expected '%s' in:\n%s", exp, s)
+		}
+	}
+	if strings.Contains(s, "\nBcc:") {
+		t.Fatalf("header injected through subject:\n%s", s)
+	}
+	if newMailer(&MailConfig{}) != nil {
+		t.Fatalf("expected no mailer when not configured")
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Admin console at /admin, only for users with users.is_admin (see OnlyAdmin
+in withCtx). Use -make-admin flag to make a user an admin.
+
+Admins can see users, disable accounts, unpublish public notes, run
+maintenance jobs and see how number of users, notes and versions changes
+over time (recorded daily in daily_stats table).
+*/
+
+const (
+	adminStatsDays     = 30
+	adminUsersPageSize = 100
+)
+
+// AdminUser is a user as shown in admin console
+type AdminUser struct {
+	*DbUser
+	HashID           string
+	NotesCount       int
+	PublicNotesCount int
+	VersionsCount    int
+	// sum of sizes of all versions of all notes
+	StorageBytes int64
+}
+
+// Storage returns StorageBytes in human-readable form
+func (u *AdminUser) Storage() string {
+	return formatSize(u.StorageBytes)
+}
+
+// formatSize formats size in bytes e.g. 1536 => "1.5 kB"
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// DailyStats is number of users, notes and versions at the end of a day
+type DailyStats struct {
+	Day           time.Time
+	UsersCount    int
+	NotesCount    int
+	VersionsCount int
+	// change since previous day
+	NewUsers    int
+	NewNotes    int
+	NewVersions int
+}
+
+// adminJob is a maintenance task that can be started from admin console
+type adminJob struct {
+	Name        string
+	Description string
+	run         func() error
+
+	// protected by adminJobsMu
+	IsRunning bool
+	StartedAt time.Time
+	Duration  time.Duration
+	Error     string
+}
+
+var (
+	adminJobsMu sync.Mutex
+	adminJobs   = []*adminJob{
+		{
+			Name:        "reindex",
+			Description: "re-index notes of all users and public notes, rebuild public notes index and sitemaps",
+			run:         reindexAll,
+		},
+		{
+			Name:        "gc",
+			Description: "delete expired sessions, tokens and data exports, forget finished imports and free unused memory",
+			run:         collectGarbage,
+		},
+	}
+)
+
+// dbQueryAdminUsers returns users selected by where (which can also have
+// ORDER BY and LIMIT) with counts of their notes and versions
+func dbQueryAdminUsers(where string, args ...interface{}) ([]*AdminUser, error) {
+	db := getDbMust()
+	q := `SELECT ` + dbUserColumns + ` FROM users u ` + where
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*AdminUser
+	for rows.Next() {
+		var au AdminUser
+		au.DbUser, err = scanDbUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		au.HashID = hashInt(au.ID)
+		res = append(res, &au)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, dbSetAdminUsersCounts(res)
+}
+
+// dbSetAdminUsersCounts sets counts of notes, versions and storage of users
+// with a single grouped query
+func dbSetAdminUsersCounts(users []*AdminUser) error {
+	if len(users) == 0 {
+		return nil
+	}
+	byID := make(map[int]*AdminUser, len(users))
+	var args []interface{}
+	for _, au := range users {
+		byID[au.ID] = au
+		args = append(args, au.ID)
+	}
+	db := getDbMust()
+	q := `
+SELECT
+  n.user_id,
+  COUNT(DISTINCT n.id),
+  COUNT(DISTINCT CASE WHEN n.is_public = true AND n.is_deleted = false THEN n.id END),
+  COUNT(v.id),
+  COALESCE(SUM(v.size), 0)
+FROM notes n
+LEFT JOIN versions v ON v.note_id = n.id
+WHERE n.user_id IN (?` + strings.Repeat(", ?", len(args)-1) + `)
+GROUP BY n.user_id`
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, nNotes, nPublic, nVersions int
+		var size int64
+		err = rows.Scan(&userID, &nNotes, &nPublic, &nVersions, &size)
+		if err != nil {
+			return err
+		}
+		if au := byID[userID]; au != nil {
+			au.NotesCount = nNotes
+			au.PublicNotesCount = nPublic
+			au.VersionsCount = nVersions
+			au.StorageBytes = size
+		}
+	}
+	return rows.Err()
+}
+
+func dbGetAdminUser(userID int) (*AdminUser, error) {
+	users, err := dbQueryAdminUsers(`WHERE u.id = ?`, userID)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+func areUserNotesHidden(userID int) bool {
+	user, err := dbGetUserByIDCached(userID)
+	return err == nil && user != nil && user.notesHidden()
+}
+
+func dbSetUserAdmin(userID int, isAdmin bool) error {
+	db := getDbMust()
+	q := `UPDATE users SET is_admin = ? WHERE id = ?`
+	_, err := db.Exec(q, isAdmin, userID)
+	clearCachedDbUser(userID)
+	clearCachedUserInfo(userID)
+	return err
+}
+
+func dbSetUserDisabled(userID int, disabled bool) error {
+	var disabledAt interface{}
+	if disabled {
+		disabledAt = time.Now()
+	}
+	db := getDbMust()
+	q := `UPDATE users SET disabled_at = ? WHERE id = ?`
+	_, err := db.Exec(q, disabledAt, userID)
+	clearCachedDbUser(userID)
+	clearCachedUserInfo(userID)
+	return err
+}
+
+// disableUser disables or enables account of a user. Disabled users are
+// logged out everywhere, can't log in and their public notes are hidden
+func disableUser(userID int, disabled bool) error {
+	err := dbSetUserDisabled(userID, disabled)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		err = revokeSessions(userID, nil)
+		if err != nil {
+			return err
+		}
+	}
+	publicNotesChanged()
+	return nil
+}
+
+// publicNotesChanged is called when public notes of a user are hidden or
+// shown again
+func publicNotesChanged() {
+	clearPublicNotesCaches()
+	go func() {
+		buildPublicNotesIndex()
+		buildSitemaps()
+	}()
+}
+
+// makeAdmin makes a user with a given login an admin, for -make-admin
+func makeAdmin(login string) error {
+	user, err := dbGetUserByLogin(login)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("no user with login '%s'", login)
+	}
+	err = dbSetUserAdmin(user.ID, true)
+	if err == nil {
+		log.Infof("user %d (%s) is now an admin\n", user.ID, login)
+	}
+	return err
+}
+
+func dbRecordDailyStats(day time.Time, users, notes, versions int) error {
+	db := getDbMust()
+	q := `REPLACE INTO daily_stats (day, users_count, notes_count, versions_count) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(q, day.Format("2006-01-02"), users, notes, versions)
+	return err
+}
+
+func getCurrentCounts() (users, notes, versions int, err error) {
+	users, err = dbGetUsersCount()
+	if err == nil {
+		notes, err = dbGetNotesCount()
+	}
+	if err == nil {
+		versions, err = dbGetVersionsCount()
+	}
+	return
+}
+
+// recordDailyStats saves current counts as stats for today. Called from
+// dailyTasksLoop
+func recordDailyStats() {
+	users, notes, versions, err := getCurrentCounts()
+	if err == nil {
+		err = dbRecordDailyStats(getCurrDayStart(), users, notes, versions)
+	}
+	if err != nil {
+		log.Errorf("recordDailyStats() failed with '%s'\n", err)
+	}
+}
+
+// dbGetDailyStats returns stats for last days, most recent first
+func dbGetDailyStats(days int) ([]*DailyStats, error) {
+	db := getDbMust()
+	// get one more day to calculate the change for the oldest day
+	q := `
+SELECT day, users_count, notes_count, versions_count
+FROM daily_stats
+ORDER BY day DESC
+LIMIT ?`
+	rows, err := db.Query(q, days+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*DailyStats
+	for rows.Next() {
+		var s DailyStats
+		err = rows.Scan(&s.Day, &s.UsersCount, &s.NotesCount, &s.VersionsCount)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	calcDailyStatsChanges(res)
+	if len(res) > days {
+		res = res[:days]
+	}
+	return res, nil
+}
+
+// stats must be sorted most recent first
+func calcDailyStatsChanges(stats []*DailyStats) {
+	for i := 0; i+1 < len(stats); i++ {
+		s, prev := stats[i], stats[i+1]
+		s.NewUsers = s.UsersCount - prev.UsersCount
+		s.NewNotes = s.NotesCount - prev.NotesCount
+		s.NewVersions = s.VersionsCount - prev.VersionsCount
+	}
+}
+
+func reindexAll() error {
+	users, err := dbGetAllUsers()
+	if err != nil {
+		return err
+	}
+	if searchIndex != nil {
+		for _, user := range users {
+			i, err := getCachedUserInfo(user.ID)
+			if err != nil {
+				return err
+			}
+			err = searchIndex.Reindex(user.ID, i.notes)
+			if err != nil {
+				return err
+			}
+		}
+		clearPublicNotesCaches()
+		notes, err := getPublicNotesCached()
+		if err != nil {
+			return err
+		}
+		err = searchIndex.Reindex(publicNotesIndexID, notes)
+		if err != nil {
+			return err
+		}
+	}
+	err = buildPublicNotesIndex()
+	if err != nil {
+		return err
+	}
+	return buildSitemaps()
+}
+
+func dbDeleteExpired() error {
+	db := getDbMust()
+	now := time.Now()
+	stmts := []struct {
+		q   string
+		arg time.Time
+	}{
+		{`DELETE FROM sessions WHERE last_seen_at < ?`, now.Add(-sessionTimeout)},
+		{`DELETE FROM ` + tableVerificationTokens + ` WHERE expires_at < ?`, now},
+		{`DELETE FROM ` + tablePasswordResetTokens + ` WHERE expires_at < ?`, now},
+	}
+	for _, stm := range stmts {
+		res, err := db.Exec(stm.q, stm.arg)
+		if err != nil {
+			log.Errorf("db.Exec('%s') failed with '%s'\n", stm.q, err)
+			return err
+		}
+		n, _ := res.RowsAffected()
+		log.Verbosef("'%s' deleted %d rows\n", stm.q, n)
+	}
+	return nil
+}
+
+func collectGarbage() error {
+	err := dbDeleteExpired()
+	if err != nil {
+		return err
+	}
+	cleanupSimpleNoteImports()
+	cleanupDataExports()
+	debug.FreeOSMemory()
+	return nil
+}
+
+// returns copies of jobs, safe to use without the lock
+func getAdminJobs() []adminJob {
+	adminJobsMu.Lock()
+	defer adminJobsMu.Unlock()
+	var res []adminJob
+	for _, job := range adminJobs {
+		res = append(res, *job)
+	}
+	return res
+}
+
+// startAdminJob runs a job with a given name in the background
+func startAdminJob(name string) error {
+	adminJobsMu.Lock()
+	defer adminJobsMu.Unlock()
+	var job *adminJob
+	for _, j := range adminJobs {
+		if j.Name == name {
+			job = j
+		}
+	}
+	if job == nil {
+		return fmt.Errorf("unknown job '%s'", name)
+	}
+	if job.IsRunning {
+		return fmt.Errorf("job '%s' is already running", name)
+	}
+	job.IsRunning = true
+	job.StartedAt = time.Now()
+	job.Error = ""
+	go func() {
+		log.Infof("starting admin job '%s'\n", job.Name)
+		err := job.run()
+		adminJobsMu.Lock()
+		defer adminJobsMu.Unlock()
+		job.IsRunning = false
+		job.Duration = time.Since(job.StartedAt)
+		if err != nil {
+			log.Errorf("admin job '%s' failed with '%s'\n", job.Name, err)
+			job.Error = err.Error()
+		} else {
+			log.Infof("admin job '%s' finished in %s\n", job.Name, job.Duration)
+		}
+	}()
+	return nil
+}
+
+func getAdminUserArg(r *http.Request) (*AdminUser, error) {
+	userID, err := dehashInt(r.FormValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	user, err := dbGetAdminUser(userID)
+	if err == nil && user == nil {
+		err = sql.ErrNoRows
+	}
+	return user, err
+}
+
+// url: GET /admin
+func handleAdmin(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	users, notes, versions, err := getCurrentCounts()
+	if err != nil {
+		httpErrorf(w, "getCurrentCounts() failed with '%s'", err)
+		return
+	}
+	stats, err := dbGetDailyStats(adminStatsDays)
+	if err != nil {
+		httpErrorf(w, "dbGetDailyStats() failed with '%s'", err)
+		return
+	}
+	model := struct {
+		LoggedUser    *UserSummary
+		UsersCount    int
+		NotesCount    int
+		VersionsCount int
+		Stats         []*DailyStats
+		Jobs          []adminJob
+		Message       string
+		Error         string
+		CSRFToken     string
+	}{
+		LoggedUser:    ctx.User,
+		UsersCount:    users,
+		NotesCount:    notes,
+		VersionsCount: versions,
+		Stats:         stats,
+		Jobs:          getAdminJobs(),
+		Message:       r.FormValue("msg"),
+		Error:         r.FormValue("error"),
+		CSRFToken:     csrfToken(w, r),
+	}
+	serveTemplate(w, tmplAdmin, model)
+}
+
+// url: POST /admin/jobs/run
+func handleAdminRunJob(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("job")
+	err := startAdminJob(name)
+	if err != nil {
+		http.Redirect(w, r, "/admin?error="+url.QueryEscape(err.Error()), http.StatusFound)
+		return
+	}
+	log.Infof("admin %d started job '%s'\n", ctx.User.id, name)
+	http.Redirect(w, r, "/admin?msg="+url.QueryEscape(fmt.Sprintf("Started job '%s'", name)), http.StatusFound)
+}
+
+// url: GET /admin/users?page=${page}
+func handleAdminUsers(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	// one more to know if there's a next page
+	users, err := dbQueryAdminUsers(`ORDER BY u.id LIMIT ? OFFSET ?`, adminUsersPageSize+1, (page-1)*adminUsersPageSize)
+	if err != nil {
+		httpErrorf(w, "dbQueryAdminUsers() failed with '%s'", err)
+		return
+	}
+	hasNext := len(users) > adminUsersPageSize
+	if hasNext {
+		users = users[:adminUsersPageSize]
+	}
+	model := struct {
+		LoggedUser *UserSummary
+		Users      []*AdminUser
+		Page       int
+		PrevPage   int
+		NextPage   int
+	}{
+		LoggedUser: ctx.User,
+		Users:      users,
+		Page:       page,
+		PrevPage:   page - 1,
+	}
+	if hasNext {
+		model.NextPage = page + 1
+	}
+	serveTemplate(w, tmplAdminUsers, model)
+}
+
+// url: GET /admin/user?id=${userHashID}
+func handleAdminUser(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	user, err := getAdminUserArg(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	identities, err := dbGetUserIdentities(user.ID)
+	if err != nil {
+		httpErrorf(w, "dbGetUserIdentities() failed with '%s'", err)
+		return
+	}
+	sessions, err := dbGetUserSessions(user.ID)
+	if err != nil {
+		httpErrorf(w, "dbGetUserSessions() failed with '%s'", err)
+		return
+	}
+	i, err := getCachedUserInfo(user.ID)
+	if err != nil {
+		httpErrorf(w, "getCachedUserInfo() failed with '%s'", err)
+		return
+	}
+	model := struct {
+		LoggedUser *UserSummary
+		User       *AdminUser
+		Identities []*Identity
+		Sessions   []*Session
+		Notes      []*Note
+		Message    string
+		Error      string
+		CSRFToken  string
+	}{
+		LoggedUser: ctx.User,
+		User:       user,
+		Identities: identities,
+		Sessions:   sessions,
+		Notes:      i.notes,
+		Message:    r.FormValue("msg"),
+		Error:      r.FormValue("error"),
+		CSRFToken:  csrfToken(w, r),
+	}
+	serveTemplate(w, tmplAdminUser, model)
+}
+
+func redirectToAdminUser(w http.ResponseWriter, r *http.Request, userID int, msg string, err error) {
+	uri := "/admin/user?id=" + hashInt(userID)
+	if err != nil {
+		uri += "&error=" + url.QueryEscape(err.Error())
+	} else {
+		uri += "&msg=" + url.QueryEscape(msg)
+	}
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// url: POST /admin/user/disable, action=disable|enable
+func handleAdminDisableUser(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	user, err := getAdminUserArg(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	disable := r.FormValue("action") == "disable"
+	if disable && user.ID == ctx.User.id {
+		redirectToAdminUser(w, r, user.ID, "", fmt.Errorf("you can't disable your own account"))
+		return
+	}
+	err = disableUser(user.ID, disable)
+	if err != nil {
+		log.Errorf("disableUser(%d, %v) failed with '%s'\n", user.ID, disable, err)
+		redirectToAdminUser(w, r, user.ID, "", err)
+		return
+	}
+	msg := "Account enabled"
+	if disable {
+		msg = "Account disabled"
+	}
+	log.Infof("admin %d: %s of user %d\n", ctx.User.id, msg, user.ID)
+	redirectToAdminUser(w, r, user.ID, msg, nil)
+}
+
+// url: POST /admin/note/unpublish, note=${noteHashID}
+func handleAdminUnpublishNote(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	noteID, err := dehashInt(r.FormValue("note"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	note, err := dbGetNoteByID(noteID)
+	if err != nil || note == nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = dbMakeNotePrivate(note.userID, noteID)
+	if err != nil {
+		log.Errorf("dbMakeNotePrivate(%d, %d) failed with '%s'\n", note.userID, noteID, err)
+		redirectToAdminUser(w, r, note.userID, "", err)
+		return
+	}
+	log.Infof("admin %d unpublished note %d of user %d\n", ctx.User.id, noteID, note.userID)
+	redirectToAdminUser(w, r, note.userID, fmt.Sprintf("Note '%s' is no longer public", note.Title), nil)
+}
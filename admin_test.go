@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1536:            "1.5 kB",
+		5 * 1024 * 1024: "5.0 MB",
+	}
+	for n, exp := range tests {
+		if got := formatSize(n); got != exp {
+			t.Errorf("formatSize(%d): expected '%s', got '%s'", n, exp, got)
+		}
+	}
+}
+
+func TestCalcDailyStatsChanges(t *testing.T) {
+	stats := []*DailyStats{
+		{UsersCount: 12, NotesCount: 100, VersionsCount: 300},
+		{UsersCount: 10, NotesCount: 95, VersionsCount: 250},
+		{UsersCount: 10, NotesCount: 90, VersionsCount: 200},
+	}
+	calcDailyStatsChanges(stats)
+	s := stats[0]
+	if s.NewUsers != 2 || s.NewNotes != 5 || s.NewVersions != 50 {
+		t.Fatalf("unexpected changes %+v", s)
+	}
+	if s = stats[2]; s.NewUsers != 0 || s.NewNotes != 0 {
+		t.Fatalf("oldest day should have no changes, got %+v", s)
+	}
+}
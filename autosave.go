@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+The editor periodically saves the note being edited. Without coalescing
+every such save would create a new row in versions table.
+
+We remember the last version created by an auto-save. If the next update
+of the same note by the same user is also an auto-save, it happens within
+flgAutoSaveWindow of the first auto-save in the sequence and nothing else
+modified the note in between, the new version replaces the remembered one
+instead of being appended.
+
+Explicit saves, changes to public / deleted state and all other operations
+(starring, restoring etc.) always create a real version. This information
+is only kept in memory; after a restart the first auto-save creates
+a new version.
+*/
+
+const (
+	defaultAutoSaveWindow = time.Minute * 5
+)
+
+// AutoSaveInfo describes the latest version of a note created by auto-save
+type AutoSaveInfo struct {
+	userID    int
+	versionID int
+	// when the first auto-save in the sequence happened
+	startedAt time.Time
+}
+
+var (
+	muAutoSave        sync.Mutex
+	noteIDToAutoSave  = map[int]*AutoSaveInfo{}
+	flgAutoSaveWindow time.Duration
+)
+
+func forgetAutoSave(noteID int) {
+	muAutoSave.Lock()
+	delete(noteIDToAutoSave, noteID)
+	muAutoSave.Unlock()
+}
+
+// returns id of the version that the auto-saved note should replace
+// or 0 if it should be saved as a new version
+func getCoalescableVersionID(userID int, existingNote *Note, note *NewNote) int {
+	if flgAutoSaveWindow <= 0 {
+		return 0
+	}
+	if note.isPublic != existingNote.IsPublic || note.isDeleted != existingNote.IsDeleted {
+		return 0
+	}
+	// copy because rememberAutoSave updates it in place
+	var i AutoSaveInfo
+	muAutoSave.Lock()
+	p := noteIDToAutoSave[existingNote.id]
+	if p != nil {
+		i = *p
+	}
+	muAutoSave.Unlock()
+	if p == nil || i.userID != userID {
+		return 0
+	}
+	// something else created a version after our auto-save
+	if i.versionID != existingNote.CurrVersionID {
+		return 0
+	}
+	if time.Since(i.startedAt) > flgAutoSaveWindow {
+		return 0
+	}
+	return i.versionID
+}
+
+func rememberAutoSave(userID int, note *NewNote) {
+	muAutoSave.Lock()
+	defer muAutoSave.Unlock()
+	i := noteIDToAutoSave[note.id]
+	if note.replacesVersionID == 0 || i == nil {
+		// starting a new sequence of auto-saves
+		i = &AutoSaveInfo{
+			userID:    userID,
+			startedAt: time.Now(),
+		}
+		noteIDToAutoSave[note.id] = i
+	}
+	i.versionID = note.versionID
+	log.Verbosef("note %d, auto-save version %d, sequence started at %s\n", note.id, i.versionID, i.startedAt.Format(time.RFC3339))
+}
@@ -98,7 +98,8 @@ func buildPublicNotesIndex() error {
 	q := `
 SELECT count(*)
 FROM notes
-WHERE is_public = true AND is_deleted = false AND is_encrypted = false`
+WHERE is_public = true AND is_deleted = false AND is_encrypted = false
+  AND user_id NOT IN (` + sqlHiddenUserIDs + `)`
 
 	err := db.QueryRow(q).Scan(&nNotes)
 	if err != nil {
@@ -119,6 +120,7 @@ SELECT
   title
 FROM notes
 WHERE is_public = true AND is_deleted = false AND is_encrypted = false
+  AND user_id NOT IN (` + sqlHiddenUserIDs + `)
 ORDER BY created_at DESC`
 	rows, err := db.Query(q)
 	if err != nil {
@@ -140,11 +142,9 @@ ORDER BY created_at DESC`
 		if err != nil {
 			return err
 		}
-		url := "/n/" + hashInt(noteID)
+		url := noteURLPath(hashInt(noteID), title)
 		if title == "" {
 			title = hashInt(noteID)
-		} else {
-			url = url + "-" + title
 		}
 		userInfo, err := getCachedUserInfo(userID)
 		creator := "unknown"
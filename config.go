@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/securecookie"
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Configuration of the server.
+
+Settings are read from a JSON file given with -config (or $QUICKNOTES_CONFIG).
+Each setting can be overridden with an environment variable (see configEnvVars)
+and some with command-line flags (-http-addr, -db-host, -db-port). Settings
+that are not set get defaults that depend on -production. Config is validated
+at startup.
+
+Example config.json:
+
+{
+  "HTTPAddr": ":80",
+  "HTTPSAddr": ":443",
+  "SiteURL": "https://quicknotes.io",
+  "DbDSN": "quicknotes:password@tcp(10.0.0.2:3306)/quicknotes?parseTime=true",
+  "CookieAuthKeyHex": "<64 hex characters>",
+  "CookieEncrKeyHex": "<64 hex characters>",
+  "AllowedDomains": ["quicknotes.io"],
+  "Storage": {
+    "GoogleStorageBucket": "quicknotes",
+    "GoogleStorageCredentialsFile": "credentials.json"
+  },
+  "Google": { "ClientID": "...", "ClientSecret": "..." },
+  "GitHub": { "ClientID": "...", "ClientSecret": "..." },
+  "Twitter": { "ClientID": "<consumer key>", "ClientSecret": "<consumer secret>" },
+  "Mail": {
+    "From": "QuickNotes <noreply@quicknotes.io>",
+    "SMTPAddr": "smtp.example.com:587",
+    "SMTPUser": "...",
+    "SMTPPassword": "..."
+  },
+  "OIDC": [
+    {
+      "Name": "acme",
+      "DisplayName": "Acme SSO",
+      "IssuerURL": "https://sso.acme.com",
+      "ClientID": "...",
+      "ClientSecret": "..."
+    }
+  ],
+  "Plans": {
+    "Free": { "MaxNotes": 1000, "MaxContentBytes": 52428800, "MaxNoteBytes": 1048576, "MaxVersions": 50 },
+    "Pro": { "MaxNoteBytes": 10485760 }
+  }
+}
+
+-print-config prints effective config with secrets redacted.
+*/
+
+const (
+	redactedValue = "<redacted>"
+)
+
+// OAuthProviderConfig has OAuth credentials of an app registered with a
+// login provider. A provider is disabled if its credentials are not set
+type OAuthProviderConfig struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// OIDCProviderConfig describes an OpenID Connect login provider, see oidc.go
+type OIDCProviderConfig struct {
+	// short name used in urls and as prefix of users.login e.g. "acme"
+	Name string
+	// shown on login button e.g. "Acme SSO"
+	DisplayName string
+	// provider configuration is discovered from
+	// ${IssuerURL}/.well-known/openid-configuration
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// defaults to openid, profile and email
+	Scopes []string
+	// claims mapped to users.login (as ${Name}:${claim}), users.full_name
+	// and users.email. Default to sub, name and email. Email is only used
+	// if the provider says it's verified (email_verified claim)
+	LoginClaim string
+	NameClaim  string
+	EmailClaim string
+}
+
+// StorageConfig describes where note content is stored
+type StorageConfig struct {
+	// local store of note content. Defaults to localstore in data dir
+	LocalStoreDir string
+	// if set, note content is also saved to this Google Storage bucket
+	GoogleStorageBucket          string
+	GoogleStorageCredentialsFile string
+}
+
+// Config is configuration of the server
+type Config struct {
+	HTTPAddr string
+	// if set, HTTPS with certificates from Let's Encrypt is served on this
+	// address and HTTP redirects to HTTPS
+	HTTPSAddr string
+	// scheme and host under which the site is available e.g.
+	// https://quicknotes.io
+	SiteURL string
+	// directory with logs, cache and search index
+	DataDir string
+	// MySQL DSN, see https://github.com/go-sql-driver/mysql#dsn-data-source-name
+	DbDSN string
+	// keys for authenticating and encrypting login cookies, hex-encoded.
+	// if not set, random keys are generated at startup (not in production)
+	CookieAuthKeyHex string
+	CookieEncrKeyHex string
+	// hosts for which we get HTTPS certificates. Includes sub-domains
+	AllowedDomains []string
+
+	Storage StorageConfig
+	Google  OAuthProviderConfig
+	GitHub  OAuthProviderConfig
+	Twitter OAuthProviderConfig
+	OIDC    []OIDCProviderConfig
+	// e-mails for password accounts, see mailer.go
+	Mail MailConfig
+	// limits of free and pro plans, see plans.go
+	Plans PlansConfig
+}
+
+var (
+	flgConfigPath  string
+	flgPrintConfig bool
+
+	config = &Config{}
+)
+
+// configEnvVars maps names of env variables to settings they override
+func configEnvVars(c *Config) map[string]*string {
+	return map[string]*string{
+		"QUICKNOTES_HTTP_ADDR":                       &c.HTTPAddr,
+		"QUICKNOTES_HTTPS_ADDR":                      &c.HTTPSAddr,
+		"QUICKNOTES_SITE_URL":                        &c.SiteURL,
+		"QUICKNOTES_DATA_DIR":                        &c.DataDir,
+		"QUICKNOTES_DB_DSN":                          &c.DbDSN,
+		"QUICKNOTES_COOKIE_AUTH_KEY":                 &c.CookieAuthKeyHex,
+		"QUICKNOTES_COOKIE_ENCR_KEY":                 &c.CookieEncrKeyHex,
+		"QUICKNOTES_LOCAL_STORE_DIR":                 &c.Storage.LocalStoreDir,
+		"QUICKNOTES_GOOGLE_STORAGE_BUCKET":           &c.Storage.GoogleStorageBucket,
+		"QUICKNOTES_GOOGLE_STORAGE_CREDENTIALS_FILE": &c.Storage.GoogleStorageCredentialsFile,
+		"QUICKNOTES_GOOGLE_CLIENT_ID":                &c.Google.ClientID,
+		"QUICKNOTES_GOOGLE_CLIENT_SECRET":            &c.Google.ClientSecret,
+		"QUICKNOTES_GITHUB_CLIENT_ID":                &c.GitHub.ClientID,
+		"QUICKNOTES_GITHUB_CLIENT_SECRET":            &c.GitHub.ClientSecret,
+		"QUICKNOTES_TWITTER_CLIENT_ID":               &c.Twitter.ClientID,
+		"QUICKNOTES_TWITTER_CLIENT_SECRET":           &c.Twitter.ClientSecret,
+		"QUICKNOTES_MAIL_FROM":                       &c.Mail.From,
+		"QUICKNOTES_SMTP_ADDR":                       &c.Mail.SMTPAddr,
+		"QUICKNOTES_SMTP_USER":                       &c.Mail.SMTPUser,
+		"QUICKNOTES_SMTP_PASSWORD":                   &c.Mail.SMTPPassword,
+		"QUICKNOTES_MAIL_DROP_DIR":                   &c.Mail.DropDir,
+	}
+}
+
+// applyConfigEnv overrides settings with env variables. getenv is
+// os.Getenv, except in tests
+func applyConfigEnv(c *Config, getenv func(string) string) {
+	for name, dst := range configEnvVars(c) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	// comma-separated
+	if v := getenv("QUICKNOTES_ALLOWED_DOMAINS"); v != "" {
+		c.AllowedDomains = strArrRemoveEmpty(strings.Split(v, ","))
+		for i, d := range c.AllowedDomains {
+			c.AllowedDomains[i] = strings.TrimSpace(d)
+		}
+	}
+}
+
+// sets the host and/or port of database address
+func setDbDSNAddr(dsn string, host, port string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	h, p, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		h, p = cfg.Addr, "3306"
+	}
+	if host != "" {
+		h = host
+	}
+	if port != "" {
+		p = port
+	}
+	cfg.Addr = net.JoinHostPort(h, p)
+	return cfg.FormatDSN(), nil
+}
+
+// applyConfigDefaults sets defaults for settings that were not set
+func applyConfigDefaults(c *Config, production bool) {
+	if c.HTTPAddr == "" {
+		c.HTTPAddr = "127.0.0.1:5111"
+		if production {
+			c.HTTPAddr = ":80"
+		}
+	}
+	if c.HTTPSAddr == "" && production {
+		c.HTTPSAddr = ":443"
+	}
+	if c.SiteURL == "" {
+		if c.HTTPSAddr != "" && len(c.AllowedDomains) > 0 {
+			c.SiteURL = "https://" + c.AllowedDomains[0]
+		} else {
+			c.SiteURL = "http://" + c.HTTPAddr
+		}
+	}
+	c.SiteURL = strings.TrimSuffix(c.SiteURL, "/")
+	if c.DbDSN == "" && !production {
+		// mysql in docker started by s/start_docker.py
+		c.DbDSN = "root@tcp(127.0.0.1:3306)/quicknotes?parseTime=true"
+	}
+	if c.Storage.GoogleStorageBucket != "" && c.Storage.GoogleStorageCredentialsFile == "" {
+		c.Storage.GoogleStorageCredentialsFile = "credentials.json"
+	}
+	if c.Mail.From == "" {
+		c.Mail.From = "QuickNotes <noreply@quicknotes.io>"
+	}
+}
+
+func validateHexKey(name string, s string, validLens ...int) error {
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid hex string", name)
+	}
+	for _, n := range validLens {
+		if len(d) == n {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be %v bytes, is %d", name, validLens, len(d))
+}
+
+func validateOAuthConfig(name string, c *OAuthProviderConfig) error {
+	if (c.ClientID == "") != (c.ClientSecret == "") {
+		return fmt.Errorf("%s: both ClientID and ClientSecret must be set", name)
+	}
+	return nil
+}
+
+// validateConfig returns all problems with the config
+func validateConfig(c *Config, production bool) []error {
+	var errs []error
+	addErr := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, addr := range []string{c.HTTPAddr, c.HTTPSAddr} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addErr(fmt.Errorf("invalid address '%s': %s", addr, err))
+		}
+	}
+	if uri, err := url.Parse(c.SiteURL); err != nil || uri.Host == "" || (uri.Scheme != "http" && uri.Scheme != "https") {
+		addErr(fmt.Errorf("invalid SiteURL '%s', expected e.g. https://quicknotes.io", c.SiteURL))
+	}
+	if c.DbDSN == "" {
+		addErr(fmt.Errorf("DbDSN must be set"))
+	} else if cfg, err := mysql.ParseDSN(c.DbDSN); err != nil {
+		addErr(fmt.Errorf("invalid DbDSN: %s", err))
+	} else if !cfg.ParseTime {
+		addErr(fmt.Errorf("DbDSN must have parseTime=true"))
+	}
+	hasAuthKey, hasEncrKey := c.CookieAuthKeyHex != "", c.CookieEncrKeyHex != ""
+	if hasAuthKey != hasEncrKey {
+		addErr(fmt.Errorf("both CookieAuthKeyHex and CookieEncrKeyHex must be set"))
+	}
+	if hasAuthKey {
+		addErr(validateHexKey("CookieAuthKeyHex", c.CookieAuthKeyHex, 32, 64))
+	}
+	if hasEncrKey {
+		addErr(validateHexKey("CookieEncrKeyHex", c.CookieEncrKeyHex, 16, 24, 32))
+	}
+	if production && !hasAuthKey {
+		addErr(fmt.Errorf("CookieAuthKeyHex and CookieEncrKeyHex must be set in production"))
+	}
+	if c.HTTPSAddr != "" && len(c.AllowedDomains) == 0 {
+		addErr(fmt.Errorf("AllowedDomains must be set when HTTPSAddr is set"))
+	}
+	for _, d := range c.AllowedDomains {
+		if d == "" || strings.ContainsAny(d, ":/ ") {
+			addErr(fmt.Errorf("invalid domain '%s' in AllowedDomains, expected e.g. quicknotes.io", d))
+		}
+	}
+	if c.Storage.GoogleStorageBucket != "" {
+		if _, err := os.Stat(c.Storage.GoogleStorageCredentialsFile); err != nil {
+			addErr(fmt.Errorf("can't read GoogleStorageCredentialsFile: %s", err))
+		}
+	}
+	addErr(validateOAuthConfig("Google", &c.Google))
+	addErr(validateOAuthConfig("GitHub", &c.GitHub))
+	addErr(validateOAuthConfig("Twitter", &c.Twitter))
+	addErr(validateMailConfig(&c.Mail))
+	addErr(validatePlanLimits("Free", &c.Plans.Free))
+	addErr(validatePlanLimits("Pro", &c.Plans.Pro))
+	names := map[string]bool{}
+	for i := range c.OIDC {
+		p := &c.OIDC[i]
+		addErr(validateOIDCProviderConfig(p))
+		if names[p.Name] {
+			addErr(fmt.Errorf("OIDC: duplicate provider name '%s'", p.Name))
+		}
+		names[p.Name] = true
+	}
+	return errs
+}
+
+func readConfigFile(path string) (*Config, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	err = json.Unmarshal(d, &c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s': %s", path, err)
+	}
+	return &c, nil
+}
+
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+func redactDbDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return redact(dsn)
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = redactedValue
+	}
+	return cfg.FormatDSN()
+}
+
+// redacted returns a copy of config with secrets redacted, for showing
+func (c *Config) redacted() *Config {
+	res := *c
+	res.DbDSN = redactDbDSN(c.DbDSN)
+	res.CookieAuthKeyHex = redact(c.CookieAuthKeyHex)
+	res.CookieEncrKeyHex = redact(c.CookieEncrKeyHex)
+	res.Google.ClientSecret = redact(c.Google.ClientSecret)
+	res.GitHub.ClientSecret = redact(c.GitHub.ClientSecret)
+	res.Twitter.ClientSecret = redact(c.Twitter.ClientSecret)
+	res.Mail.SMTPPassword = redact(c.Mail.SMTPPassword)
+	res.OIDC = make([]OIDCProviderConfig, len(c.OIDC))
+	for i, p := range c.OIDC {
+		p.ClientSecret = redact(p.ClientSecret)
+		res.OIDC[i] = p
+	}
+	return &res
+}
+
+func printConfig(c *Config) {
+	d, err := json.MarshalIndent(c.redacted(), "", "  ")
+	if err != nil {
+		log.Fatalf("json.MarshalIndent() failed with '%s'\n", err)
+	}
+	fmt.Printf("%s\n", d)
+}
+
+// loadConfig reads config file (if given), applies env variables, flags and
+// defaults
+func loadConfig() (*Config, error) {
+	c := &Config{}
+	path := flgConfigPath
+	if path == "" {
+		path = os.Getenv("QUICKNOTES_CONFIG")
+	}
+	if path != "" {
+		var err error
+		c, err = readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	applyConfigEnv(c, os.Getenv)
+	if flgHTTPAddr != "" {
+		c.HTTPAddr = flgHTTPAddr
+	}
+	applyConfigDefaults(c, flgProduction)
+	if flgDbHost != "" || flgDbPort != "" {
+		dsn, err := setDbDSNAddr(c.DbDSN, flgDbHost, flgDbPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DbDSN: %s", err)
+		}
+		c.DbDSN = dsn
+	}
+	return c, nil
+}
+
+// loadConfigMust loads and validates config. With -print-config, prints it
+// and exits
+func loadConfigMust() {
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("loadConfig() failed with '%s'\n", err)
+	}
+	errs := validateConfig(c, flgProduction)
+	if flgPrintConfig {
+		printConfig(c)
+		for _, err := range errs {
+			fmt.Printf("error: %s\n", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Errorf("config: %s\n", err)
+		}
+		log.Fatalf("invalid config\n")
+	}
+	config = c
+	if config.DataDir != "" {
+		dataDir = config.DataDir
+	}
+	onlyLocalStorage = config.Storage.GoogleStorageBucket == ""
+	initOAuthFromConfig()
+	if !flgProduction && config.Mail.SMTPAddr == "" && config.Mail.DropDir == "" {
+		config.Mail.DropDir = filepath.Join(getDataDir(), "mail")
+	}
+	mailer = newMailer(&config.Mail)
+}
+
+// returns cookie keys from config or random keys if not configured
+func getCookieKeys() ([]byte, []byte) {
+	if config.CookieAuthKeyHex == "" {
+		log.Infof("cookie keys are not configured, using random keys. Logins won't survive restarts\n")
+		return securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)
+	}
+	authKey, _ := hex.DecodeString(config.CookieAuthKeyHex)
+	encrKey, _ := hex.DecodeString(config.CookieEncrKeyHex)
+	return authKey, encrKey
+}
+
+// isAllowedHost returns true if host is one of domains or their sub-domain
+func isAllowedHost(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
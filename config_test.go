@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	env := map[string]string{
+		"QUICKNOTES_DB_DSN":               "qn:secret@tcp(10.0.0.2:3306)/quicknotes?parseTime=true",
+		"QUICKNOTES_GITHUB_CLIENT_ID":     "id",
+		"QUICKNOTES_GITHUB_CLIENT_SECRET": "github-secret",
+		"QUICKNOTES_ALLOWED_DOMAINS":      "quicknotes.io, example.com",
+	}
+	c := &Config{HTTPAddr: ":8080", DbDSN: "ignored"}
+	applyConfigEnv(c, func(name string) string { return env[name] })
+	applyConfigDefaults(c, true)
+	if c.HTTPAddr != ":8080" || c.HTTPSAddr != ":443" || c.SiteURL != "https://quicknotes.io" {
+		t.Fatalf("unexpected defaults: %#v", c)
+	}
+	if len(c.AllowedDomains) != 2 || c.AllowedDomains[1] != "example.com" {
+		t.Fatalf("unexpected AllowedDomains: %v", c.AllowedDomains)
+	}
+
+	// cookie keys are required in production
+	errs := validateConfig(c, true)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "production") {
+		t.Fatalf("expected error about cookie keys, got %v", errs)
+	}
+	c.CookieAuthKeyHex = strings.Repeat("ab", 32)
+	c.CookieEncrKeyHex = strings.Repeat("cd", 32)
+	if errs = validateConfig(c, true); len(errs) != 0 {
+		t.Fatalf("expected valid config, got %v", errs)
+	}
+
+	r := c.redacted()
+	for _, s := range []string{r.DbDSN, r.CookieAuthKeyHex, r.CookieEncrKeyHex, r.GitHub.ClientSecret} {
+		if strings.Contains(s, "secret") || strings.Contains(s, "abab") || strings.Contains(s, "cdcd") {
+			t.Fatalf("secret not redacted in '%s'", s)
+		}
+	}
+	if !strings.Contains(r.DbDSN, "10.0.0.2:3306") || r.GitHub.ClientID != "id" {
+		t.Fatalf("too much redacted: %#v", r)
+	}
+
+	bad := &Config{
+		HTTPAddr:         "localhost",
+		SiteURL:          "quicknotes.io",
+		DbDSN:            "root@tcp(127.0.0.1:3306)/quicknotes",
+		CookieAuthKeyHex: "zz",
+		AllowedDomains:   []string{"https://quicknotes.io"},
+		Google:           OAuthProviderConfig{ClientID: "id"},
+	}
+	// address, SiteURL, parseTime, missing encr key, auth key, domain, Google
+	if errs = validateConfig(bad, false); len(errs) != 7 {
+		t.Fatalf("expected 7 errors, got %v", errs)
+	}
+
+	dsn, err := setDbDSNAddr("root@tcp(127.0.0.1:3306)/quicknotes?parseTime=true", "", "3307")
+	if err != nil || !strings.Contains(dsn, "tcp(127.0.0.1:3307)") {
+		t.Fatalf("setDbDSNAddr() returned '%s', %v", dsn, err)
+	}
+
+	domains := []string{"quicknotes.io"}
+	if !isAllowedHost("www.quicknotes.io", domains) || isAllowedHost("notquicknotes.io", domains) {
+		t.Fatalf("isAllowedHost() is wrong")
+	}
+}
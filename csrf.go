@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+State-changing requests must carry a CSRF token, either in X-CSRF-Token
+header (ajax) or in csrf form field (html forms).
+
+For logged in users the token is derived from the session token so it's
+per-session and changes on every login. For logged out users (login and
+sign up forms) we use a random value stored in a cookie (double submit).
+
+OAuth state is also bound to the browser that started the login: we store
+its hash in a short-lived cookie and the callback only accepts the state
+if it matches the cookie. Otherwise an attacker could make a victim's
+browser finish the attacker's login (login CSRF).
+*/
+
+const (
+	csrfCookieName = "qncsrf"
+	csrfFormField  = "csrf"
+	csrfHeaderName = "X-CSRF-Token"
+
+	oauthStateCookieName = "qnoauthstate"
+
+	oauthStateTimeout = 10 * time.Minute
+)
+
+var (
+	oauthStatesMu sync.Mutex
+	// state => login in progress, see putOAuthState
+	oauthStates = map[string]*oauthState{}
+)
+
+type oauthState struct {
+	redir     string
+	createdAt time.Time
+}
+
+func csrfTokenForSession(sessionToken string) string {
+	mac := hmac.New(sha256.New, cookieAuthKey)
+	mac.Write([]byte("csrf:" + sessionToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// expectedCSRFToken returns CSRF token for this request or "" if there's none
+func expectedCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if sc := getSecureCookie(w, r); sc != nil && sc.SessionToken != "" {
+		return csrfTokenForSession(sc.SessionToken)
+	}
+	if c, err := r.Cookie(csrfCookieName); err == nil && len(c.Value) >= 32 {
+		return c.Value
+	}
+	return ""
+}
+
+// csrfToken returns CSRF token to be included in forms and ajax requests,
+// setting csrf cookie if necessary
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if tok := expectedCSRFToken(w, r); tok != "" {
+		return tok
+	}
+	tok := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    tok,
+		Path:     "/",
+		HttpOnly: true,
+	})
+	return tok
+}
+
+// checkCSRF returns true if the request has a valid CSRF token
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	got := r.Header.Get(csrfHeaderName)
+	if got == "" {
+		got = r.PostFormValue(csrfFormField)
+	}
+	exp := expectedCSRFToken(w, r)
+	if got == "" || exp == "" || subtle.ConstantTimeCompare([]byte(got), []byte(exp)) != 1 {
+		log.Errorf("invalid CSRF token for '%s'\n", r.URL.Path)
+		return false
+	}
+	return true
+}
+
+func isSafeMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+func serveCSRFError(w http.ResponseWriter, r *http.Request, isJSON bool) {
+	if isJSON {
+		httpErrorWithJSONf(w, r, "invalid CSRF token")
+		return
+	}
+	http.Error(w, "invalid CSRF token, please reload the page and try again", http.StatusForbidden)
+}
+
+// isAllowedOrigin returns true if websocket connection from a given Origin
+// header is allowed: our own site, one of AllowedDomains or the host
+// the request was sent to
+func isAllowedOrigin(r *http.Request, origin string) bool {
+	// non-browser clients don't send Origin
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if host == strings.ToLower(r.Host) {
+		return true
+	}
+	if site, err := url.Parse(config.SiteURL); err == nil && host == strings.ToLower(site.Host) {
+		return true
+	}
+	for _, d := range config.AllowedDomains {
+		if host == strings.ToLower(d) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !isAllowedOrigin(r, origin) {
+		log.Errorf("rejected websocket connection from origin '%s'\n", origin)
+		return false
+	}
+	return true
+}
+
+// setOAuthStateCookie binds OAuth state to this browser
+func setOAuthStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    hashToken(state),
+		Path:     "/",
+		MaxAge:   int(oauthStateTimeout.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkOAuthStateCookie returns true if state was created in this browser
+// (see setOAuthStateCookie). The cookie is cleared as state is single-use
+func checkOAuthStateCookie(w http.ResponseWriter, r *http.Request, state string) bool {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c, err := r.Cookie(oauthStateCookieName)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(hashToken(state))) == 1
+}
+
+// putOAuthState remembers a login in progress and returns random state
+// to be sent to OAuth provider. The state is bound to this browser
+func putOAuthState(w http.ResponseWriter, redir string) string {
+	state := randomToken()
+	setOAuthStateCookie(w, state)
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+	for k, v := range oauthStates {
+		if timeExpired(v.createdAt, oauthStateTimeout) {
+			delete(oauthStates, k)
+		}
+	}
+	oauthStates[state] = &oauthState{redir: redir, createdAt: time.Now()}
+	return state
+}
+
+// popOAuthState returns redir for state from OAuth callback request and
+// forgets it, so that state can only be used once. Returns false if there's
+// no such state or it was started in a different browser
+func popOAuthState(w http.ResponseWriter, r *http.Request) (string, bool) {
+	state := r.FormValue("state")
+	if !checkOAuthStateCookie(w, r, state) {
+		log.Errorf("oauth state '%s' doesn't match state cookie\n", state)
+		return "", false
+	}
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+	st := oauthStates[state]
+	delete(oauthStates, state)
+	if st == nil || timeExpired(st.createdAt, oauthStateTimeout) {
+		return "", false
+	}
+	return st.redir, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	rr := httptest.NewRecorder()
+	tok := csrfToken(rr, httptest.NewRequest("GET", "/loginemail", nil))
+	cookies := rr.Result().Cookies()
+	if tok == "" || len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+		t.Fatalf("expected csrf cookie, got %v", cookies)
+	}
+
+	newReq := func(formTok, hdrTok string, withCookie bool) *http.Request {
+		form := url.Values{}
+		if formTok != "" {
+			form.Set(csrfFormField, formTok)
+		}
+		r := httptest.NewRequest("POST", "/loginemail", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if hdrTok != "" {
+			r.Header.Set(csrfHeaderName, hdrTok)
+		}
+		if withCookie {
+			r.AddCookie(cookies[0])
+		}
+		return r
+	}
+	tests := []struct {
+		r   *http.Request
+		exp bool
+	}{
+		{newReq(tok, "", true), true},
+		{newReq("", tok, true), true},
+		{newReq("", "", true), false},
+		{newReq(tok+"x", "", true), false},
+		{newReq(tok, "", false), false},
+	}
+	for i, test := range tests {
+		if got := checkCSRF(httptest.NewRecorder(), test.r); got != test.exp {
+			t.Errorf("test %d: expected %v, got %v", i, test.exp, got)
+		}
+	}
+}
+
+func TestIsAllowedOrigin(t *testing.T) {
+	config.SiteURL = "https://quicknotes.io"
+	config.AllowedDomains = []string{"www.quicknotes.io"}
+	r := httptest.NewRequest("GET", "http://localhost:5111/api/ws", nil)
+	tests := map[string]bool{
+		"":                          true,
+		"http://localhost:5111":     true,
+		"https://quicknotes.io":     true,
+		"https://www.quicknotes.io": true,
+		"https://evil.com":          false,
+		"http://localhost:5112":     false,
+		"null":                      false,
+	}
+	for origin, exp := range tests {
+		if got := isAllowedOrigin(r, origin); got != exp {
+			t.Errorf("origin '%s': expected %v, got %v", origin, exp, got)
+		}
+	}
+}
+
+func TestOAuthState(t *testing.T) {
+	// returns callback request from a browser that has the cookies set by rr
+	callback := func(rr *httptest.ResponseRecorder, state string) *http.Request {
+		r := httptest.NewRequest("GET", "/logingithubcb?state="+url.QueryEscape(state), nil)
+		if rr != nil {
+			for _, c := range rr.Result().Cookies() {
+				r.AddCookie(c)
+			}
+		}
+		return r
+	}
+	rr1 := httptest.NewRecorder()
+	s1 := putOAuthState(rr1, "/u/1")
+	rr2 := httptest.NewRecorder()
+	s2 := putOAuthState(rr2, "/u/2")
+	if s1 == s2 {
+		t.Fatalf("states should be random")
+	}
+	// state started in a different browser or without the cookie
+	if _, ok := popOAuthState(httptest.NewRecorder(), callback(rr2, s1)); ok {
+		t.Fatalf("state should be bound to the browser")
+	}
+	if _, ok := popOAuthState(httptest.NewRecorder(), callback(nil, s2)); ok {
+		t.Fatalf("state without cookie should be rejected")
+	}
+	rr1 = httptest.NewRecorder()
+	s1 = putOAuthState(rr1, "/u/1")
+	if redir, ok := popOAuthState(httptest.NewRecorder(), callback(rr1, s1)); !ok || redir != "/u/1" {
+		t.Fatalf("expected /u/1, got '%s' %v", redir, ok)
+	}
+	if _, ok := popOAuthState(httptest.NewRecorder(), callback(rr1, s1)); ok {
+		t.Fatalf("state should only be used once")
+	}
+	if _, ok := popOAuthState(httptest.NewRecorder(), callback(rr1, "5576867039-/")); ok {
+		t.Fatalf("unknown state should be rejected")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Export of all data of a user as a .zip file:
+
+manifest.json            - user, logins, tags and list of notes and versions
+notes/{id}-{slug}.md     - current version of a note
+versions/{id}/{n}.md     - all versions of a note, 1 is the oldest
+
+Each .md file starts with front-matter (title, tags, format, dates etc.)
+followed by content as-is, so notes in other formats are exported as
+written. Notes don't have attachments so there are no other files.
+
+Export runs in the background. The .zip is written to exports directory in
+data dir and is deleted after dataExportTimeout. A user has at most one
+export at a time.
+
+Pages:
+POST /account/data/export          : start the export
+GET  /account/data/export/download : download finished export
+*/
+
+const dataExportTimeout = 24 * time.Hour
+
+var (
+	dataExportsMu sync.Mutex
+	// user id => the latest export
+	dataExports = map[int]*DataExport{}
+)
+
+// DataExport is an export of user's data
+type DataExport struct {
+	// random, so that the download url can't be guessed
+	ID         string
+	userID     int
+	path       string
+	StartedAt  time.Time
+	IsFinished bool
+	Duration   time.Duration
+	Size       int64
+	Error      string
+}
+
+// SizeStr returns Size in human-readable form
+func (e *DataExport) SizeStr() string {
+	return formatSize(e.Size)
+}
+
+// ExportedNote describes a note in manifest.json
+type ExportedNote struct {
+	HashID    string
+	Title     string
+	Format    string
+	Tags      []string `json:",omitempty"`
+	IsPublic  bool
+	IsStarred bool
+	IsDeleted bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Path      string
+	Versions  []*ExportedVersion
+}
+
+// ExportedVersion describes a version of a note in manifest.json
+type ExportedVersion struct {
+	HashID    string
+	Title     string
+	Format    string
+	Tags      []string `json:",omitempty"`
+	CreatedAt time.Time
+	Path      string
+}
+
+// ExportManifest is manifest.json
+type ExportManifest struct {
+	ExportedAt time.Time
+	User       struct {
+		HashID    string
+		Login     string
+		FullName  string `json:",omitempty"`
+		Email     string `json:",omitempty"`
+		CreatedAt time.Time
+		Logins    []string
+	}
+	// tag => number of notes with that tag
+	Tags  map[string]int
+	Notes []*ExportedNote
+}
+
+func getDataExportsDir() string {
+	return filepath.Join(getDataDir(), "exports")
+}
+
+// noteFrontMatter returns yaml front-matter. Strings are json-encoded
+// which is also valid yaml
+func noteFrontMatter(hashID, title, format string, tags []string, createdAt, updatedAt time.Time, extra ...string) []byte {
+	js := func(v interface{}) string {
+		d, _ := json.Marshal(v)
+		return string(d)
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	lines := []string{
+		"---",
+		"id: " + js(hashID),
+		"title: " + js(title),
+		"format: " + js(format),
+		"tags: " + js(tags),
+		"created: " + createdAt.UTC().Format(time.RFC3339),
+		"updated: " + updatedAt.UTC().Format(time.RFC3339),
+	}
+	lines = append(lines, extra...)
+	lines = append(lines, "---", "")
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func zipWriteFile(zw *zip.Writer, name string, modTime time.Time, parts ...[]byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range parts {
+		if _, err = w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDataExport writes all notes and their versions to zw. versions are
+// newest first, as returned by dbGetVersionsForUser
+func writeDataExport(zw *zip.Writer, user *DbUser, logins []string, notes []*Note, versions []*NoteVersion, getContent func(sha1 []byte) ([]byte, error)) error {
+	now := time.Now()
+	var m ExportManifest
+	m.ExportedAt = now
+	m.User.HashID = hashInt(user.ID)
+	m.User.Login = user.Login
+	m.User.FullName = user.FullName.String
+	m.User.Email = user.Email.String
+	m.User.CreatedAt = user.CreatedAt
+	m.User.Logins = logins
+	m.Tags = map[string]int{}
+
+	noteVersions := map[int][]*NoteVersion{}
+	for _, v := range versions {
+		noteVersions[v.noteID] = append(noteVersions[v.noteID], v)
+	}
+	notes = append([]*Note(nil), notes...)
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].id < notes[j].id
+	})
+	for _, note := range notes {
+		hashID := hashInt(note.id)
+		name := hashID + ".md"
+		if slug := titleToSlug(note.Title); slug != "" {
+			name = hashID + "-" + slug + ".md"
+		}
+		en := &ExportedNote{
+			HashID:    hashID,
+			Title:     note.Title,
+			Format:    note.Format,
+			Tags:      note.Tags,
+			IsPublic:  note.IsPublic,
+			IsStarred: note.IsStarred,
+			IsDeleted: note.IsDeleted,
+			CreatedAt: note.CreatedAt,
+			UpdatedAt: note.UpdatedAt,
+			Path:      "notes/" + name,
+		}
+		for _, tag := range note.Tags {
+			m.Tags[tag]++
+		}
+		content, err := getContent(note.ContentSha1)
+		if err != nil {
+			return err
+		}
+		fm := noteFrontMatter(hashID, note.Title, note.Format, note.Tags, note.CreatedAt, note.UpdatedAt,
+			fmt.Sprintf("public: %v", note.IsPublic),
+			fmt.Sprintf("starred: %v", note.IsStarred),
+			fmt.Sprintf("deleted: %v", note.IsDeleted))
+		err = zipWriteFile(zw, en.Path, note.UpdatedAt, fm, content)
+		if err != nil {
+			return err
+		}
+
+		vers := noteVersions[note.id]
+		for i := len(vers) - 1; i >= 0; i-- {
+			v := vers[i]
+			ev := &ExportedVersion{
+				HashID:    hashInt(v.id),
+				Title:     v.Title,
+				Format:    v.Format,
+				Tags:      v.Tags,
+				CreatedAt: v.CreatedAt,
+				Path:      fmt.Sprintf("versions/%s/%d.md", hashID, len(en.Versions)+1),
+			}
+			content, err = getContent(v.ContentSha1)
+			if err != nil {
+				return err
+			}
+			fm = noteFrontMatter(hashID, v.Title, v.Format, v.Tags, v.CreatedAt, v.CreatedAt, "version: "+ev.HashID)
+			err = zipWriteFile(zw, ev.Path, v.CreatedAt, fm, content)
+			if err != nil {
+				return err
+			}
+			en.Versions = append(en.Versions, ev)
+		}
+		m.Notes = append(m.Notes, en)
+	}
+
+	d, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return zipWriteFile(zw, "manifest.json", now, d)
+}
+
+func exportUserData(userID int, w io.Writer) error {
+	user, err := dbGetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("no user %d", userID)
+	}
+	identities, err := dbGetUserIdentities(userID)
+	if err != nil {
+		return err
+	}
+	var logins []string
+	for _, i := range identities {
+		logins = append(logins, i.Login)
+	}
+	notes, err := dbGetNotesForUser(user)
+	if err != nil {
+		return err
+	}
+	versions, err := dbGetVersionsForUser(userID)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	// not getCachedContent, old versions would fill the cache
+	err = writeDataExport(zw, user, logins, notes, versions, localStore.GetContentBySha1)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+func runDataExport(e *DataExport) {
+	timeStart := time.Now()
+	err := os.MkdirAll(filepath.Dir(e.path), 0755)
+	var size int64
+	if err == nil {
+		var f *os.File
+		f, err = os.Create(e.path)
+		if err == nil {
+			err = exportUserData(e.userID, f)
+			if fi, err2 := f.Stat(); err2 == nil {
+				size = fi.Size()
+			}
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("exportUserData(%d) failed with '%s'\n", e.userID, err)
+		os.Remove(e.path)
+	} else {
+		log.Infof("exported data of user %d, %s in %s\n", e.userID, formatSize(size), time.Since(timeStart))
+	}
+	dataExportsMu.Lock()
+	defer dataExportsMu.Unlock()
+	e.IsFinished = true
+	e.Duration = time.Since(timeStart)
+	e.Size = size
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// startDataExport starts exporting data of a user in the background,
+// replacing previous export
+func startDataExport(userID int) error {
+	dataExportsMu.Lock()
+	defer dataExportsMu.Unlock()
+	prev := dataExports[userID]
+	if prev != nil && !prev.IsFinished {
+		return fmt.Errorf("export is already in progress")
+	}
+	if prev != nil {
+		os.Remove(prev.path)
+	}
+	id := randomToken()
+	e := &DataExport{
+		ID:        id,
+		userID:    userID,
+		path:      filepath.Join(getDataExportsDir(), fmt.Sprintf("%d-%s.zip", userID, id)),
+		StartedAt: time.Now(),
+	}
+	dataExports[userID] = e
+	go runDataExport(e)
+	return nil
+}
+
+// getDataExport returns a copy of the latest export of a user or nil
+func getDataExport(userID int) *DataExport {
+	dataExportsMu.Lock()
+	defer dataExportsMu.Unlock()
+	e := dataExports[userID]
+	if e == nil || timeExpired(e.StartedAt, dataExportTimeout) {
+		return nil
+	}
+	res := *e
+	return &res
+}
+
+func deleteDataExport(userID int) {
+	dataExportsMu.Lock()
+	defer dataExportsMu.Unlock()
+	if e := dataExports[userID]; e != nil && e.IsFinished {
+		os.Remove(e.path)
+		delete(dataExports, userID)
+	}
+}
+
+// cleanupDataExports deletes expired exports, including those left over
+// from previous runs
+func cleanupDataExports() {
+	dataExportsMu.Lock()
+	for userID, e := range dataExports {
+		if e.IsFinished && timeExpired(e.StartedAt, dataExportTimeout) {
+			delete(dataExports, userID)
+		}
+	}
+	dataExportsMu.Unlock()
+
+	dir := getDataExportsDir()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if timeExpired(fi.ModTime(), dataExportTimeout) {
+			path := filepath.Join(dir, fi.Name())
+			err = os.Remove(path)
+			log.Verbosef("deleted expired export '%s', err: %v\n", path, err)
+		}
+	}
+}
+
+// url: POST /account/data/export
+func handleAccountDataExport(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	err := startDataExport(ctx.User.id)
+	if err != nil {
+		redirectToAccountData(w, r, "", err)
+		return
+	}
+	redirectToAccountData(w, r, "Export started. Reload this page to see when it's ready.", nil)
+}
+
+// url: GET /account/data/export/download?id=${id}
+func handleAccountDataExportDownload(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	e := getDataExport(ctx.User.id)
+	if e == nil || e.ID != r.FormValue("id") || !e.IsFinished || e.Error != "" {
+		http.NotFound(w, r)
+		return
+	}
+	name := fmt.Sprintf("quicknotes-%s-%s.zip", titleToSlug(ctx.User.Handle), e.StartedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, e.path)
+}
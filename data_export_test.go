@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteDataExport(t *testing.T) {
+	initHashID()
+	t1 := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	note := &Note{}
+	note.id = 5
+	note.Title = "My note"
+	note.Format = formatMarkdown
+	note.Tags = []string{"go", "todo"}
+	note.ContentSha1 = []byte("sha2")
+	note.CreatedAt = t1
+	note.UpdatedAt = t2
+	versions := []*NoteVersion{
+		{id: 11, noteID: 5, CreatedAt: t2, ContentSha1: []byte("sha2"), Format: formatMarkdown, Title: "My note"},
+		{id: 10, noteID: 5, CreatedAt: t1, ContentSha1: []byte("sha1"), Format: formatText, Title: "first"},
+	}
+	content := map[string]string{"sha1": "first content", "sha2": "second content"}
+	getContent := func(sha1 []byte) ([]byte, error) {
+		return []byte(content[string(sha1)]), nil
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	user := &DbUser{ID: 1, Login: "github:kjk", CreatedAt: t1}
+	err := writeDataExport(zw, user, []string{"github:kjk"}, []*Note{note}, versions, getContent)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatalf("writeDataExport() failed with '%s'", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(d)
+	}
+
+	var m ExportManifest
+	if err = json.Unmarshal([]byte(files["manifest.json"]), &m); err != nil {
+		t.Fatalf("invalid manifest.json: '%s'", err)
+	}
+	if len(m.Notes) != 1 || len(m.Notes[0].Versions) != 2 || m.Tags["go"] != 1 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	n := m.Notes[0]
+	if !strings.HasSuffix(n.Path, "-my-note.md") {
+		t.Errorf("unexpected path '%s'", n.Path)
+	}
+	s := files[n.Path]
+	if !strings.HasPrefix(s, "---\n") || !strings.Contains(s, `title: "My note"`) || !strings.Contains(s, `tags: ["go","todo"]`) || !strings.HasSuffix(s, "---\nsecond content") {
+		t.Errorf("unexpected note file:\n%s", s)
+	}
+	// versions are numbered from the oldest
+	if s = files[n.Versions[0].Path]; !strings.HasSuffix(s, "first content") || !strings.HasSuffix(n.Versions[0].Path, "/1.md") {
+		t.Errorf("unexpected first version %s:\n%s", n.Versions[0].Path, s)
+	}
+	if len(files) != 4 {
+		t.Errorf("expected 4 files, got %d", len(files))
+	}
+}
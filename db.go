@@ -51,6 +51,8 @@ var (
 
 	// general purpose mutex for short-lived ops (like lookup/insert in a map)
 	mu sync.Mutex
+	// see deleteUnreferencedContent
+	muContentRefs sync.RWMutex
 )
 
 func init() {
@@ -60,25 +62,12 @@ func init() {
 }
 
 func getSQLConnection() string {
-	host := flgDbHost
-	port := flgDbPort
-	if flgProduction {
-		// private ip address
-		host = "10.138.224.27"
-		port = "3306"
-	} else if flgProdDb {
-		// public ip address
-		host = "138.68.237.61"
-		port = "3306"
-	}
-	conn := fmt.Sprintf("quicknotes:R4ISoyZ2Vj8i@tcp(%s:%s)", host, port)
-	return conn + "/quicknotes?parseTime=true"
+	return config.DbDSN
 }
 
 // like getSQLConnection() but without the password
 func getSQLConnectionSanitized() string {
-	s := getSQLConnection()
-	return strings.Replace(s, "R4ISoyZ2Vj8i", "*", -1)
+	return redactDbDSN(getSQLConnection())
 }
 
 func isValidFormat(s string) bool {
@@ -109,10 +98,21 @@ type DbUser struct {
 	Email     sql.NullString
 	OauthJSON sql.NullString
 	CreatedAt time.Time
+	IsAdmin   bool
+	// nil if account is not disabled
+	DisabledAt *time.Time
+	// nil unless user asked to delete the account, see account_deletion.go
+	DeletionRequestedAt *time.Time
 
 	handle string // e.g. 'kjk'
 }
 
+// notesHidden returns true if public notes of the user should not be shown
+// to others because the account is disabled or is being deleted
+func (u *DbUser) notesHidden() bool {
+	return u.DisabledAt != nil || u.DeletionRequestedAt != nil
+}
+
 // GetHandle returns short user handle extracted from login
 // "twitter:kjk" => "kjk"
 func (u *DbUser) GetHandle() string {
@@ -174,6 +174,14 @@ type NewNote struct {
 	isPublic    bool
 	isStarred   bool
 	contentSha1 []byte
+	// true if this is a periodic save from the editor. Those can be
+	// coalesced into the previous version (see autosave.go)
+	isAutoSave bool
+	// if non-zero, the new version replaces this version instead of
+	// being appended to the list of versions
+	replacesVersionID int
+	// set by dbCreateNewNote and dbUpdateNote2
+	versionID int
 }
 
 func newNoteFromNote(n *Note) (*NewNote, error) {
@@ -199,6 +207,11 @@ type CachedUserInfo struct {
 	user          *DbUser
 	notes         []*Note
 	latestVersion int
+
+	// built lazily, see getSuggestIndex
+	suggestMu     sync.Mutex
+	suggestAll    *SuggestIndex
+	suggestPublic *SuggestIndex
 }
 
 // SetSnippet sets a short version of note (if is big)
@@ -463,6 +476,7 @@ func dbCreateNewNote(userID int, note *NewNote) (int, error) {
 	}
 	err = tx.Commit()
 	tx = nil
+	note.versionID = int(versionID)
 	return int(noteID), err
 }
 
@@ -520,6 +534,20 @@ func dbUpdateNote2(note *NewNote, markUpdated bool) (int, error) {
 	}
 	log.Verbosef("inserted new version of note %d, new version id: %d\n", note.id, versionID)
 
+	// a coalesced auto-save replaces the previous version, so the number
+	// of versions doesn't change
+	versionsCountInc := 1
+	if note.replacesVersionID != 0 {
+		q := `DELETE FROM versions WHERE id=? AND note_id=?`
+		_, err = tx.Exec(q, note.replacesVersionID, note.id)
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+			return 0, err
+		}
+		log.Verbosef("version %d of note %d replaced by version %d\n", note.replacesVersionID, note.id, versionID)
+		versionsCountInc = 0
+	}
+
 	//Maybe: could get versions_count as:
 	//q := `SELECT count(*) FROM versions WHERE note_id=?`
 
@@ -538,7 +566,7 @@ UPDATE notes SET
   is_deleted=?,
   is_starred=?,
   curr_version_id=?,
-  versions_count = versions_count + 1
+  versions_count = versions_count + ?
 WHERE id=?`
 	_, err = tx.Exec(q,
 		noteUpdatedAt,
@@ -552,6 +580,7 @@ WHERE id=?`
 		note.isDeleted,
 		note.isStarred,
 		versionID,
+		versionsCountInc,
 		note.id)
 	if err != nil {
 		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
@@ -562,6 +591,7 @@ WHERE id=?`
 
 	err = tx.Commit()
 	tx = nil
+	note.versionID = int(versionID)
 
 	return note.id, err
 }
@@ -589,6 +619,10 @@ func dbUpdateNoteWith(userID, noteID int, markUpdated bool, updateFn func(*NewNo
 		return nil
 	}
 	_, err = dbUpdateNote2(newNote, markUpdated)
+	if err == nil {
+		updateSearchIndexForNote(userID, noteID, newNote)
+		pruneNoteVersions(userID, noteID)
+	}
 	return err
 }
 
@@ -695,6 +729,33 @@ func dbCreateOrUpdateNote(userID int, note *NewNote) (int, error) {
 		return 0, fmt.Errorf("invalid format %s", note.format)
 	}
 
+	var noteID int
+	var existingNote *Note
+	if note.hashID != "" {
+		noteID, err = dehashInt(note.hashID)
+		if err != nil {
+			return 0, err
+		}
+		existingNote, err = dbGetNoteByID(noteID)
+		if err != nil {
+			return 0, err
+		}
+		u.PanicIf(noteID != existingNote.id)
+		if existingNote.userID != userID {
+			return 0, fmt.Errorf("user %d is trying to update note that belongs to user %d", userID, existingNote.userID)
+		}
+	}
+
+	// limits of user's plan, see plans.go
+	err = checkUserQuota(userID, existingNote, len(note.content))
+	if err != nil {
+		return 0, err
+	}
+
+	// content must not be deleted by deleteUnreferencedContent before
+	// the version referencing it is saved
+	muContentRefs.RLock()
+	defer muContentRefs.RUnlock()
 	note.contentSha1, err = saveContent(note.content)
 	if err != nil {
 		log.Errorf("saveContent() failed with %s\n", err)
@@ -703,30 +764,24 @@ func dbCreateOrUpdateNote(userID int, note *NewNote) (int, error) {
 
 	defer clearCachedUserInfo(userID)
 
-	var noteID int
-	var existingNote *Note
-	if note.hashID == "" {
+	if existingNote == nil {
 		log.Verbosef("creating a new note %s\n", note.title)
 		noteID, err = dbCreateNewNote(userID, note)
 		note.hashID = hashInt(noteID)
+		if err == nil {
+			updateSearchIndexForNote(userID, noteID, note)
+		}
 		return noteID, err
 	}
 
-	noteID, err = dehashInt(note.hashID)
-	if err != nil {
-		return 0, err
-	}
-	existingNote, err = dbGetNoteByID(noteID)
-	if err != nil {
-		return 0, err
-	}
-	u.PanicIf(noteID != existingNote.id)
-	if existingNote.userID != userID {
-		return 0, fmt.Errorf("user %d is trying to update note that belongs to user %d", userID, existingNote.userID)
-	}
-
 	note.id = noteID
 
+	// an explicit save always ends a sequence of coalesced auto-saves,
+	// even if it doesn't create a new version
+	if !note.isAutoSave {
+		forgetAutoSave(noteID)
+	}
+
 	// when editing a note, we don't change starred status
 	note.isStarred = existingNote.IsStarred
 	// don't create new versions if not necessary
@@ -735,8 +790,18 @@ func dbCreateOrUpdateNote(userID int, note *NewNote) (int, error) {
 	}
 	log.Verbosef("updating existing note %d (%s). CreatedAt: %s, UpdatedAt: %s\n", existingNote.id, existingNote.HashID, existingNote.CreatedAt.Format(time.RFC3339), existingNote.UpdatedAt.Format(time.RFC3339))
 
+	if note.isAutoSave {
+		note.replacesVersionID = getCoalescableVersionID(userID, existingNote, note)
+	}
 	note.createdAt = existingNote.CreatedAt
 	noteID, err = dbUpdateNote2(note, true)
+	if err == nil {
+		updateSearchIndexForNote(userID, noteID, note)
+		pruneNoteVersions(userID, noteID)
+	}
+	if err == nil && note.isAutoSave {
+		rememberAutoSave(userID, note)
+	}
 
 	return noteID, err
 }
@@ -746,6 +811,8 @@ func dbCreateOrUpdateNote(userID int, note *NewNote) (int, error) {
 // delete from google storage
 func dbPermanentDeleteNote(userID, noteID int) error {
 	defer clearCachedUserInfo(userID)
+	forgetAutoSave(noteID)
+	removeNoteFromSearchIndex(userID, noteID)
 	db := getDbMust()
 	tx, err := db.Begin()
 	if err != nil {
@@ -1047,7 +1114,7 @@ SELECT
 	content_sha1,
 	tags
 FROM notes
-WHERE is_public=true
+WHERE is_public=true AND user_id NOT IN (` + sqlHiddenUserIDs + `)
 ORDER BY updated_at DESC
 LIMIT %d`
 
@@ -1164,11 +1231,39 @@ func isValidProState(proState int) bool {
 	}
 }
 
-// id, login, full_name, email, created_at, pro_state
-func dbGetUserByQuery(q string, args ...interface{}) (*DbUser, error) {
+// columns expected by scanDbUser
+const dbUserColumns = `id, login, full_name, email, created_at, pro_state, is_admin, disabled_at, deletion_requested_at`
+
+// sub-query for ids of users whose public notes are hidden, see notesHidden
+const sqlHiddenUserIDs = `SELECT id FROM users WHERE disabled_at IS NOT NULL OR deletion_requested_at IS NOT NULL`
+
+// scanDbUser scans dbUserColumns followed by optional extra columns
+func scanDbUser(row interface {
+	Scan(dest ...interface{}) error
+}, extra ...interface{}) (*DbUser, error) {
 	var user DbUser
+	var disabledAt, deletionRequestedAt sql.NullTime
+	dest := []interface{}{&user.ID, &user.Login, &user.FullName, &user.Email, &user.CreatedAt, &user.ProState, &user.IsAdmin, &disabledAt, &deletionRequestedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
+	}
+	if deletionRequestedAt.Valid {
+		user.DeletionRequestedAt = &deletionRequestedAt.Time
+	}
+	if !isValidProState(user.ProState) {
+		return nil, fmt.Errorf("invalid ProState '%d' for user %d", user.ProState, user.ID)
+	}
+	return &user, nil
+}
+
+// q must select dbUserColumns
+func dbGetUserByQuery(q string, args ...interface{}) (*DbUser, error) {
 	db := getDbMust()
-	err := db.QueryRow(q, args...).Scan(&user.ID, &user.Login, &user.FullName, &user.Email, &user.CreatedAt, &user.ProState)
+	user, err := scanDbUser(db.QueryRow(q, args...))
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Errorf("db.QueryRow('%s', %v) failed with '%s'\n", q, args, err)
@@ -1176,10 +1271,7 @@ func dbGetUserByQuery(q string, args ...interface{}) (*DbUser, error) {
 		}
 		return nil, nil
 	}
-	if !isValidProState(user.ProState) {
-		return nil, fmt.Errorf("invalid ProState '%d' for user from query '%s'", user.ProState, q)
-	}
-	return &user, nil
+	return user, nil
 }
 
 func dbGetUserByIDCached(userID int) (*DbUser, error) {
@@ -1201,18 +1293,22 @@ func dbGetUserByIDCached(userID int) (*DbUser, error) {
 }
 
 func dbGetUserByID(userID int) (*DbUser, error) {
-	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users WHERE id=?`
+	q := `SELECT ` + dbUserColumns + ` FROM users WHERE id=?`
 	return dbGetUserByQuery(q, userID)
 }
 
+// dbGetUserByLogin returns user with a given identity, see identities.go
 func dbGetUserByLogin(login string) (*DbUser, error) {
-	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users WHERE login=?`
+	q := `
+SELECT u.id, u.login, u.full_name, u.email, u.created_at, u.pro_state, u.is_admin, u.disabled_at, u.deletion_requested_at
+FROM users u JOIN identities i ON i.user_id = u.id
+WHERE i.login=?`
 	return dbGetUserByQuery(q, login)
 }
 
 func dbGetAllUsers() ([]*DbUser, error) {
 	db := getDbMust()
-	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users`
+	q := `SELECT ` + dbUserColumns + ` FROM users`
 	rows, err := db.Query(q)
 	if err != nil {
 		return nil, err
@@ -1220,12 +1316,11 @@ func dbGetAllUsers() ([]*DbUser, error) {
 	defer rows.Close()
 	var res []*DbUser
 	for rows.Next() {
-		var user DbUser
-		err = rows.Scan(&user.ID, &user.Login, &user.FullName, &user.Email, &user.CreatedAt)
+		user, err := scanDbUser(rows)
 		if err != nil {
 			return nil, err
 		}
-		res = append(res, &user)
+		res = append(res, user)
 	}
 	return res, rows.Err()
 }
@@ -1236,6 +1331,66 @@ func getWelcomeMD() []byte {
 	return d
 }
 
+func dbSetUserEmail(userID int, email string) error {
+	db := getDbMust()
+	q := `UPDATE users SET email = ? WHERE id = ?`
+	_, err := db.Exec(q, email, userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	mu.Lock()
+	delete(userIDToDbUserCache, userID)
+	mu.Unlock()
+	return nil
+}
+
+// txCreateUser creates a user with identity userLogin
+func txCreateUser(tx *sql.Tx, userLogin string, fullName string) (int, error) {
+	vals := NewDbVals("users", 3)
+	vals.Add("login", userLogin)
+	vals.Add("full_name", fullName)
+	vals.Add("pro_state", NotProEligible)
+	res, err := vals.TxInsert(tx)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	q := `INSERT INTO identities (login, user_id) VALUES (?, ?)`
+	_, err = tx.Exec(q, userLogin, userID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return 0, err
+	}
+	return int(userID), nil
+}
+
+// addWelcomeNote adds a note for a newly created user
+func addWelcomeNote(dbUser *DbUser) error {
+	d := getWelcomeMD()
+	if len(d) == 0 {
+		return nil
+	}
+	note := &NewNote{
+		title:     "Welcome!",
+		format:    formatMarkdown,
+		content:   d,
+		tags:      []string{"quicknotes"},
+		createdAt: time.Now(),
+		isDeleted: false,
+		isPublic:  false,
+		isStarred: false,
+	}
+	_, err := dbCreateOrUpdateNote(dbUser.ID, note)
+	if err != nil {
+		log.Errorf("dbCreateOrUpdateNote() failed with '%s'\n", err)
+	}
+	return err
+}
+
 // TODO: also insert oauthJSON
 func dbGetOrCreateUser(userLogin string, fullName string) (*DbUser, error) {
 	user, err := dbGetUserByLogin(userLogin)
@@ -1245,37 +1400,30 @@ func dbGetOrCreateUser(userLogin string, fullName string) (*DbUser, error) {
 	}
 
 	db := getDbMust()
-	vals := NewDbVals("users", 3)
-	vals.Add("login", userLogin)
-	vals.Add("full_name", fullName)
-	vals.Add("pro_state", NotProEligible)
-	_, err = vals.Insert(db)
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
-
-	dbUser, err := dbGetUserByLogin(userLogin)
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	userID, err := txCreateUser(tx, userLogin, fullName)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	tx = nil
 	if err != nil {
 		return nil, err
 	}
 
-	d := getWelcomeMD()
-	if len(d) > 0 {
-		note := &NewNote{
-			title:     "Welcome!",
-			format:    formatMarkdown,
-			content:   d,
-			tags:      []string{"quicknotes"},
-			createdAt: time.Now(),
-			isDeleted: false,
-			isPublic:  false,
-			isStarred: false,
-		}
-		_, err = dbCreateOrUpdateNote(dbUser.ID, note)
-		if err != nil {
-			log.Errorf("dbCreateOrUpdateNote() failed with '%s'\n", err)
-		}
+	dbUser, err := dbGetUserByID(userID)
+	if err != nil {
+		return nil, err
 	}
+	err = addWelcomeNote(dbUser)
 	return dbUser, err
 }
 
@@ -23,6 +23,161 @@ CREATE TABLE simplenote_imports (
     REFERENCES notes(id)
     ON DELETE CASCADE
 );
+`
+
+	sql11 = `
+CREATE TABLE saved_searches (
+  id                  INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id             INT NOT NULL,
+  name                VARCHAR(255) NOT NULL,
+  query               VARCHAR(1024) NOT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  INDEX(user_id),
+
+  FOREIGN KEY fk_saved_searches_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql12 = `
+CREATE TABLE email_accounts (
+  user_id             INT NOT NULL PRIMARY KEY,
+  password_hash       VARCHAR(255) NOT NULL,
+  verified_at         DATETIME DEFAULT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  FOREIGN KEY fk_email_accounts_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE email_verification_tokens (
+  token_hash          CHAR(64) NOT NULL PRIMARY KEY,
+  user_id             INT NOT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at          DATETIME NOT NULL,
+
+  INDEX(user_id),
+
+  FOREIGN KEY fk_email_verification_tokens_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE password_reset_tokens (
+  token_hash          CHAR(64) NOT NULL PRIMARY KEY,
+  user_id             INT NOT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at          DATETIME NOT NULL,
+
+  INDEX(user_id),
+
+  FOREIGN KEY fk_password_reset_tokens_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+`
+
+	// identities are ways of logging in linked to a user. users.login is
+	// the first of them, used for user's handle
+	sql13 = `
+CREATE TABLE identities (
+  login               VARCHAR(255) NOT NULL PRIMARY KEY,
+  user_id             INT NOT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  INDEX(user_id),
+
+  FOREIGN KEY fk_identities_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+
+INSERT INTO identities (login, user_id, created_at)
+SELECT login, id, created_at FROM users
+WHERE id IN (SELECT MIN(id) FROM users GROUP BY login);
+`
+
+	sql14 = `
+CREATE TABLE totp_secrets (
+  user_id             INT NOT NULL PRIMARY KEY,
+  secret              VARBINARY(64) NOT NULL,
+  # NULL while 2FA is being set up
+  enabled_at          DATETIME DEFAULT NULL,
+  # time step of the last used code, to not accept a code twice
+  last_used_step      BIGINT NOT NULL DEFAULT 0,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  FOREIGN KEY fk_totp_secrets_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_codes (
+  id                  INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id             INT NOT NULL,
+  code_hash           CHAR(64) NOT NULL,
+  used_at             DATETIME DEFAULT NULL,
+
+  INDEX(user_id),
+
+  FOREIGN KEY fk_recovery_codes_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql15 = `
+CREATE TABLE sessions (
+  id                  INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id             INT NOT NULL,
+  # sha256 of the token from login cookie
+  token_hash          CHAR(64) NOT NULL,
+  user_agent          VARCHAR(512) NOT NULL,
+  ip                  VARCHAR(64) NOT NULL,
+  # true if logged in with second factor
+  second_factor       BOOL NOT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_seen_at        DATETIME NOT NULL,
+
+  UNIQUE INDEX(token_hash),
+  INDEX(user_id),
+
+  FOREIGN KEY fk_sessions_user_id(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql16 = `
+ALTER TABLE users ADD COLUMN (
+  # can access /admin, see admin.go
+  is_admin            BOOL NOT NULL DEFAULT FALSE,
+  # disabled users can't log in and their notes are not shown
+  disabled_at         DATETIME NULL
+);
+
+CREATE TABLE daily_stats (
+  day                 DATE NOT NULL PRIMARY KEY,
+  users_count         INT NOT NULL,
+  notes_count         INT NOT NULL,
+  versions_count      INT NOT NULL
+);
+
+UPDATE users SET is_admin = TRUE WHERE id IN (
+  SELECT user_id FROM identities WHERE login IN ('twitter:kjk', 'github:kjk', 'google:kkowalczyk@gmail.com')
+);
+`
+
+	sql17 = `
+ALTER TABLE users ADD COLUMN (
+  # account and all notes are deleted after a grace period, see account_deletion.go
+  deletion_requested_at DATETIME NULL
+);
+
+CREATE INDEX versions_content_sha1 ON versions (content_sha1);
 `
 )
 
@@ -35,6 +190,13 @@ type DbMigration struct {
 var (
 	migrations = []DbMigration{
 		{10, sql10},
+		{11, sql11},
+		{12, sql12},
+		{13, sql13},
+		{14, sql14},
+		{15, sql15},
+		{16, sql16},
+		{17, sql17},
 	}
 )
 
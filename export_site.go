@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Exports public notes of a user (optionally only those with a given tag) as
+a static website that can be published to any static host:
+
+index.html          - list of all exported notes
+n/{id}-{slug}.html  - server-rendered note
+tag/{slug}.html     - list of notes with a given tag
+feed.atom           - atom feed of exported notes
+s/*                 - css
+
+All links are relative so the site can be hosted under any path. Notes don't
+have attachments of their own so the only files we copy are css files.
+*/
+
+var (
+	flgExportSiteUser string
+	flgExportSiteTag  string
+	flgExportSiteDir  string
+	flgExportSiteURL  string
+)
+
+// ExportTagLink is a link to tag page in exported site
+type ExportTagLink struct {
+	Name     string
+	URL      string
+	NumNotes int
+}
+
+// ExportNoteLink is a link to a note page in exported site
+type ExportNoteLink struct {
+	Title           string
+	URL             string
+	UpdatedAtString string
+}
+
+// StaticSite describes the site being exported
+type StaticSite struct {
+	Dir     string
+	BaseURL string
+	Title   string
+	Author  *UserSummary
+	Notes   []*Note
+
+	// tag name => tag page file name, without extension
+	tagToSlug map[string]string
+	tags      []string
+}
+
+func exportNoteFileName(note *Note) string {
+	slug := titleToSlug(note.Title)
+	if slug == "" {
+		return note.HashID + ".html"
+	}
+	return note.HashID + "-" + slug + ".html"
+}
+
+// root is relative path from the page to the root of the site, e.g. "../"
+func (s *StaticSite) noteLink(root string, note *Note) ExportNoteLink {
+	title := note.Title
+	if title == "" {
+		title = note.HashID
+	}
+	return ExportNoteLink{
+		Title:           title,
+		URL:             root + "n/" + url.PathEscape(exportNoteFileName(note)),
+		UpdatedAtString: note.UpdatedAt.Format("2006-01-02"),
+	}
+}
+
+func (s *StaticSite) tagLinks(root string, tags []string, tagToNotes map[string][]*Note) []ExportTagLink {
+	var res []ExportTagLink
+	for _, tag := range tags {
+		link := ExportTagLink{
+			Name:     tag,
+			URL:      root + "tag/" + url.PathEscape(s.tagToSlug[tag]) + ".html",
+			NumNotes: len(tagToNotes[tag]),
+		}
+		res = append(res, link)
+	}
+	return res
+}
+
+// assigns unique file names to tags
+func (s *StaticSite) buildTagSlugs(tagToNotes map[string][]*Note) {
+	s.tagToSlug = map[string]string{}
+	for tag := range tagToNotes {
+		s.tags = append(s.tags, tag)
+	}
+	sort.Strings(s.tags)
+	used := map[string]bool{}
+	for _, tag := range s.tags {
+		base := titleToSlug(tag)
+		if base == "" {
+			base = "tag"
+		}
+		slug := base
+		for n := 2; used[slug]; n++ {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[slug] = true
+		s.tagToSlug[tag] = slug
+	}
+}
+
+func (s *StaticSite) writeFile(name string, d []byte) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+func (s *StaticSite) writeTemplate(name string, templateName string, model interface{}) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return serveTemplateFile(path, templateName, model)
+}
+
+func (s *StaticSite) writeIndexPage(name, root, title string, notes []*Note, tags []ExportTagLink) error {
+	var links []ExportNoteLink
+	for _, note := range notes {
+		links = append(links, s.noteLink(root, note))
+	}
+	v := struct {
+		Title    string
+		Root     string
+		FeedURL  string
+		Notes    []ExportNoteLink
+		Tags     []ExportTagLink
+		SiteName string
+	}{
+		Title:    title,
+		Root:     root,
+		FeedURL:  root + "feed.atom",
+		Notes:    links,
+		Tags:     tags,
+		SiteName: s.Title,
+	}
+	return s.writeTemplate(name, tmplExportIndex, v)
+}
+
+func (s *StaticSite) writeNotePage(note *Note, tagToNotes map[string][]*Note) error {
+	noteHTML, err := renderNoteHTML(note)
+	if err != nil {
+		return err
+	}
+	root := "../"
+	link := s.noteLink(root, note)
+	name := "n/" + exportNoteFileName(note)
+	v := struct {
+		Title           string
+		Root            string
+		SiteName        string
+		FeedURL         string
+		NoteHTML        template.HTML
+		UpdatedAtString string
+		Tags            []ExportTagLink
+		Description     string
+		CanonicalURL    string
+	}{
+		Title:           link.Title,
+		Root:            root,
+		SiteName:        s.Title,
+		FeedURL:         root + "feed.atom",
+		NoteHTML:        noteHTML,
+		UpdatedAtString: link.UpdatedAtString,
+		Tags:            s.tagLinks(root, note.Tags, tagToNotes),
+		Description:     noteDescription(note),
+		CanonicalURL:    s.BaseURL + "/" + name,
+	}
+	return s.writeTemplate(name, tmplExportNote, v)
+}
+
+func (s *StaticSite) writeFeed() error {
+	notes := s.Notes
+	if len(notes) > maxFeedEntries {
+		notes = notes[:maxFeedEntries]
+	}
+	noteURL := func(note *Note) string {
+		return s.BaseURL + "/n/" + url.PathEscape(exportNoteFileName(note))
+	}
+	getAuthor := func(*Note) *AtomAuthor {
+		return &AtomAuthor{Name: s.Author.Handle}
+	}
+	d := buildAtomFeed(s.Title, s.BaseURL+"/feed.atom", s.BaseURL+"/index.html", notes, noteURL, getAuthor)
+	return s.writeFile("feed.atom", d)
+}
+
+func (s *StaticSite) copyCSS() error {
+	err := s.writeFile("s/highlight.css", []byte(getHighlightCSS()))
+	if err != nil {
+		return err
+	}
+	d, err := loadResourceFile(filepath.Join("static", "dist", "main.css"))
+	if err != nil {
+		// only exists after front-end was built
+		log.Errorf("loadResourceFile('main.css') failed with '%s'\n", err)
+		return nil
+	}
+	return s.writeFile("s/main.css", d)
+}
+
+func (s *StaticSite) export() error {
+	tagToNotes := map[string][]*Note{}
+	for _, note := range s.Notes {
+		for _, tag := range note.Tags {
+			tagToNotes[tag] = append(tagToNotes[tag], note)
+		}
+	}
+	s.buildTagSlugs(tagToNotes)
+
+	err := s.copyCSS()
+	if err != nil {
+		return err
+	}
+	allTags := s.tagLinks("", s.tags, tagToNotes)
+	err = s.writeIndexPage("index.html", "", s.Title, s.Notes, allTags)
+	if err != nil {
+		return err
+	}
+	for _, tag := range s.tags {
+		name := "tag/" + s.tagToSlug[tag] + ".html"
+		title := fmt.Sprintf("Notes tagged '%s'", tag)
+		err = s.writeIndexPage(name, "../", title, tagToNotes[tag], nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, note := range s.Notes {
+		err = s.writeNotePage(note, tagToNotes)
+		if err != nil {
+			return err
+		}
+	}
+	return s.writeFeed()
+}
+
+// exportStaticSite exports public notes of a user with a given login
+// (e.g. twitter:kjk) to dir. If tag is given, only notes with that tag
+// are exported
+func exportStaticSite(userLogin, tag, dir, baseURL string) error {
+	user, err := dbGetUserByLogin(userLogin)
+	if err != nil {
+		return fmt.Errorf("dbGetUserByLogin('%s') failed with '%s'", userLogin, err)
+	}
+	allNotes, err := dbGetNotesForUser(user)
+	if err != nil {
+		return fmt.Errorf("dbGetNotesForUser() failed with '%s'", err)
+	}
+	var notes []*Note
+	for _, note := range allNotes {
+		if isPublicNoteWithTag(note, tag) {
+			notes = append(notes, note)
+		}
+	}
+	sortNotesByUpdatedAtDesc(notes)
+
+	author := userSummaryFromDbUser(user)
+	title := fmt.Sprintf("Notes by %s", author.Handle)
+	if tag != "" {
+		title = fmt.Sprintf("Notes by %s tagged '%s'", author.Handle, tag)
+	}
+	if baseURL == "" {
+		baseURL = getSiteURL()
+	}
+	site := &StaticSite{
+		Dir:     dir,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Title:   title,
+		Author:  author,
+		Notes:   notes,
+	}
+	err = site.export()
+	if err != nil {
+		return err
+	}
+	log.Infof("exported %d notes and %d tags to '%s'\n", len(notes), len(site.tags), dir)
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+)
+
+/*
+Atom feeds of public notes:
+/feed.atom - recent public notes of all users
+/u/{userIDHash}/feed.atom - public notes of a given user
+/u/{userIDHash}/tag/{tag}/feed.atom - public notes of a given user with a given tag
+*/
+
+const (
+	maxFeedEntries = 50
+	atomNS         = "http://www.w3.org/2005/Atom"
+)
+
+// AtomLink is a link in atom feed
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+// AtomText is a text construct in atom feed
+type AtomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+// AtomAuthor is an author of atom feed entry
+type AtomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+// AtomCategory is a tag of atom feed entry
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// AtomEntry is a single entry in atom feed
+type AtomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       []AtomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     *AtomAuthor    `xml:"author,omitempty"`
+	Categories []AtomCategory `xml:"category"`
+	Summary    *AtomText      `xml:"summary,omitempty"`
+	Content    *AtomText      `xml:"content,omitempty"`
+}
+
+// AtomFeed is atom feed
+type AtomFeed struct {
+	XMLName xml.Name     `xml:"feed"`
+	NS      string       `xml:"xmlns,attr"`
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Link    []AtomLink   `xml:"link"`
+	Updated string       `xml:"updated"`
+	Author  *AtomAuthor  `xml:"author,omitempty"`
+	Entries []*AtomEntry `xml:"entry"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func isPublicNoteWithTag(note *Note, tag string) bool {
+	if !note.IsPublic || note.IsDeleted {
+		return false
+	}
+	if tag == "" {
+		return true
+	}
+	for _, t := range note.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func sortNotesByUpdatedAtDesc(notes []*Note) {
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].UpdatedAt.After(notes[j].UpdatedAt)
+	})
+}
+
+// returns a tag that changes whenever a note in the feed changes
+func notesETag(notes []*Note) string {
+	var buf bytes.Buffer
+	for _, note := range notes {
+		fmt.Fprintf(&buf, "%s-%d\n", note.HashID, note.CurrVersionID)
+	}
+	return `"` + u.Sha1HexOfBytes(buf.Bytes()) + `"`
+}
+
+func notesLastModified(notes []*Note) time.Time {
+	var res time.Time
+	for _, note := range notes {
+		if note.UpdatedAt.After(res) {
+			res = note.UpdatedAt
+		}
+	}
+	return res
+}
+
+// returns true if the client already has the latest version
+func feedNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, s := range strings.Split(inm, ",") {
+			s = strings.TrimSpace(s)
+			if s == etag || s == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// http dates have a resolution of a second
+	return !lastModified.Truncate(time.Second).After(t)
+}
+
+func noteToAtomEntry(noteURL string, note *Note, author *AtomAuthor) *AtomEntry {
+	title := note.Title
+	if title == "" {
+		title = note.HashID
+	}
+	e := &AtomEntry{
+		Title:     title,
+		ID:        noteURL,
+		Link:      []AtomLink{{Href: noteURL, Rel: "alternate", Type: "text/html"}},
+		Published: atomTime(note.CreatedAt),
+		Updated:   atomTime(note.UpdatedAt),
+		Author:    author,
+	}
+	for _, tag := range note.Tags {
+		e.Categories = append(e.Categories, AtomCategory{Term: tag})
+	}
+	noteHTML, err := renderNoteHTML(note)
+	if err != nil {
+		log.Errorf("renderNoteHTML() failed with '%s'\n", err)
+		e.Summary = &AtomText{Type: "text", Body: note.Snippet}
+	} else {
+		e.Content = &AtomText{Type: "html", Body: string(noteHTML)}
+	}
+	return e
+}
+
+func userToAtomAuthor(host string, user *UserSummary) *AtomAuthor {
+	if user == nil {
+		return nil
+	}
+	return &AtomAuthor{
+		Name: user.Handle,
+		URI:  host + "/u/" + user.HashID + "/" + user.Handle,
+	}
+}
+
+// buildAtomFeed returns feed with notes, which must be sorted by UpdatedAt,
+// most recent first. feedURL, htmlURL and urls returned by noteURL must be
+// absolute
+func buildAtomFeed(title, feedURL, htmlURL string, notes []*Note, noteURL func(*Note) string, getAuthor func(*Note) *AtomAuthor) []byte {
+	feed := &AtomFeed{
+		NS:    atomNS,
+		Title: title,
+		ID:    feedURL,
+		Link: []AtomLink{
+			{Href: feedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: htmlURL, Rel: "alternate", Type: "text/html"},
+		},
+		Updated: atomTime(notesLastModified(notes)),
+	}
+	for _, note := range notes {
+		e := noteToAtomEntry(noteURL(note), note, getAuthor(note))
+		feed.Entries = append(feed.Entries, e)
+	}
+	d, err := xml.MarshalIndent(feed, "", "  ")
+	// can only fail for types that can't be marshalled
+	u.PanicIfErr(err)
+	return append([]byte(xml.Header), d...)
+}
+
+// notes must be sorted by UpdatedAt, most recent first
+func serveAtomFeed(w http.ResponseWriter, r *http.Request, title string, htmlURL string, notes []*Note, getAuthor func(*Note) *UserSummary) {
+	if len(notes) > maxFeedEntries {
+		notes = notes[:maxFeedEntries]
+	}
+	etag := notesETag(notes)
+	lastModified := notesLastModified(notes)
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if feedNotModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	host := getMyHost(r)
+	noteURL := func(note *Note) string {
+		return host + noteURLPath(note.HashID, note.Title)
+	}
+	getAtomAuthor := func(note *Note) *AtomAuthor {
+		return userToAtomAuthor(host, getAuthor(note))
+	}
+	d := buildAtomFeed(title, host+r.URL.Path, host+htmlURL, notes, noteURL, getAtomAuthor)
+	httpOkBytesWithContentType(w, r, "application/atom+xml; charset=utf-8", d)
+}
+
+// parses /u/{userIDHash}/feed.atom and /u/{userIDHash}/tag/{tag}/feed.atom
+func parseUserFeedURI(uri string) (string, string, bool) {
+	s := strings.TrimPrefix(uri, "/u/")
+	s = strings.TrimSuffix(s, "/feed.atom")
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 1:
+		return parts[0], "", true
+	case 3:
+		if parts[1] != "tag" {
+			return "", "", false
+		}
+		tag, err := url.PathUnescape(parts[2])
+		if err != nil || tag == "" {
+			return "", "", false
+		}
+		return parts[0], tag, true
+	}
+	return "", "", false
+}
+
+// /u/{userIDHash}/feed.atom
+// /u/{userIDHash}/tag/{tag}/feed.atom
+func handleUserFeed(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	userIDHash, tag, ok := parseUserFeedURI(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := dehashInt(userIDHash)
+	if err != nil {
+		log.Errorf("invalid userID='%s'\n", userIDHash)
+		http.NotFound(w, r)
+		return
+	}
+	i, err := getCachedUserInfo(userID)
+	if err != nil || i == nil || i.user.notesHidden() {
+		log.Errorf("no user '%d', url: '%s', err: %s\n", userID, r.URL, err)
+		http.NotFound(w, r)
+		return
+	}
+	var notes []*Note
+	for _, note := range i.notes {
+		if isPublicNoteWithTag(note, tag) {
+			notes = append(notes, note)
+		}
+	}
+	sortNotesByUpdatedAtDesc(notes)
+
+	author := userSummaryFromDbUser(i.user)
+	title := fmt.Sprintf("Notes by %s", author.Handle)
+	if tag != "" {
+		title = fmt.Sprintf("Notes by %s tagged '%s'", author.Handle, tag)
+	}
+	htmlURL := "/u/" + author.HashID + "/" + author.Handle
+	getAuthor := func(*Note) *UserSummary {
+		return author
+	}
+	serveAtomFeed(w, r, title, htmlURL, notes, getAuthor)
+}
+
+// /feed.atom
+func handleRecentNotesFeed(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	recentNotes, err := getRecentPublicNotesCached(maxFeedEntries)
+	if err != nil {
+		httpErrorf(w, "getRecentPublicNotesCached() failed with %s", err)
+		return
+	}
+	var notes []*Note
+	for i := range recentNotes {
+		note := &recentNotes[i]
+		if isPublicNoteWithTag(note, "") {
+			notes = append(notes, note)
+		}
+	}
+	sortNotesByUpdatedAtDesc(notes)
+
+	getAuthor := func(note *Note) *UserSummary {
+		user, err := dbGetUserByIDCached(note.userID)
+		if err != nil {
+			return nil
+		}
+		return userSummaryFromDbUser(user)
+	}
+	serveAtomFeed(w, r, "QuickNotes recent public notes", "/idx/allnotes", notes, getAuthor)
+}
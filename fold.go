@@ -0,0 +1,223 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+Unicode-aware normalization (folding) of text for search.
+
+Text of notes and search terms is folded before matching:
+- NFKD decomposition, so that compatibility characters (ligatures, full-width
+  forms etc.) match their plain equivalents
+- combining marks are removed from letters in Latin, Greek and Cyrillic
+  scripts, so "resume" matches "résumé"
+- case folding i.e. lower-casing and ß => ss, ς => σ, dotless ı => i (and
+  İ => i, since its dot is a combining mark)
+- NFC composition of what's left (e.g. Hangul, Japanese voiced kana)
+
+Text is folded one rune at a time and for every byte of folded text we
+remember where the rune it came from starts in the original text. That way
+positions of matches in folded text can be mapped back to positions in the
+original text, for highlighting.
+
+Text in CJK scripts doesn't separate words with spaces, so tokenize splits
+runs of CJK characters into overlapping bigrams.
+*/
+
+var foldSpecialCases = map[rune]string{
+	'ß': "ss",
+	'ẞ': "ss",
+	'ς': "σ",
+	'ı': "i",
+}
+
+// FoldedText is text folded for search, see foldText
+type FoldedText struct {
+	s       string
+	origLen int
+	// starts[i] is the offset in original text of the rune that was folded
+	// into byte i of s. nil if s has the same layout as original text
+	starts []int32
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// returns true if combining marks after c should be removed
+func isStripMarksRune(c rune) bool {
+	return unicode.In(c, unicode.Latin, unicode.Greek, unicode.Cyrillic)
+}
+
+// isCJKRune returns true for characters of scripts that don't separate
+// words with spaces
+func isCJKRune(c rune) bool {
+	// katakana-hiragana prolonged sound mark is in Common script
+	return c == 'ー' || unicode.In(c, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// appendFoldedRune appends folded c to d. stripMarks is true if the last
+// letter was Latin, Greek or Cyrillic i.e. combining marks should be removed
+func appendFoldedRune(d []byte, c rune, stripMarks *bool) []byte {
+	if c < utf8.RuneSelf {
+		b := byte(c)
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		*stripMarks = 'a' <= b && b <= 'z'
+		return append(d, b)
+	}
+
+	var buf [utf8.UTFMax]byte
+	var decomposed [4 * utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], c)
+	rest := norm.NFKD.Append(decomposed[:0], buf[:n]...)
+	start := len(d)
+	for len(rest) > 0 {
+		r, size := utf8.DecodeRune(rest)
+		rest = rest[size:]
+		if unicode.Is(unicode.Mn, r) {
+			if *stripMarks {
+				continue
+			}
+		} else {
+			*stripMarks = isStripMarksRune(r)
+		}
+		if s, ok := foldSpecialCases[r]; ok {
+			d = append(d, s...)
+			continue
+		}
+		n = utf8.EncodeRune(buf[:], unicode.ToLower(r))
+		d = append(d, buf[:n]...)
+	}
+	if folded := d[start:]; !norm.NFC.IsNormal(folded) {
+		composed := norm.NFC.Append(nil, folded...)
+		d = append(d[:start], composed...)
+	}
+	return d
+}
+
+// foldText folds text for search
+func foldText(s string) *FoldedText {
+	if isASCII(s) {
+		return &FoldedText{
+			s:       strings.ToLower(s),
+			origLen: len(s),
+		}
+	}
+	d := make([]byte, 0, len(s))
+	starts := make([]int32, 0, len(s))
+	sameLayout := true
+	stripMarks := false
+	// start of the previous rune in d and in s
+	prevStart, prevOrig := -1, 0
+	for i, c := range s {
+		n, orig := len(d), i
+		d = appendFoldedRune(d, c, &stripMarks)
+		// layout is the same if c was folded into a single rune of the
+		// same size
+		_, size := utf8.DecodeRuneInString(s[i:])
+		if _, foldedSize := utf8.DecodeRune(d[n:]); len(d)-n != size || foldedSize != size {
+			sameLayout = false
+		}
+		if prevStart != -1 && len(d) > n && unicode.Is(unicode.M, c) && !norm.NFC.IsNormal(d[prevStart:]) {
+			// compose with the previous rune e.g. decomposed voiced kana
+			composed := norm.NFC.Append(nil, d[prevStart:]...)
+			d = append(d[:prevStart], composed...)
+			starts = starts[:prevStart]
+			n, orig = prevStart, prevOrig
+			sameLayout = false
+		}
+		if len(d) > n {
+			prevStart, prevOrig = n, orig
+		}
+		for ; n < len(d); n++ {
+			starts = append(starts, int32(orig))
+		}
+	}
+	res := &FoldedText{
+		s:       string(d),
+		origLen: len(s),
+	}
+	if !sameLayout {
+		res.starts = starts
+	}
+	return res
+}
+
+// foldString returns s folded for search
+func foldString(s string) string {
+	return foldText(s).s
+}
+
+// isMapped returns true if positions in folded text are different than
+// positions in original text
+func (t *FoldedText) isMapped() bool {
+	return t.starts != nil
+}
+
+// origPos maps offset in folded text to offset in original text
+func (t *FoldedText) origPos(pos int) int {
+	if pos >= len(t.starts) {
+		return t.origLen
+	}
+	return int(t.starts[pos])
+}
+
+// origEnd returns the offset in original text of the end of the rune that
+// was folded into byte pos of folded text. Removed combining marks that
+// follow the rune are included
+func (t *FoldedText) origEnd(pos int) int {
+	start := t.starts[pos]
+	for pos < len(t.starts) && t.starts[pos] == start {
+		pos++
+	}
+	return t.origPos(pos)
+}
+
+// mapPositions maps sorted positions of matches in folded text to positions
+// in original text. Matches that end up overlapping (e.g. "s" in "ß", which
+// is folded to "ss") are merged
+func (t *FoldedText) mapPositions(a []PosLen) []PosLen {
+	if !t.isMapped() || len(a) == 0 {
+		return a
+	}
+	res := make([]PosLen, 0, len(a))
+	for _, pl := range a {
+		start := t.origPos(pl.Pos)
+		end := t.origEnd(pl.Pos + pl.Len - 1)
+		if n := len(res); n > 0 {
+			last := &res[n-1]
+			if start < last.Pos+last.Len {
+				if end > last.Pos+last.Len {
+					last.Len = end - last.Pos
+				}
+				continue
+			}
+		}
+		res = append(res, PosLen{Pos: start, Len: end - start})
+	}
+	return res
+}
+
+// mapMatch returns a copy of match with positions mapped to positions in
+// original title and body
+func mapMatch(match *Match, title, body *FoldedText) *Match {
+	if match == nil || (!title.isMapped() && !body.isMapped()) {
+		return match
+	}
+	res := *match
+	res.titleMatchPos = title.mapPositions(match.titleMatchPos)
+	res.bodyMatchPos = body.mapPositions(match.bodyMatchPos)
+	return &res
+}
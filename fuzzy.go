@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+Typo-tolerant (fuzzy) and prefix matching of search terms against words
+(runs of letters and digits, same as terms in search index).
+
+- fuzzy term matches words within a given edit distance. We use optimal
+  string alignment distance i.e. insertions, deletions, substitutions and
+  transpositions of adjacent characters each count as 1 edit. Fuzzy terms
+  also match as substrings, like regular terms
+- prefix term only matches at the start of words
+- fuzzy prefix term matches words whose prefix is within edit distance
+
+Fuzzy and prefix matching only applies to terms that are single words.
+*/
+
+// autoFuzzyEdits returns max number of edits appropriate for a term:
+// short terms must match exactly
+func autoFuzzyEdits(term string) int {
+	n := utf8.RuneCountInString(term)
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	}
+	return 2
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// osaDistanceMatrix returns matrix d where d[i][j] is optimal string
+// alignment distance between a[:i] and b[:j]
+func osaDistanceMatrix(a, b []rune) [][]int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			v := minInt(d[i-1][j]+1, d[i][j-1]+1)
+			v = minInt(v, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				v = minInt(v, d[i-2][j-2]+1)
+			}
+			d[i][j] = v
+		}
+	}
+	return d
+}
+
+func osaDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	return osaDistanceMatrix(ra, rb)[len(ra)][len(rb)]
+}
+
+// prefixDistance returns the smallest distance between a and a prefix of b
+// and the length of that prefix in bytes. Among equally distant prefixes
+// we pick the one closest in length to a
+func prefixDistance(a, b string) (int, int) {
+	ra, rb := []rune(a), []rune(b)
+	d := osaDistanceMatrix(ra, rb)
+	last := d[len(ra)]
+	bestJ := 0
+	for j := 1; j <= len(rb); j++ {
+		if last[j] < last[bestJ] || (last[j] == last[bestJ] && absInt(j-len(ra)) < absInt(bestJ-len(ra))) {
+			bestJ = j
+		}
+	}
+	return last[bestJ], len(string(rb[:bestJ]))
+}
+
+// matchWord returns positions of matches of term in word, relative to the
+// start of the word. Only for fuzzy or prefix terms
+func (term *QueryTerm) matchWord(word string) []PosLen {
+	text := term.Text
+	if !isIndexTerm(word) {
+		// CJK bigrams
+		return nil
+	}
+	if term.Prefix {
+		if strings.HasPrefix(word, text) {
+			return []PosLen{{0, len(text)}}
+		}
+		if term.Fuzzy == 0 || utf8.RuneCountInString(word) < utf8.RuneCountInString(text)-term.Fuzzy {
+			return nil
+		}
+		dist, n := prefixDistance(text, word)
+		if dist <= term.Fuzzy {
+			return []PosLen{{0, n}}
+		}
+		return nil
+	}
+
+	if absInt(utf8.RuneCountInString(word)-utf8.RuneCountInString(text)) <= term.Fuzzy {
+		if osaDistance(text, word) <= term.Fuzzy {
+			return []PosLen{{0, len(word)}}
+		}
+	}
+	return appendTermMatches(nil, word, 0, text)
+}
+
+// isWordTerm returns true if term is matched against whole words
+func (term *QueryTerm) isWordTerm() bool {
+	return (term.Fuzzy > 0 || term.Prefix) && isIndexTerm(term.Text)
+}
+
+// limits number of matches the same way searchTitleAndBody does
+func limitMatches(match *Match, maxMatches int) {
+	if maxMatches == -1 {
+		return
+	}
+	if len(match.titleMatchPos) >= maxMatches {
+		match.bodyMatchPos = nil
+		return
+	}
+	if n := maxMatches - len(match.titleMatchPos); len(match.bodyMatchPos) > n {
+		match.bodyMatchPos = match.bodyMatchPos[:n]
+	}
+}
+
+// searchWordsInTitleAndBody is like searchFoldedTitleAndBody for fuzzy and
+// prefix terms
+func searchWordsInTitleAndBody(term *QueryTerm, title, body *FoldedText, maxMatches int) *Match {
+	var match Match
+	tokenize(title.s, func(word string, pos int) {
+		for _, pl := range term.matchWord(word) {
+			match.titleMatchPos = append(match.titleMatchPos, PosLen{pos + pl.Pos, pl.Len})
+		}
+	})
+	tokenize(body.s, func(word string, pos int) {
+		for _, pl := range term.matchWord(word) {
+			match.bodyMatchPos = append(match.bodyMatchPos, PosLen{pos + pl.Pos, pl.Len})
+		}
+	})
+	if len(match.titleMatchPos) == 0 && len(match.bodyMatchPos) == 0 {
+		return nil
+	}
+	limitMatches(&match, maxMatches)
+	return mapMatch(&match, title, body)
+}
@@ -15,18 +15,15 @@ import (
 	"google.golang.org/api/option"
 )
 
-const (
-	quicknotesBucket = "quicknotes"
-)
-
 var (
 	googleStorageClient *storage.Client
-	// if true, don't save notes to Google Storage. Enabled when running locally
+	// if true, don't save notes to Google Storage. Set if
+	// config.Storage.GoogleStorageBucket is not set
 	onlyLocalStorage bool
 )
 
 func loadGoogleStorageCredentialsMust() []byte {
-	d, err := ioutil.ReadFile("credentials.json")
+	d, err := ioutil.ReadFile(config.Storage.GoogleStorageCredentialsFile)
 	u.PanicIfErr(err)
 	return d
 }
@@ -52,7 +49,7 @@ func testListObjects() {
 	nTotal := 0
 	timeStart := time.Now()
 
-	it := googleStorageClient.Bucket(quicknotesBucket).Objects(ctx, query)
+	it := googleStorageClient.Bucket(config.Storage.GoogleStorageBucket).Objects(ctx, query)
 	for {
 		_, err := it.Next()
 		if err == iterator.Done {
@@ -83,7 +80,7 @@ func saveNoteToGoogleStorage(sha1 []byte, d []byte) error {
 	timeStart := time.Now()
 	path := noteGoogleStoragePath(sha1)
 	ctx := context.Background()
-	objHandle := googleStorageClient.Bucket(quicknotesBucket).Object(path)
+	objHandle := googleStorageClient.Bucket(config.Storage.GoogleStorageBucket).Object(path)
 	_, err := objHandle.Attrs(ctx)
 	if err == nil {
 		// already exists
@@ -115,11 +112,30 @@ func saveNoteToGoogleStorage(sha1 []byte, d []byte) error {
 	return nil
 }
 
+func deleteNoteFromGoogleStorage(sha1 []byte) error {
+	if onlyLocalStorage {
+		return nil
+	}
+	path := noteGoogleStoragePath(sha1)
+	objHandle := googleStorageClient.Bucket(config.Storage.GoogleStorageBucket).Object(path)
+	err := objHandle.Delete(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		log.Errorf("storage.Delete('%s') failed with %s\n", path, err)
+	}
+	return err
+}
+
 func readNoteFromGoogleStorage(sha1 []byte) ([]byte, error) {
+	if googleStorageClient == nil {
+		return nil, fmt.Errorf("google storage is not configured")
+	}
 	timeStart := time.Now()
 	path := noteGoogleStoragePath(sha1)
 	ctx := context.Background()
-	objHandle := googleStorageClient.Bucket(quicknotesBucket).Object(path)
+	objHandle := googleStorageClient.Bucket(config.Storage.GoogleStorageBucket).Object(path)
 	r, err := objHandle.NewReader(ctx)
 	if err != nil {
 		return nil, err
@@ -185,16 +185,12 @@ func markSimpleNoteImported(state *SimpleNoteImport, noteID int, simplenoteID st
 	return nil
 }
 
-func dbIsUserMe(userID int) bool {
+func dbIsUserAdmin(userID int) bool {
 	userDb, err := dbGetUserByIDCached(userID)
-	if err != nil {
+	if err != nil || userDb == nil {
 		return false
 	}
-	switch userDb.Login {
-	case "twitter:kjk", "github:kjk", "google:kkowalczyk@gmail.com":
-		return true
-	}
-	return false
+	return userDb.IsAdmin
 }
 
 // other system tags: published, pinned
@@ -312,10 +308,10 @@ func importPreviousVersions(state *SimpleNoteImport, noteLastVer *simplenote.Not
 
 func importSimpleNote(state *SimpleNoteImport, email, password string) {
 	id := state.importID
-	state.shouldConvertPublic = dbIsUserMe(state.userID)
-	// for now only import previous versions for me
+	state.shouldConvertPublic = dbIsUserAdmin(state.userID)
+	// for now only import previous versions for admins
 	// Maybe: enable for everyone with a checkbox in import dialog
-	importPrevious := dbIsUserMe(state.userID)
+	importPrevious := dbIsUserAdmin(state.userID)
 	state.client = simplenote.NewClient(simplenoteAPIKey, email, password)
 	notes, err := state.client.List()
 	if err != nil {
@@ -350,6 +346,8 @@ func importSimpleNote(state *SimpleNoteImport, email, password string) {
 
 	if err == nil {
 		importMarkFinished(id)
+	} else if _, ok := err.(*QuotaError); ok {
+		importSetError(id, fmt.Sprintf("Import stopped because %s", err))
 	} else {
 		importSetError(id, err.Error())
 	}
@@ -390,7 +388,7 @@ func handleAPIImportSimpleNotesStatus(ctx *ReqContext, w http.ResponseWriter, r
 	httpOkWithJSON(w, r, status)
 }
 
-/* GET /api/import_simplenote_start
+/* POST /api/import_simplenote_start
 args:
   email   : simplenote user e-email
   assword : simplenote user password
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -21,13 +20,8 @@ import (
 )
 
 const (
-	cookieAuthKeyHex  = "513521f0ef43c9446ed7bf359a5a9700ef5fa5a5eb15d0db5eae8e93856d99bd"
-	cookieEncrKeyHex  = "4040ed16d4352320b5a7f51e26443342d55a0f46be2acfe5ba694a123230376a"
 	cookieName        = "qnckie"      // "quicknotes cookie"
 	sessionCookieName = "sess_qnckie" // "session quicknotes cookie"
-
-	// random string for oauth2 API calls to protect against CSRF
-	oauthSecretPrefix = "5576867039-"
 )
 
 var (
@@ -46,16 +40,13 @@ var (
 		TokenURL: "https://accounts.google.com/o/oauth2/token",
 	}
 
+	// client ids and secrets are set from config in initOAuthFromConfig
 	oauthGoogleConf = &oauth2.Config{
-		ClientID:     "393285548407-rau0ccv7h7chin1auv5v179jdq7rkvqf.apps.googleusercontent.com",
-		ClientSecret: "KP7eRR9zVPlY3fXNeTUl5ZIr",
-		Scopes:       []string{goauth2.UserinfoProfileScope, goauth2.UserinfoEmailScope},
-		Endpoint:     googleEndpoint,
+		Scopes:   []string{goauth2.UserinfoProfileScope, goauth2.UserinfoEmailScope},
+		Endpoint: googleEndpoint,
 	}
 
 	oauthGitHubConf = &oauth2.Config{
-		ClientID:     "0de5b60a98b0f3fbb187",
-		ClientSecret: "a46a61a26d7841a5206b5e1d9313cf3e3f1150e8",
 		// select level of access you want https://developer.github.com/v3/oauth/#scopes
 		Scopes:   []string{"user:email", "repo"},
 		Endpoint: githubEndpoint,
@@ -65,10 +56,6 @@ var (
 		TemporaryCredentialRequestURI: "https://api.twitter.com/oauth/request_token",
 		TokenRequestURI:               "https://api.twitter.com/oauth/access_token",
 		ResourceOwnerAuthorizationURI: "https://api.twitter.com/oauth/authenticate",
-		Credentials: oauth.Credentials{
-			Secret: "wdDXapzG5zEeQ7ToJnABvBIoGmLFLdvueT7vGMPjCvjUNAU928",
-			Token:  "rYmWoMXQ3Wwx69do31TW4DRes",
-		},
 	}
 
 	muLogin     sync.Mutex
@@ -78,23 +65,33 @@ var (
 // SecureCookieValue is value of the cookie
 type SecureCookieValue struct {
 	UserID int
+	// identifies server-side session, see sessions.go
+	SessionToken string
 }
 
 func initCookieMust() {
-	var err error
-	cookieAuthKey, err = hex.DecodeString(cookieAuthKeyHex)
-	u.PanicIfErr(err)
-	cookieEncrKey, err = hex.DecodeString(cookieEncrKeyHex)
-	u.PanicIfErr(err)
+	cookieAuthKey, cookieEncrKey = getCookieKeys()
 	secureCookie = securecookie.New(cookieAuthKey, cookieEncrKey)
 	// verify auth/encr keys are correct
 	val := map[string]string{
 		"foo": "bar",
 	}
-	_, err = secureCookie.Encode(cookieName, val)
+	_, err := secureCookie.Encode(cookieName, val)
 	u.PanicIfErr(err)
 }
 
+func initOAuthFromConfig() {
+	oauthGoogleConf.ClientID = config.Google.ClientID
+	oauthGoogleConf.ClientSecret = config.Google.ClientSecret
+	oauthGitHubConf.ClientID = config.GitHub.ClientID
+	oauthGitHubConf.ClientSecret = config.GitHub.ClientSecret
+	oauthTwitterClient.Credentials = oauth.Credentials{
+		Token:  config.Twitter.ClientID,
+		Secret: config.Twitter.ClientSecret,
+	}
+	initOIDCProviders(config.OIDC)
+}
+
 func setSecureCookie(w http.ResponseWriter, cookieVal *SecureCookieValue) {
 	if encoded, err := secureCookie.Encode(cookieName, cookieVal); err == nil {
 		// TODO: set expiration (Expires    time.Time) long time in the future?
@@ -169,12 +166,39 @@ func getDbUserFromCookie(w http.ResponseWriter, r *http.Request) *DbUser {
 	if sc == nil {
 		return nil
 	}
-	user, err := dbGetUserByID(sc.UserID)
+	user, _ := getSessionFromCookie(w, r)
+	return user
+}
+
+// getSessionFromCookie returns logged-in user and their session
+func getSessionFromCookie(w http.ResponseWriter, r *http.Request) (*DbUser, *Session) {
+	sc := getSecureCookie(w, r)
+	if sc == nil {
+		return nil, nil
+	}
+	sess, err := getSession(sc.SessionToken)
 	if err != nil {
-		log.Errorf("dbGetUserById(%d) failed with %s\n", sc.UserID, err)
-		return nil
+		return nil, nil
 	}
-	return user
+	if sess == nil || sess.userID != sc.UserID {
+		// revoked, expired or from before we had sessions
+		deleteSecureCookie(w)
+		return nil, nil
+	}
+	user, err := dbGetUserByIDCached(sc.UserID)
+	if err != nil {
+		log.Errorf("dbGetUserByIDCached(%d) failed with %s\n", sc.UserID, err)
+		return nil, nil
+	}
+	if user == nil || user.DisabledAt != nil {
+		return nil, nil
+	}
+	if !sess.SecondFactor && userHas2FA(user.ID) {
+		log.Verbosef("user %d has 2FA but session %d is without it\n", user.ID, sess.ID)
+		return nil, nil
+	}
+	touchSession(w, r, sess, sc)
+	return user, sess
 }
 
 func putTempCredentials(cred *oauth.Credentials) {
@@ -237,6 +261,60 @@ func fixLoginRedir(redir string, u *DbUser) string {
 	return redir
 }
 
+// loginUser logs in a user with a given login, creating the user if
+// necessary, and redirects to redir. email is optional
+func loginUser(w http.ResponseWriter, r *http.Request, userLogin, fullName, email, redir string) {
+	// logged-in user is adding a login method, see identities.go
+	if user, sess := getSessionFromCookie(w, r); sess != nil && popPendingLink(sess) {
+		linkIdentity(w, r, user, userLogin)
+		return
+	}
+	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
+	if err != nil {
+		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
+		// TODO: show error to the user
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	log.Verbosef("got or created user %d, login: '%s'\n", dbUser.ID, userLogin)
+	if email != "" && dbUser.Email.String != email {
+		err = dbSetUserEmail(dbUser.ID, email)
+		if err != nil {
+			log.Errorf("dbSetUserEmail(%d) failed with '%s'\n", dbUser.ID, err)
+		}
+	}
+	logInDbUser(w, r, dbUser, redir)
+}
+
+// logInDbUser sets login cookie for the user and redirects to redir. If the
+// user has 2FA, asks for second factor first
+func logInDbUser(w http.ResponseWriter, r *http.Request, dbUser *DbUser, redir string) {
+	if dbUser.DisabledAt != nil {
+		log.Infof("disabled user %d tried to log in\n", dbUser.ID)
+		http.Error(w, "This account has been disabled.", http.StatusForbidden)
+		return
+	}
+	// redir comes from the login url so it must not go to another site
+	redir = fixLoginRedir(sanitizeRedir(redir), dbUser)
+	if dbUser.DeletionRequestedAt != nil {
+		// so that they can cancel the deletion, see account_deletion.go
+		redir = "/account/data"
+	}
+	if userHas2FA(dbUser.ID) {
+		startSecondFactor(w, r, dbUser, redir)
+		return
+	}
+	err := startSession(w, r, dbUser.ID, false)
+	if err != nil {
+		log.Errorf("startSession(%d) failed with '%s'\n", dbUser.ID, err)
+		httpErrorf(w, "failed to log in")
+		return
+	}
+
+	// StatusFound so that redirect after POST is a GET
+	http.Redirect(w, r, redir, http.StatusFound)
+}
+
 // url: GET /logintwittercb?redir=${redirect}
 func handleOauthTwitterCallback(w http.ResponseWriter, r *http.Request) {
 	redir := strings.TrimSpace(r.FormValue("redir"))
@@ -277,27 +355,17 @@ func handleOauthTwitterCallback(w http.ResponseWriter, r *http.Request) {
 	// avatar_url
 	userLogin := "twitter:" + twitterHandle
 	// TODO: oauthJSON
-	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
-	if err != nil {
-		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
-		// TODO: show error to the user
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-	log.Verbosef("got or created user %d, login: '%s'\n", dbUser.ID, userLogin)
-	cookieVal := &SecureCookieValue{
-		UserID: dbUser.ID,
-	}
-	setSecureCookie(w, cookieVal)
-
-	redir = fixLoginRedir(redir, dbUser)
-	http.Redirect(w, r, redir, http.StatusTemporaryRedirect)
+	loginUser(w, r, userLogin, fullName, "", redir)
 }
 
 // url: GET /logintwitter?redir=${redirect}
 func handleLoginTwitter(w http.ResponseWriter, r *http.Request) {
 	redir := strings.TrimSpace(r.FormValue("redir"))
 	log.Verbosef("url: '%s', redir: '%s'\n", r.URL, redir)
+	if config.Twitter.ClientID == "" {
+		httpErrorf(w, "login with Twitter is not configured")
+		return
+	}
 
 	q := url.Values{
 		"redir": {redir},
@@ -332,18 +400,13 @@ func tokenFromJSON(jsonStr string) (*oauth2.Token, error) {
 // logingithubcb
 func handleOauthGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	state := r.FormValue("state")
-	if !strings.HasPrefix(state, oauthSecretPrefix) {
-		log.Errorf("invalid oauth state, expected '%s', got '%s'\n", oauthSecretPrefix, state)
+	// state was remembered in handleLoginGitHub
+	redir, ok := popOAuthState(w, r)
+	if !ok {
+		log.Errorf("invalid or expired oauth state '%s'\n", state)
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
-
-	// extract redir from secret (added in handleLoginGitHub
-	redir := state[len(oauthSecretPrefix):]
-	if redir == "" {
-		log.Errorf("missing 'redir' arg\n")
-		redir = "/"
-	}
 	log.Verbosef("url: '%s', state: '%s', redir: '%s'\n", r.URL, state, redir)
 
 	code := r.FormValue("code")
@@ -371,21 +434,7 @@ func handleOauthGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	// profile_image_url
 	// profile_image_url_https
 	userLogin := "github:" + githubLogin
-	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
-	if err != nil {
-		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
-		// TODO: show error to the user
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-	log.Verbosef("got or created user %d, login: '%s'\n", dbUser.ID, userLogin)
-	cookieVal := &SecureCookieValue{
-		UserID: dbUser.ID,
-	}
-	setSecureCookie(w, cookieVal)
-
-	redir = fixLoginRedir(redir, dbUser)
-	http.Redirect(w, r, redir, http.StatusTemporaryRedirect)
+	loginUser(w, r, userLogin, fullName, "", redir)
 }
 
 // /logingithub?redir=${redirect}
@@ -395,31 +444,30 @@ func handleLoginGitHub(w http.ResponseWriter, r *http.Request) {
 		httpErrorf(w, "Missing 'redir' value for /logingithub")
 		return
 	}
+	if config.GitHub.ClientID == "" {
+		httpErrorf(w, "login with GitHub is not configured")
+		return
+	}
 	log.Verbosef("redir: '%s'\n", redir)
 
 	oauthCopy := oauthGitHubConf
 	// GitHub seems to completely ignore Redir, so unfortunately we'll
 	// alwayas end up on quicknotes.io, which makes testing locally hard
-	// encode redir in state
-	uri := oauthCopy.AuthCodeURL(oauthSecretPrefix+redir, oauth2.AccessTypeOnline)
+	// remember redir on our side, keyed by random state
+	uri := oauthCopy.AuthCodeURL(putOAuthState(w, redir), oauth2.AccessTypeOnline)
 	http.Redirect(w, r, uri, http.StatusTemporaryRedirect)
 }
 
 // logingooglecb
 func handleOauthGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	state := r.FormValue("state")
-	if !strings.HasPrefix(state, oauthSecretPrefix) {
-		log.Errorf("invalid oauth state, expected '%s*', got '%s'\n", oauthSecretPrefix, state)
+	// state was remembered in handleLoginGoogle
+	redir, ok := popOAuthState(w, r)
+	if !ok {
+		log.Errorf("invalid or expired oauth state '%s'\n", state)
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
-
-	// extract redir from secret (added in handleLoginGoogle)
-	redir := state[len(oauthSecretPrefix):]
-	if redir == "" {
-		log.Errorf("missing redir in state\n")
-		redir = "/"
-	}
 	log.Verbosef("url: '%s', state: '%s', redir: '%s'\n", r.URL, state, redir)
 
 	code := r.FormValue("code")
@@ -452,21 +500,7 @@ func handleOauthGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	// also might be useful:
 	// Picture
 	userLogin := "google:" + nameFromEmail(userInfo.Email)
-	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
-	if err != nil {
-		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
-		// TODO: show error to the user
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-	log.Verbosef("got or created user %d, login: '%s'\n", dbUser.ID, userLogin)
-	cookieVal := &SecureCookieValue{
-		UserID: dbUser.ID,
-	}
-	setSecureCookie(w, cookieVal)
-
-	redir = fixLoginRedir(redir, dbUser)
-	http.Redirect(w, r, redir, http.StatusTemporaryRedirect)
+	loginUser(w, r, userLogin, fullName, "", redir)
 }
 
 // /logingoogle?redir=${redirect}
@@ -476,25 +510,40 @@ func handleLoginGoogle(w http.ResponseWriter, r *http.Request) {
 		httpErrorf(w, "Missing 'redir' arg for /logingoogle")
 		return
 	}
+	if config.Google.ClientID == "" {
+		httpErrorf(w, "login with Google is not configured")
+		return
+	}
 	log.Verbosef("redir: '%s'\n", redir)
 
 	// login callback must be exactly as configured with Google so we can't
 	// encode redir as url param the way we do for Twitter login
-	// instead we'll encode redir inside state
+	// instead we remember redir on our side, keyed by random state
 	oauthCopy := oauthGoogleConf
 	oauthCopy.RedirectURL = getMyHost(r) + "/logingooglecb"
-	uri := oauthCopy.AuthCodeURL(oauthSecretPrefix+redir, oauth2.AccessTypeOnline)
+	uri := oauthCopy.AuthCodeURL(putOAuthState(w, redir), oauth2.AccessTypeOnline)
 	http.Redirect(w, r, uri, http.StatusTemporaryRedirect)
 }
 
-// url: GET /logout?redir=${redirect}
+// url: POST /logout, redir=${redirect}
 func handleLogout(w http.ResponseWriter, r *http.Request) {
-	redir := strings.TrimSpace(r.FormValue("redir"))
-	if redir == "" {
-		log.Errorf("Missing 'redir' arg for /logout\n")
-		redir = "/"
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(w, r) {
+		serveCSRFError(w, r, false)
+		return
 	}
+	redir := sanitizeRedir(strings.TrimSpace(r.FormValue("redir")))
 	log.Verbosef("redir: '%s'\n", redir)
+	if user, sess := getSessionFromCookie(w, r); sess != nil {
+		err := revokeSession(user.ID, sess.ID)
+		if err != nil {
+			log.Errorf("revokeSession(%d) failed with '%s'\n", sess.ID, err)
+		}
+	}
 	deleteSecureCookie(w)
-	http.Redirect(w, r, redir, http.StatusTemporaryRedirect)
+	// StatusFound so that redirect after POST is a GET
+	http.Redirect(w, r, redir, http.StatusFound)
 }
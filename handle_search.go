@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"strconv"
 
 	"github.com/kjk/quicknotes/pkg/log"
 )
@@ -27,24 +29,94 @@ type SearchResultItem struct {
 type SearchResult struct {
 	NoteHashID string
 	Items      []SearchResultItem
+	// relevance, higher is better. See rank.go
+	Score float64
+	// set if the match is in a previous version of the note
+	Version *SearchResultVersion `json:",omitempty"`
 }
 
-func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string) (interface{}, error) {
-	if userIDHash == "" {
-		return nil, fmt.Errorf("missing 'userIDHash' arg")
+// PublicSearchResult is a search result in a public note of any user
+type PublicSearchResult struct {
+	SearchResult
+	Title      string
+	URL        string
+	UserIDHash string
+	UserHandle string
+}
+
+// PublicSearchResults is a page of results of searching public notes
+type PublicSearchResults struct {
+	Term    string
+	Page    int
+	HasMore bool
+	// total number of matching notes
+	Total   int
+	Results []PublicSearchResult
+	// set if regex search took too long and not all notes were searched
+	TimedOut bool `json:",omitempty"`
+}
+
+func matchToSearchResult(searchTerm string, match *Match) SearchResult {
+	items := noteMatchToSearchResults(searchTerm, match)
+	if len(items) >= maxHitsPerNote {
+		items = items[:maxHitsPerNote]
 	}
+	res := SearchResult{
+		NoteHashID: match.note.HashID,
+		Items:      items,
+		Score:      match.score,
+	}
+	if v := match.version; v != nil {
+		res.Version = &SearchResultVersion{
+			HashID:    hashInt(v.id),
+			CreatedAt: v.CreatedAt,
+			ViewURL:   noteVersionViewURL(match.note, v),
+		}
+	}
+	return res
+}
+
+func parseSearchQuery(searchTerm string, opts *SearchOptions) (*Query, error) {
 	if searchTerm == "" {
 		return nil, fmt.Errorf("missing search term")
 	}
+	if opts.Regex {
+		return parseRegexQuery(searchTerm)
+	}
+	q, err := parseQuery(searchTerm)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Fuzzy {
+		q.SetFuzzy()
+	}
+	if opts.Prefix {
+		q.SetPrefix()
+	}
+	return q, nil
+}
+
+func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string, opts *SearchOptions) (interface{}, error) {
+	if userIDHash == "" {
+		return nil, fmt.Errorf("missing 'userIDHash' arg")
+	}
 
 	userID, err := dehashInt(userIDHash)
 	if err != nil {
 		return nil, fmt.Errorf("invalid 'user' arg '%s', err='%s'", userIDHash, err)
 	}
 	searchPrivate := ctx.User != nil && userID == ctx.User.id
+	if opts.History && !searchPrivate {
+		return nil, fmt.Errorf("can only search history of your own notes")
+	}
 
 	log.Verbosef("userID: '%d', term: '%s', private: %v\n", userID, searchTerm, searchPrivate)
 
+	q, err := parseSearchQuery(searchTerm, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	i, err := getCachedUserInfo(userID)
 	if err != nil {
 		return nil, err
@@ -53,44 +125,139 @@ func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string) (int
 		return nil, fmt.Errorf("No user with userIDHash '%s'", userIDHash)
 	}
 	var notes []*Note
+	// public notes of disabled users or users being deleted are hidden
+	showPublic := searchPrivate || !i.user.notesHidden()
 	for _, note := range i.notes {
-		if note.IsPublic || searchPrivate {
+		if searchPrivate || (note.IsPublic && showPublic) {
 			notes = append(notes, note)
 		}
 	}
 
 	timing := ctx.NewTimingf("searching %d notes for '%s'", len(notes), searchTerm)
-	matches := searchNotes(searchTerm, notes, defaultMaxResults)
+	var matches []*Match
+	if searchIndex != nil {
+		matches, err = searchIndex.Search(userID, q, notes, defaultMaxResults, opts)
+		if err != nil {
+			log.Errorf("searchIndex.Search() failed with '%s'\n", err)
+		}
+	}
+	if searchIndex == nil || err != nil {
+		matches = searchNotesWithQuery(q, notes, defaultMaxResults, newScanTextMatcher(), opts)
+	}
+	if opts.History && len(matches) < maxSearchResults {
+		historyMatches, err := searchUserNotesHistory(userID, q, notes, matches, opts)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, historyMatches...)
+	}
 	timing.Finished()
 	log.Verbosef("searchNotes('%s') of %d notes took %s\n", searchTerm, len(matches), timing.Duration)
 
 	var res []SearchResult
 	for _, match := range matches {
-		items := noteMatchToSearchResults(searchTerm, match)
-		if len(items) >= maxHitsPerNote {
-			items = items[:maxHitsPerNote]
-		}
-		sr := SearchResult{
-			NoteHashID: match.note.HashID,
-			Items:      items,
-		}
-		res = append(res, sr)
+		res = append(res, matchToSearchResult(searchTerm, match))
 		if len(res) >= maxSearchResults {
 			break
 		}
 	}
 	v := struct {
-		Term    string
-		Results []SearchResult
+		Term     string
+		Results  []SearchResult
+		TimedOut bool `json:",omitempty"`
 	}{
-		Term:    searchTerm,
-		Results: res,
+		Term:     searchTerm,
+		Results:  res,
+		TimedOut: q.TimedOut(),
 	}
 	return v, nil
 }
 
+// searchPublicNotes searches public notes of all users. page starts at 1
+func searchPublicNotes(ctx *ReqContext, searchTerm string, page int, opts *SearchOptions) (*PublicSearchResults, error) {
+	q, err := parseSearchQuery(searchTerm, opts)
+	if err != nil {
+		return nil, err
+	}
+	if page < 1 {
+		page = 1
+	}
+	// starred status is private to note's owner
+	opts.StarredBoost = false
+
+	timing := ctx.NewTimingf("searching public notes for '%s'", searchTerm)
+	matches, err := searchAllPublicNotes(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	timing.Finished()
+	log.Verbosef("searchPublicNotes('%s') found %d notes in %s\n", searchTerm, len(matches), timing.Duration)
+
+	res := &PublicSearchResults{
+		Term:     searchTerm,
+		Page:     page,
+		Total:    len(matches),
+		TimedOut: q.TimedOut(),
+	}
+	var pageMatches []*Match
+	pageMatches, res.HasMore = pageOfMatches(matches, page, publicSearchPageSize)
+	for _, match := range pageMatches {
+		note := match.note
+		user, err := dbGetUserByIDCached(note.userID)
+		if err != nil {
+			log.Errorf("dbGetUserByIDCached(%d) failed with '%s'\n", note.userID, err)
+			continue
+		}
+		userSummary := userSummaryFromDbUser(user)
+		sr := PublicSearchResult{
+			SearchResult: matchToSearchResult(searchTerm, match),
+			Title:        note.Title,
+			URL:          noteURLPath(note.HashID, note.Title),
+			UserIDHash:   userSummary.HashID,
+			UserHandle:   userSummary.Handle,
+		}
+		res.Results = append(res.Results, sr)
+	}
+	return res, nil
+}
+
+func searchOptionsFromArgs(args map[string]interface{}) *SearchOptions {
+	opts := &SearchOptions{}
+	opts.RecencyBoost, _ = jsonMapGetBool(args, "recencyBoost")
+	opts.StarredBoost, _ = jsonMapGetBool(args, "starredBoost")
+	opts.Fuzzy, _ = jsonMapGetBool(args, "fuzzy")
+	opts.Prefix, _ = jsonMapGetBool(args, "prefix")
+	opts.History, _ = jsonMapGetBool(args, "history")
+	opts.Regex, _ = jsonMapGetBool(args, "regex")
+	return opts
+}
+
 func wsSearchUserNotes(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
 	userIDHash, _ := jsonMapGetString(args, "userIDHash")
 	searchTerm, _ := jsonMapGetString(args, "searchTerm")
-	return searchUserNotes(ctx, userIDHash, searchTerm)
+	return searchUserNotes(ctx, userIDHash, searchTerm, searchOptionsFromArgs(args))
+}
+
+func wsSearchPublicNotes(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	searchTerm, _ := jsonMapGetString(args, "searchTerm")
+	page, _ := jsonMapGetInt(args, "page")
+	return searchPublicNotes(ctx, searchTerm, page, searchOptionsFromArgs(args))
+}
+
+// GET /api/search_public.json?q=${query}&page=${page}
+// optional args: fuzzy, prefix, regex, recencyBoost set to "true"
+func handleAPISearchPublicNotes(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	opts := &SearchOptions{
+		Fuzzy:        r.FormValue("fuzzy") == "true",
+		Prefix:       r.FormValue("prefix") == "true",
+		Regex:        r.FormValue("regex") == "true",
+		RecencyBoost: r.FormValue("recencyBoost") == "true",
+	}
+	res, err := searchPublicNotes(ctx, r.FormValue("q"), page, opts)
+	if err != nil {
+		httpErrorWithJSONf(w, r, "%s", err)
+		return
+	}
+	httpOkWithJSON(w, r, res)
 }
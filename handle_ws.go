@@ -27,6 +27,8 @@ type NewNoteFromBrowser struct {
 	Content  string
 	Tags     []string
 	IsPublic bool
+	// set by the editor for periodic saves, as opposed to explicit saves
+	IsAutoSave bool
 }
 
 type wsGenericReq struct {
@@ -40,21 +42,30 @@ type wsResponse struct {
 	Cmd    string      `json:"cmd"`
 	Result interface{} `json:"result"`
 	Err    string      `json:"error,omitempty"`
+	// set for errors the browser handles specially e.g. QuotaError.Code
+	ErrCode string `json:"errorCode,omitempty"`
 }
 
 var (
 	muWsConnections sync.Mutex
-	wsConnections   map[int][]chan *wsResponse
+	wsConnections   map[int][]*wsConnection
 )
 
-func wsRememberConnection(userID int, c chan *wsResponse) {
+// wsConnection is a websocket connection of a logged-in user
+type wsConnection struct {
+	c         chan *wsResponse
+	conn      *websocket.Conn
+	sessionID int
+}
+
+func wsRememberConnection(userID int, wc *wsConnection) {
 	muWsConnections.Lock()
 	defer muWsConnections.Unlock()
 	if wsConnections == nil {
-		wsConnections = make(map[int][]chan *wsResponse)
+		wsConnections = make(map[int][]*wsConnection)
 	}
 	a := wsConnections[userID]
-	a = append(a, c)
+	a = append(a, wc)
 	wsConnections[userID] = a
 }
 
@@ -62,8 +73,8 @@ func wsRemoveConnection(userID int, cToRemove chan *wsResponse) {
 	muWsConnections.Lock()
 	defer muWsConnections.Unlock()
 	a := wsConnections[userID]
-	for i, c := range a {
-		if c == cToRemove {
+	for i, wc := range a {
+		if wc.c == cToRemove {
 			a[i], a = a[len(a)-1], a[:len(a)-1]
 			break
 		}
@@ -79,8 +90,8 @@ func wsBroadcastToUser(userID int, v *wsResponse) {
 	muWsConnections.Lock()
 	defer muWsConnections.Unlock()
 	arr := wsConnections[userID]
-	for _, c := range arr {
-		c <- v
+	for _, wc := range arr {
+		wc.c <- v
 	}
 }
 
@@ -96,6 +107,18 @@ func jsonMapGetString(m map[string]interface{}, key string) (string, error) {
 	return s, nil
 }
 
+func jsonMapGetBool(m map[string]interface{}, key string) (bool, error) {
+	v, ok := m[key]
+	if !ok {
+		return false, fmt.Errorf("no '%s' in %v", key, m)
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("'%s' is not of type bool. Type: %T, value: '%v'", key, v, v)
+	}
+	return b, nil
+}
+
 func jsonMapGetInt(m map[string]interface{}, key string) (int, error) {
 	v, ok := m[key]
 	if !ok {
@@ -139,9 +162,11 @@ func getUserNoteByHashID(ctx *ReqContext, noteHashIDStr string) (int, error) {
 
 type getUserInfoRsp struct {
 	UserInfo *UserSummary
+	// only sent for the logged in user
+	Usage *UserUsage `json:",omitempty"`
 }
 
-func wsGetUserInfo(args map[string]interface{}) (*getUserInfoRsp, error) {
+func wsGetUserInfo(ctx *ReqContext, args map[string]interface{}) (*getUserInfoRsp, error) {
 	userIDHash, err := jsonMapGetString(args, "userIDHash")
 	if err != nil {
 		return nil, fmt.Errorf("'userIDHash' argument missing in '%v'", args)
@@ -155,8 +180,13 @@ func wsGetUserInfo(args map[string]interface{}) (*getUserInfoRsp, error) {
 	if err != nil || i == nil {
 		return nil, fmt.Errorf("no user '%d', err: '%s'", userID, err)
 	}
-	userInfo := userSummaryFromDbUser(i.user)
-	return &getUserInfoRsp{userInfo}, nil
+	res := &getUserInfoRsp{
+		UserInfo: userSummaryFromDbUser(i.user),
+	}
+	if ctx.User != nil && ctx.User.id == userID {
+		res.Usage = calcUserUsage(i.user, i.notes)
+	}
+	return res, nil
 }
 
 func wsGetRecentNotes(limit int) (interface{}, error) {
@@ -187,9 +217,10 @@ func getNotesForUser(ctx *ReqContext, userID int, latestVersion int) (interface{
 	}
 
 	showPrivate := ctx.User != nil && userID == ctx.User.id
+	showPublic := showPrivate || !i.user.notesHidden()
 	var notes [][]interface{}
 	for _, note := range i.notes {
-		if note.IsPublic || showPrivate {
+		if (note.IsPublic && showPublic) || showPrivate {
 			compactNote, _ := noteToCompact(note, false)
 			notes = append(notes, compactNote)
 		}
@@ -239,7 +270,8 @@ func wsGetNotes(ctx *ReqContext, args map[string]interface{}) (interface{}, erro
 }
 
 func userCanAccessNote(loggedUser *UserSummary, note *Note) bool {
-	if note.IsPublic {
+	// public notes of disabled and deleted users are hidden
+	if note.IsPublic && !areUserNotesHidden(note.userID) {
 		return true
 	}
 	return loggedUser != nil && loggedUser.id == note.userID
@@ -334,6 +366,7 @@ func newNoteFromBrowserNote(note *NewNoteFromBrowser) (*NewNote, error) {
 	newNote.format = note.Format
 	newNote.tags = note.Tags
 	newNote.isPublic = note.IsPublic
+	newNote.isAutoSave = note.IsAutoSave
 
 	if newNote.title == "" && newNote.format == formatText {
 		newNote.title, newNote.content = noteToTitleContent(newNote.content)
@@ -359,6 +392,9 @@ func wsCreateOrUpdateNote(ctx *ReqContext, args map[string]interface{}) (interfa
 	}
 
 	noteID, err := dbCreateOrUpdateNote(ctx.User.id, note)
+	if _, ok := err.(*QuotaError); ok {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("dbCreateNewNote() failed with %s", err)
 	}
@@ -373,6 +409,7 @@ func wsCreateOrUpdateNote(ctx *ReqContext, args map[string]interface{}) (interfa
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  8 * 1024,
 	WriteBufferSize: 8 * 1024,
+	CheckOrigin:     checkWsOrigin,
 }
 
 func handleWs(w http.ResponseWriter, r *http.Request) {
@@ -390,7 +427,7 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 
 	c := make(chan *wsResponse)
 	if user != nil {
-		wsRememberConnection(user.id, c)
+		wsRememberConnection(user.id, &wsConnection{c: c, conn: conn, sessionID: user.sessionID})
 	}
 
 	var writeError error
@@ -454,13 +491,14 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 		args := req.Args
 
 		broadcastGetNotes := false
+		broadcastSavedSearches := false
 
 		switch req.Cmd {
 		case cmdPing:
 			res = "pong"
 
 		case "getUserInfo":
-			res, err = wsGetUserInfo(args)
+			res, err = wsGetUserInfo(&ctx, args)
 
 		case "getNotes":
 			res, err = wsGetNotes(&ctx, args)
@@ -506,6 +544,31 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 		case "searchUserNotes":
 			res, err = wsSearchUserNotes(&ctx, args)
 
+		case "searchPublicNotes":
+			res, err = wsSearchPublicNotes(&ctx, args)
+
+		case "suggest":
+			res, err = wsSuggest(&ctx, args)
+
+		case "restoreNoteVersion":
+			res, err = wsRestoreNoteVersion(&ctx, args)
+			broadcastGetNotes = true
+
+		case "getSavedSearches":
+			res, err = wsGetSavedSearches(&ctx)
+
+		case "createSavedSearch":
+			res, err = wsCreateSavedSearch(&ctx, args)
+			broadcastSavedSearches = true
+
+		case "renameSavedSearch":
+			res, err = wsRenameSavedSearch(&ctx, args)
+			broadcastSavedSearches = true
+
+		case "deleteSavedSearch":
+			res, err = wsDeleteSavedSearch(&ctx, args)
+			broadcastSavedSearches = true
+
 		default:
 			log.Errorf("unknown type '%s' in request '%s'\n", req.Cmd, string(reqBytes))
 			continue
@@ -519,6 +582,9 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			rsp.Err = err.Error()
+			if qe, ok := err.(*QuotaError); ok {
+				rsp.ErrCode = qe.Code
+			}
 			rsp.Result = nil
 			log.Errorf("handling request '%s' failed with '%s'\n", string(reqBytes), err)
 		}
@@ -542,6 +608,15 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 
 			wsBroadcastToUser(ctx.User.id, &rsp)
 		}
+
+		// counts of saved searches change when notes change
+		if rsp.Err == "" && ctx.User != nil {
+			if broadcastSavedSearches {
+				broadcastSavedSearchesToUser(ctx.User.id)
+			} else if broadcastGetNotes {
+				broadcastSavedSearchesDelayed(ctx.User.id)
+			}
+		}
 		err = getWriteError()
 		if err != nil {
 			break
@@ -2,13 +2,17 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/kjk/quicknotes/pkg/log"
 	"github.com/kjk/u"
@@ -46,7 +50,11 @@ type UserSummary struct {
 	id     int
 	HashID string
 	Handle string
-	login  string
+	// only set for the logged-in user
+	IsAdmin bool `json:",omitempty"`
+	login   string
+	// id of session in sessions table
+	sessionID int
 }
 
 // Timing describes how long did it take to execute a piece of code
@@ -100,6 +108,7 @@ func withCtx(f HandlerWithCtxFunc, opts ReqOpts) http.HandlerFunc {
 
 		isJSON := opts&IsJSON != 0
 		onlyLoggedIn := opts&OnlyLoggedIn != 0
+		onlyAdmin := opts&OnlyAdmin != 0
 		onlyGet := opts&OnlyGet != 0
 		onlyPost := opts&OnlyPost != 0
 
@@ -108,6 +117,11 @@ func withCtx(f HandlerWithCtxFunc, opts ReqOpts) http.HandlerFunc {
 			return
 		}
 
+		if onlyAdmin && (ctx.User == nil || !ctx.User.IsAdmin) {
+			serveError(rrw, r, isJSON, "not an admin")
+			return
+		}
+
 		method := strings.ToUpper(r.Method)
 		if onlyGet && method != "GET" {
 			serveError(rrw, r, isJSON, fmt.Sprintf("%s %s is not GET", method, uri))
@@ -119,6 +133,11 @@ func withCtx(f HandlerWithCtxFunc, opts ReqOpts) http.HandlerFunc {
 			return
 		}
 
+		if !isSafeMethod(method) && !checkCSRF(rrw, r) {
+			serveCSRFError(rrw, r, isJSON)
+			return
+		}
+
 		// if user is logged in, redirect / to their notes
 		if ctx.User != nil && r.URL.String() == "/" {
 			url := "/u/" + ctx.User.HashID + "/" + ctx.User.Handle
@@ -238,8 +257,13 @@ func userSummaryFromDbUser(dbUser *DbUser) *UserSummary {
 }
 
 func getUserSummaryFromCookie(w http.ResponseWriter, r *http.Request) *UserSummary {
-	dbUser := getDbUserFromCookie(w, r)
-	return userSummaryFromDbUser(dbUser)
+	dbUser, sess := getSessionFromCookie(w, r)
+	res := userSummaryFromDbUser(dbUser)
+	if res != nil {
+		res.IsAdmin = dbUser.IsAdmin
+		res.sessionID = sess.ID
+	}
+	return res
 }
 
 func serveResourceFromZip(w http.ResponseWriter, r *http.Request, path string) {
@@ -319,9 +343,105 @@ Big picture:
   it's a logged-in user. Shows only public if user's owner != logged in
   user
 /n/${noteHashIDed} - show a single note
+/n/${noteHashIDed}.html - server-rendered version of a single note
+/u/{idHashed}/feed.atom, /u/{idHashed}/tag/{tag}/feed.atom, /feed.atom - atom feeds of public notes
+/sitemap.xml, /sitemaps/*, /robots.txt - for crawlers
+/api/search_public.json - search public notes of all users
+/loginoidc?provider=${name}, /loginoidccb - login with OpenID Connect providers from config
+/loginemail, /verifyemail, /resetpassword - e-mail / password accounts, see accounts.go
+/account/logins - login methods linked to the account, see identities.go
+/login2fa, /account/2fa - two-factor authentication, see totp.go
+/account/sessions - list and revoke logged-in sessions, see sessions.go
+/account/data/* - export all data and delete the account, see data_export.go and account_deletion.go
+/admin/* - admin console, only for users with is_admin, see admin.go
 /api/* - api calls
 */
 
+// parses /n/{note_id_hash}-rest and /n/{note_id_hash}-rest.html
+func noteHashIDFromURI(uri string) string {
+	s := strings.TrimPrefix(uri, "/n/")
+	s = strings.TrimSuffix(s, ".html")
+	// remove optional part after -, which is constructed from note title
+	if idx := strings.Index(s, "-"); idx != -1 {
+		s = s[:idx]
+	}
+	return s
+}
+
+// converts note title to a part of url e.g. "My Note!" => "my-note"
+func titleToSlug(title string) string {
+	var buf bytes.Buffer
+	needDash := false
+	for _, c := range strings.ToLower(title) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if needDash && buf.Len() > 0 {
+				buf.WriteByte('-')
+			}
+			needDash = false
+			buf.WriteRune(c)
+		} else {
+			needDash = true
+		}
+	}
+	return buf.String()
+}
+
+// noteURLPath returns /n/{note_id_hash}-{title slug}
+func noteURLPath(noteHashID, title string) string {
+	res := "/n/" + noteHashID
+	if slug := titleToSlug(title); slug != "" {
+		res += "-" + url.PathEscape(slug)
+	}
+	return res
+}
+
+// /n/{note_id_hash}.html
+func handleNoteHTML(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	noteHashIDStr := noteHashIDFromURI(r.URL.Path)
+	note, err := getNoteByIDHash(ctx, noteHashIDStr)
+	if err != nil || note == nil {
+		log.Error(err)
+		http.NotFound(w, r)
+		return
+	}
+	noteHTML, err := renderNoteHTML(note)
+	if err != nil {
+		httpErrorf(w, "renderNoteHTML() failed with %s", err)
+		return
+	}
+	dbNoteUser, err := dbGetUserByIDCached(note.userID)
+	if err != nil || dbNoteUser == nil {
+		httpErrorf(w, "dbGetUserByIDCached(%d) failed with %s", note.userID, err)
+		return
+	}
+	title := note.Title
+	if title == "" {
+		title = note.HashID
+	}
+	v := struct {
+		Title           string
+		MainCSSPath     string
+		HighlightCSS    template.CSS
+		NoteHashID      string
+		NoteUser        *UserSummary
+		NoteHTML        template.HTML
+		UpdatedAtString string
+		Description     string
+		CanonicalURL    string
+	}{
+		Title:           title,
+		MainCSSPath:     "/" + mainCSSPath,
+		HighlightCSS:    getHighlightCSS(),
+		NoteHashID:      note.HashID,
+		NoteUser:        userSummaryFromDbUser(dbNoteUser),
+		NoteHTML:        noteHTML,
+		UpdatedAtString: note.UpdatedAt.Format("2006-01-02"),
+		Description:     noteDescription(note),
+		CanonicalURL:    noteCanonicalURL(note),
+	}
+	serveTemplate(w, tmplNote, v)
+}
+
 func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 	uri := r.URL.Path
 
@@ -338,23 +458,37 @@ func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 		BundleJSPath string
 		MainCSSPath  string
 		IsLocal      bool
+		CSRFToken    string
+		// OpenID Connect login providers, see oidc.go
+		OIDCProviders []oidcLoginProvider
 
 		// for / and /u/
 		Notes     []*Note
 		NotesUser *UserSummary
 
 		// for /n/
-		NoteUser *UserSummary
-		Note     []interface{}
+		NoteUser     *UserSummary
+		Note         []interface{}
+		NoteHTML     template.HTML
+		HighlightCSS template.CSS
+		Description  string
+		CanonicalURL string
 	}{
 		LoggedUser:   ctx.User,
 		Title:        "QuickNotes",
 		BundleJSPath: "/" + bundleJSPath,
 		MainCSSPath:  "/" + mainCSSPath,
 		IsLocal:      !flgProduction,
+		CSRFToken:    csrfToken(w, r),
+
+		OIDCProviders: getOIDCLoginProviders(),
 	}
 
 	if strings.HasPrefix(uri, "/u/") {
+		if strings.HasSuffix(uri, "/feed.atom") {
+			handleUserFeed(ctx, w, r)
+			return
+		}
 		// /u/${userId}/${whatever}
 		userIDHash := r.URL.Path[len("/u/"):]
 		userIDHash = strings.Split(userIDHash, "/")[0]
@@ -365,7 +499,8 @@ func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		i, err := getCachedUserInfo(userID)
-		if err != nil || i == nil {
+		isOwner := ctx.User != nil && ctx.User.id == userID
+		if err != nil || i == nil || (i.user.notesHidden() && !isOwner) {
 			log.Errorf("no user '%d', url: '%s', err: %s\n", userID, r.URL, err)
 			http.NotFound(w, r)
 			return
@@ -375,13 +510,13 @@ func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 		v.NotesUser = notesUser
 		v.Title = fmt.Sprintf("Notes by %s", notesUser.Handle)
 	} else if strings.HasPrefix(uri, "/n/") {
+		if strings.HasSuffix(uri, ".html") {
+			handleNoteHTML(ctx, w, r)
+			return
+		}
 
 		// /n/{note_id_hash}-rest
-		noteHashIDStr := r.URL.Path[len("/n/"):]
-		// remove optional part after -, which is constructed from note title
-		if idx := strings.Index(noteHashIDStr, "-"); idx != -1 {
-			noteHashIDStr = noteHashIDStr[:idx]
-		}
+		noteHashIDStr := noteHashIDFromURI(uri)
 
 		note, err := getNoteByIDHash(ctx, noteHashIDStr)
 		if err != nil || note == nil {
@@ -402,9 +537,17 @@ func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 		}
 		noteUser := userSummaryFromDbUser(dbNoteUser)
 
+		// for crawlers and visitors without JavaScript
+		v.NoteHTML, err = renderNoteHTML(note)
+		if err != nil {
+			log.Errorf("renderNoteHTML() failed with %s\n", err)
+		}
+		v.HighlightCSS = getHighlightCSS()
 		v.Note = compactNote
 		v.NoteUser = noteUser
 		v.Title = note.Title
+		v.Description = noteDescription(note)
+		v.CanonicalURL = noteCanonicalURL(note)
 	} else {
 		if !isAllowedURL(uri) {
 			http.NotFound(w, r)
@@ -507,7 +650,7 @@ func handleIndexAllNotes(ctx *ReqContext, w http.ResponseWriter, r *http.Request
 }
 
 func handleRawNote(w http.ResponseWriter, r *http.Request) {
-	uri := r.RequestURI
+	uri := r.URL.Path
 	s := strings.TrimPrefix(uri, "/raw/n/")
 	parts := strings.SplitN(s, "-", 2)
 	noteID, err := dehashInt(parts[0])
@@ -526,6 +669,21 @@ func handleRawNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// ?v=${versionHashID} shows a previous version, only to the owner
+	if versionHashID := r.FormValue("v"); versionHashID != "" {
+		versionID, err := dehashInt(versionHashID)
+		if err != nil || user == nil || user.id != note.userID {
+			http.NotFound(w, r)
+			return
+		}
+		v, err := dbGetNoteVersion(noteID, versionID)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		note = noteAtVersion(note, v)
+	}
+
 	var lines []string
 
 	s = "Id: " + note.HashID
@@ -628,16 +786,44 @@ func makeHTTPServer() *http.Server {
 	mux.HandleFunc("/s/", handleStatic)
 	mux.HandleFunc("/raw/n/", handleRawNote)
 	mux.HandleFunc("/idx/allnotes", withCtx(handleIndexAllNotes, OnlyGet))
+	mux.HandleFunc("/feed.atom", withCtx(handleRecentNotesFeed, OnlyGet))
+	mux.HandleFunc("/sitemap.xml", handleSitemapIndex)
+	mux.HandleFunc("/sitemaps/", handleSitemap)
+	mux.HandleFunc("/robots.txt", handleRobotsTxt)
 	mux.HandleFunc("/logintwitter", handleLoginTwitter)
 	mux.HandleFunc("/logintwittercb", handleOauthTwitterCallback)
 	mux.HandleFunc("/logingithub", handleLoginGitHub)
 	mux.HandleFunc("/logingithubcb", handleOauthGitHubCallback)
 	mux.HandleFunc("/logingoogle", handleLoginGoogle)
 	mux.HandleFunc("/logingooglecb", handleOauthGoogleCallback)
+	mux.HandleFunc("/loginoidc", handleLoginOIDC)
+	mux.HandleFunc("/loginoidccb", handleOIDCCallback)
+	mux.HandleFunc("/loginemail", handleLoginEmail)
+	mux.HandleFunc("/verifyemail", handleVerifyEmail)
+	mux.HandleFunc("/resetpassword", handleResetPassword)
+	mux.HandleFunc("/account/logins", withCtx(handleAccountLogins, OnlyLoggedIn|OnlyGet))
+	mux.HandleFunc("/account/logins/add", withCtx(handleAccountLoginsAdd, OnlyLoggedIn|OnlyPost))
+	mux.HandleFunc("/account/logins/unlink", withCtx(handleAccountLoginsUnlink, OnlyLoggedIn|OnlyPost))
+	mux.HandleFunc("/login2fa", handleLogin2FA)
+	mux.HandleFunc("/account/2fa", withCtx(handleAccount2FA, OnlyLoggedIn))
+	mux.HandleFunc("/account/sessions", withCtx(handleAccountSessions, OnlyLoggedIn|OnlyGet))
+	mux.HandleFunc("/account/sessions/revoke", withCtx(handleAccountSessionsRevoke, OnlyLoggedIn|OnlyPost))
+	mux.HandleFunc("/account/data", withCtx(handleAccountData, OnlyLoggedIn|OnlyGet))
+	mux.HandleFunc("/account/data/export", withCtx(handleAccountDataExport, OnlyLoggedIn|OnlyPost))
+	mux.HandleFunc("/account/data/export/download", withCtx(handleAccountDataExportDownload, OnlyLoggedIn|OnlyGet))
+	mux.HandleFunc("/account/data/delete", withCtx(handleAccountDataDelete, OnlyLoggedIn|OnlyPost))
+	mux.HandleFunc("/account/data/delete/cancel", withCtx(handleAccountDataDeleteCancel, OnlyLoggedIn|OnlyPost))
+	mux.HandleFunc("/admin", withCtx(handleAdmin, OnlyAdmin|OnlyGet))
+	mux.HandleFunc("/admin/jobs/run", withCtx(handleAdminRunJob, OnlyAdmin|OnlyPost))
+	mux.HandleFunc("/admin/users", withCtx(handleAdminUsers, OnlyAdmin|OnlyGet))
+	mux.HandleFunc("/admin/user", withCtx(handleAdminUser, OnlyAdmin|OnlyGet))
+	mux.HandleFunc("/admin/user/disable", withCtx(handleAdminDisableUser, OnlyAdmin|OnlyPost))
+	mux.HandleFunc("/admin/note/unpublish", withCtx(handleAdminUnpublishNote, OnlyAdmin|OnlyPost))
 
 	mux.HandleFunc("/logout", handleLogout)
 	mux.HandleFunc("/api/ws", handleWs)
-	mux.HandleFunc("/api/import_simplenote_start", withCtx(handleAPIImportSimpleNoteStart, OnlyLoggedIn|IsJSON))
+	mux.HandleFunc("/api/search_public.json", withCtx(handleAPISearchPublicNotes, OnlyGet|IsJSON))
+	mux.HandleFunc("/api/import_simplenote_start", withCtx(handleAPIImportSimpleNoteStart, OnlyLoggedIn|OnlyPost|IsJSON))
 	mux.HandleFunc("/api/import_simplenote_status", withCtx(handleAPIImportSimpleNotesStatus, OnlyLoggedIn|IsJSON))
 
 	srv := &http.Server{
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+A user can log in with multiple providers. Each way of logging in is an
+identity (identities table) with a login like "github:kjk" or
+"email:kjk@acme.com". users.login is the identity the account was created
+with (or, if that was unlinked, another one) and is used for user's handle.
+
+Adding a login method: a logged-in user posts to /account/logins/add (with
+csrf token), which remembers (for pendingLinkTimeout) that this session is
+adding a login method and redirects to the provider's login page. When the
+provider redirects back, loginUser() adds the identity to the logged-in user
+instead of logging in. Pending links are keyed by hash of session token,
+which only the browser that started adding the login has, and OAuth state
+is bound to that browser (see setOAuthStateCookie) so another browser can't
+finish the login.
+
+An identity can be unlinked unless it's the last one. If an identity is
+already linked to another account, the accounts can be merged by an admin
+with -merge-users.
+
+Pages:
+GET  /account/logins                         : list of login methods
+POST /account/logins/add, provider=${name}   : add login method
+POST /account/logins/unlink                  : unlink identity given as login
+*/
+
+const (
+	pendingLinkTimeout = time.Minute * 10
+)
+
+var (
+	errIdentityNotFound    = errors.New("login method not found")
+	errLastIdentity        = errors.New("can't remove the only login method")
+	errIdentityLinkedOther = errors.New("this login is already used by another account")
+
+	pendingLinksMu sync.Mutex
+	// hash of session token => login method being added in that session
+	pendingLinks = map[string]*pendingLink{}
+)
+
+type pendingLink struct {
+	userID    int
+	createdAt time.Time
+}
+
+// Identity is a way of logging in to user's account
+type Identity struct {
+	userID    int
+	Login     string
+	CreatedAt time.Time
+}
+
+// Provider returns provider part of login e.g. "github" for "github:kjk"
+func (i *Identity) Provider() string {
+	return strings.SplitN(i.Login, ":", 2)[0]
+}
+
+// Name returns user name part of login e.g. "kjk" for "github:kjk"
+func (i *Identity) Name() string {
+	parts := strings.SplitN(i.Login, ":", 2)
+	if len(parts) != 2 {
+		return i.Login
+	}
+	return parts[1]
+}
+
+func dbGetUserIdentities(userID int) ([]*Identity, error) {
+	db := getDbMust()
+	q := `SELECT login, created_at FROM identities WHERE user_id = ? ORDER BY created_at, login`
+	rows, err := db.Query(q, userID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Identity
+	for rows.Next() {
+		i := &Identity{userID: userID}
+		err = rows.Scan(&i.Login, &i.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, i)
+	}
+	return res, rows.Err()
+}
+
+func clearCachedDbUser(userID int) {
+	mu.Lock()
+	delete(userIDToDbUserCache, userID)
+	mu.Unlock()
+}
+
+// dbLinkIdentity adds identity to a user. Returns errIdentityLinkedOther if
+// it belongs to another user
+func dbLinkIdentity(userID int, login string) error {
+	db := getDbMust()
+	var ownerID int
+	q := `SELECT user_id FROM identities WHERE login = ?`
+	err := db.QueryRow(q, login).Scan(&ownerID)
+	if err == nil {
+		if ownerID != userID {
+			return errIdentityLinkedOther
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		log.Errorf("db.QueryRow('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	q = `INSERT INTO identities (login, user_id) VALUES (?, ?)`
+	_, err = db.Exec(q, login, userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+// dbUnlinkIdentity removes identity from a user, unless it's the last one
+func dbUnlinkIdentity(userID int, login string) error {
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	// lock user's identities so that concurrent unlinks can't remove all
+	q := `SELECT login FROM identities WHERE user_id = ? ORDER BY created_at, login FOR UPDATE`
+	rows, err := tx.Query(q, userID)
+	if err != nil {
+		log.Errorf("tx.Query('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	var remaining []string
+	found := false
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if s == login {
+			found = true
+		} else {
+			remaining = append(remaining, s)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return errIdentityNotFound
+	}
+	if len(remaining) == 0 {
+		return errLastIdentity
+	}
+	q = `DELETE FROM identities WHERE login = ? AND user_id = ?`
+	_, err = tx.Exec(q, login, userID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	// users.login must be one of user's identities
+	q = `UPDATE users SET login = ? WHERE id = ? AND login = ?`
+	_, err = tx.Exec(q, remaining[0], userID, login)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return err
+	}
+	clearCachedDbUser(userID)
+	return nil
+}
+
+// dbMergeUsers moves notes, saved searches and identities of user fromID
+// to user toID and deletes user fromID. Returns ids of moved notes
+func dbMergeUsers(fromID, toID int) ([]int, error) {
+	if fromID == toID {
+		return nil, fmt.Errorf("can't merge user %d with itself", fromID)
+	}
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	q := `SELECT id FROM notes WHERE user_id = ? FOR UPDATE`
+	rows, err := tx.Query(q, fromID)
+	if err != nil {
+		log.Errorf("tx.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	var noteIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		noteIDs = append(noteIDs, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	stmts := []string{
+		`UPDATE notes SET user_id = ? WHERE user_id = ?`,
+		`UPDATE saved_searches SET user_id = ? WHERE user_id = ?`,
+		`UPDATE simplenote_imports SET user_id = ? WHERE user_id = ?`,
+		`UPDATE identities SET user_id = ? WHERE user_id = ?`,
+		// an account has at most one password, the target's wins
+		`UPDATE IGNORE email_accounts SET user_id = ? WHERE user_id = ?`,
+	}
+	for _, q := range stmts {
+		_, err = tx.Exec(q, toID, fromID)
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+			return nil, err
+		}
+	}
+	// deletes what's left (e.g. tokens) thanks to ON DELETE CASCADE
+	q = `DELETE FROM users WHERE id = ?`
+	_, err = tx.Exec(q, fromID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range []int{fromID, toID} {
+		clearCachedDbUser(userID)
+		clearCachedUserInfo(userID)
+	}
+	return noteIDs, nil
+}
+
+// mergeUsers merges user with login fromLogin into user with login toLogin.
+// Used by -merge-users
+func mergeUsers(fromLogin, toLogin string) error {
+	from, err := dbGetUserByLogin(fromLogin)
+	if err == nil && from == nil {
+		err = fmt.Errorf("no user with login '%s'", fromLogin)
+	}
+	if err != nil {
+		return err
+	}
+	to, err := dbGetUserByLogin(toLogin)
+	if err == nil && to == nil {
+		err = fmt.Errorf("no user with login '%s'", toLogin)
+	}
+	if err != nil {
+		return err
+	}
+	noteIDs, err := dbMergeUsers(from.ID, to.ID)
+	if err != nil {
+		return err
+	}
+	// index of the target user picks up moved notes when it's searched
+	for _, noteID := range noteIDs {
+		if searchIndex != nil {
+			err = searchIndex.RemoveNote(from.ID, noteID)
+			if err != nil {
+				log.Errorf("searchIndex.RemoveNote() failed with '%s'\n", err)
+			}
+		}
+	}
+	fmt.Printf("merged user %d (%s) into user %d (%s), moved %d notes\n", from.ID, fromLogin, to.ID, toLogin, len(noteIDs))
+	return nil
+}
+
+func startLinkingIdentity(sess *Session) {
+	pendingLinksMu.Lock()
+	defer pendingLinksMu.Unlock()
+	for k, v := range pendingLinks {
+		if timeExpired(v.createdAt, pendingLinkTimeout) {
+			delete(pendingLinks, k)
+		}
+	}
+	pendingLinks[sess.tokenHash] = &pendingLink{
+		userID:    sess.userID,
+		createdAt: time.Now(),
+	}
+}
+
+// popPendingLink returns true if the user started adding a login method
+// recently in this session. Can only be used once
+func popPendingLink(sess *Session) bool {
+	pendingLinksMu.Lock()
+	defer pendingLinksMu.Unlock()
+	pl := pendingLinks[sess.tokenHash]
+	delete(pendingLinks, sess.tokenHash)
+	return pl != nil && pl.userID == sess.userID && !timeExpired(pl.createdAt, pendingLinkTimeout)
+}
+
+func redirectToAccountLogins(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	v := url.Values{}
+	if msg != "" {
+		v.Set("msg", msg)
+	}
+	if err != nil {
+		v.Set("error", err.Error())
+	}
+	uri := "/account/logins"
+	if len(v) > 0 {
+		uri += "?" + v.Encode()
+	}
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// linkIdentity is called instead of logging in when a logged-in user adds
+// a login method
+func linkIdentity(w http.ResponseWriter, r *http.Request, user *DbUser, login string) {
+	err := dbLinkIdentity(user.ID, login)
+	if err != nil {
+		if err != errIdentityLinkedOther {
+			log.Errorf("dbLinkIdentity(%d, '%s') failed with '%s'\n", user.ID, login, err)
+		}
+		redirectToAccountLogins(w, r, "", err)
+		return
+	}
+	log.Verbosef("linked '%s' to user %d\n", login, user.ID)
+	redirectToAccountLogins(w, r, fmt.Sprintf("Added %s", login), nil)
+}
+
+// loginProvider is a provider with which the user can log in
+type loginProvider struct {
+	Name        string
+	DisplayName string
+	// url of login page
+	loginURL string
+}
+
+// getLoginProviders returns configured login providers
+func getLoginProviders() []loginProvider {
+	var res []loginProvider
+	if config.Twitter.ClientID != "" {
+		res = append(res, loginProvider{"twitter", "Twitter", "/logintwitter"})
+	}
+	if config.Google.ClientID != "" {
+		res = append(res, loginProvider{"google", "Google", "/logingoogle"})
+	}
+	if config.GitHub.ClientID != "" {
+		res = append(res, loginProvider{"github", "GitHub", "/logingithub"})
+	}
+	for _, p := range getOIDCLoginProviders() {
+		uri := "/loginoidc?provider=" + url.QueryEscape(p.Name)
+		res = append(res, loginProvider{p.Name, p.DisplayName, uri})
+	}
+	return res
+}
+
+// url: GET /account/logins
+func handleAccountLogins(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	identities, err := dbGetUserIdentities(ctx.User.id)
+	if err != nil {
+		httpErrorf(w, "dbGetUserIdentities() failed with '%s'", err)
+		return
+	}
+	model := struct {
+		LoggedUser *UserSummary
+		Identities []*Identity
+		Providers  []loginProvider
+		Message    string
+		Error      string
+		CSRFToken  string
+	}{
+		LoggedUser: ctx.User,
+		Identities: identities,
+		Providers:  getLoginProviders(),
+		Message:    r.FormValue("msg"),
+		Error:      r.FormValue("error"),
+		CSRFToken:  csrfToken(w, r),
+	}
+	serveTemplate(w, tmplAccountLogins, model)
+}
+
+// url: POST /account/logins/add, provider=${name}
+func handleAccountLoginsAdd(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	_, sess := getSessionFromCookie(w, r)
+	if sess == nil || sess.userID != ctx.User.id {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	name := r.FormValue("provider")
+	for _, p := range getLoginProviders() {
+		if p.Name != name {
+			continue
+		}
+		startLinkingIdentity(sess)
+		uri := p.loginURL
+		if strings.Contains(uri, "?") {
+			uri += "&"
+		} else {
+			uri += "?"
+		}
+		uri += "redir=" + url.QueryEscape("/account/logins")
+		http.Redirect(w, r, uri, http.StatusFound)
+		return
+	}
+	redirectToAccountLogins(w, r, "", fmt.Errorf("unknown login provider '%s'", name))
+}
+
+// url: POST /account/logins/unlink
+func handleAccountLoginsUnlink(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	login := r.FormValue("login")
+	err := dbUnlinkIdentity(ctx.User.id, login)
+	if err != nil {
+		if err != errLastIdentity && err != errIdentityNotFound {
+			log.Errorf("dbUnlinkIdentity(%d, '%s') failed with '%s'\n", ctx.User.id, login, err)
+		}
+		redirectToAccountLogins(w, r, "", err)
+		return
+	}
+	redirectToAccountLogins(w, r, fmt.Sprintf("Removed %s", login), nil)
+}
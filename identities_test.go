@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdentity(t *testing.T) {
+	i := &Identity{Login: "email:jane@acme.com"}
+	if i.Provider() != "email" || i.Name() != "jane@acme.com" {
+		t.Fatalf("unexpected provider '%s' or name '%s'", i.Provider(), i.Name())
+	}
+
+	sess := &Session{userID: 1, tokenHash: hashToken("token-1")}
+	other := &Session{userID: 1, tokenHash: hashToken("token-2")}
+	if popPendingLink(sess) {
+		t.Fatalf("session didn't start linking")
+	}
+	startLinkingIdentity(sess)
+	if popPendingLink(other) {
+		t.Fatalf("pending link should only be usable by the session that started it")
+	}
+	if !popPendingLink(sess) || popPendingLink(sess) {
+		t.Fatalf("pending link should be usable once")
+	}
+	startLinkingIdentity(sess)
+	pendingLinks[sess.tokenHash].createdAt = time.Now().Add(-pendingLinkTimeout * 2)
+	if popPendingLink(sess) {
+		t.Fatalf("pending link should expire")
+	}
+}
@@ -71,6 +71,10 @@ func importNotesFromJSON(path, userLogin string) {
 			newNote.tags = append(newNote.tags, "blog")
 		}
 		_, err = dbCreateOrUpdateNote(dbUser.ID, &newNote)
+		if qe, ok := err.(*QuotaError); ok {
+			fmt.Printf("import stopped after %d notes because %s (%s)\n", nImported, qe, qe.Code)
+			return
+		}
 		if err != nil {
 			log.Fatalf("dbCreateOrUpdateNote() failed with '%s'", err)
 		}
@@ -342,6 +342,10 @@ func importPosts() (int, int) {
 		nVersions++
 		note.isPublic = rand.Intn(1000) > 100 // make 90% of notes public
 		_, err := dbCreateOrUpdateNote(userID, note)
+		if qe, ok := err.(*QuotaError); ok {
+			fmt.Printf("\nimport stopped because %s (%s)\n", qe, qe.Code)
+			return n, nVersions
+		}
 		u.PanicIfErr(err, "dbCreateOrUpdateNote()")
 
 		for currPost != nil {
@@ -349,6 +353,10 @@ func importPosts() (int, int) {
 			detectFormat(note)
 			if len(note.content) > 0 {
 				_, err := dbCreateOrUpdateNote(userID, note)
+				if qe, ok := err.(*QuotaError); ok {
+					fmt.Printf("\nimport stopped because %s (%s)\n", qe, qe.Code)
+					return n, nVersions
+				}
 				u.PanicIfErr(err, "dbCreateOrUpdateNote()")
 				nVersions++
 			}
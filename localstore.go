@@ -339,6 +339,29 @@ func (store *LocalStore) GetContentBySha1(sha1 []byte) ([]byte, error) {
 	return store.getContentBySha1Limited(sha1, -1)
 }
 
+// DeleteContent makes content with a given sha1 unavailable. Large files
+// are deleted. Segment files are append-only so content stored in them
+// stays on disk but can no longer be read
+func (store *LocalStore) DeleteContent(sha1 []byte) error {
+	key := dbKeyForContentSha1(sha1)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	name, err := store.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(name), "segment.") {
+		err = os.Remove(store.pathForSha1(sha1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return store.db.Delete(key, nil)
+}
+
 // Close closes the store
 func (store *LocalStore) Close() {
 	if store.db != nil {
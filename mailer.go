@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Sending e-mails (account verification, password reset).
+
+Mailer is chosen by config.Mail: SMTPAddr selects SMTPMailer, DropDir selects
+FileMailer which writes each message to a file in a directory (for tests and
+local development). If neither is set, mailer is nil and features that need
+sending e-mails are disabled.
+*/
+
+// MailConfig describes how we send e-mails
+type MailConfig struct {
+	// From address, e.g. "QuickNotes <noreply@quicknotes.io>"
+	From string
+	// SMTP server as host:port
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	// if set, e-mails are written to this directory instead of being sent
+	DropDir string
+}
+
+// MailMessage is an e-mail to send
+type MailMessage struct {
+	To      string
+	Subject string
+	// plain text
+	Body string
+}
+
+// Mailer sends e-mails
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+var (
+	mailer Mailer
+)
+
+// formatMailMessage formats the message as RFC 5322 e-mail
+func formatMailMessage(from string, msg *MailMessage) []byte {
+	var buf bytes.Buffer
+	// \r and \n in headers would allow injecting headers
+	hdr := func(name, val string) {
+		val = strings.NewReplacer("\r", "", "\n", "").Replace(val)
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, val)
+	}
+	hdr("From", from)
+	hdr("To", msg.To)
+	hdr("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	hdr("Date", time.Now().Format(time.RFC1123Z))
+	hdr("MIME-Version", "1.0")
+	hdr("Content-Type", "text/plain; charset=utf-8")
+	buf.WriteString("\r\n")
+	body := strings.Replace(msg.Body, "\r\n", "\n", -1)
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// SMTPMailer sends e-mails through SMTP server. Uses STARTTLS if the server
+// supports it
+type SMTPMailer struct {
+	conf *MailConfig
+}
+
+// Send sends the message
+func (m *SMTPMailer) Send(msg *MailMessage) error {
+	var auth smtp.Auth
+	if m.conf.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(m.conf.SMTPAddr)
+		auth = smtp.PlainAuth("", m.conf.SMTPUser, m.conf.SMTPPassword, host)
+	}
+	from := m.conf.From
+	if addr, err := parseEmail(from); err == nil {
+		from = addr
+	}
+	d := formatMailMessage(m.conf.From, msg)
+	return smtp.SendMail(m.conf.SMTPAddr, auth, from, []string{msg.To}, d)
+}
+
+// FileMailer writes e-mails as .eml files to a directory
+type FileMailer struct {
+	conf *MailConfig
+}
+
+// Send writes the message to a file
+func (m *FileMailer) Send(msg *MailMessage) error {
+	err := os.MkdirAll(m.conf.DropDir, 0755)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), randomToken()[:8])
+	path := filepath.Join(m.conf.DropDir, name)
+	err = ioutil.WriteFile(path, formatMailMessage(m.conf.From, msg), 0644)
+	if err != nil {
+		return err
+	}
+	log.Verbosef("wrote e-mail to '%s' as '%s'\n", msg.To, path)
+	return nil
+}
+
+// newMailer returns mailer for a config or nil if sending e-mails is not
+// configured
+func newMailer(conf *MailConfig) Mailer {
+	if conf.DropDir != "" {
+		return &FileMailer{conf: conf}
+	}
+	if conf.SMTPAddr != "" {
+		return &SMTPMailer{conf: conf}
+	}
+	return nil
+}
+
+func validateMailConfig(c *MailConfig) error {
+	if c.SMTPAddr == "" && c.DropDir == "" {
+		return nil
+	}
+	if _, err := parseEmail(c.From); err != nil {
+		return fmt.Errorf("Mail: invalid From '%s'", c.From)
+	}
+	if c.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			return fmt.Errorf("Mail: invalid SMTPAddr '%s': %s", c.SMTPAddr, err)
+		}
+	}
+	return nil
+}
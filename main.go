@@ -33,7 +33,6 @@ var (
 	flgProduction          bool
 	flgUseResourcesZip     bool
 	flgVerbose             bool
-	flgProdDb              bool // if true, use gce db when running localy
 	flgDbHost              string
 	flgDbPort              string
 	flgImportJSONUserLogin string
@@ -42,6 +41,8 @@ var (
 	flgSearchLocalTerm     string
 	flgShowNote            string
 	flgListUsers           bool
+	flgMergeUsers          string
+	flgMakeAdmin           string
 	flgImportStackOverflow bool
 
 	localStore      *LocalStore
@@ -106,6 +107,9 @@ func getCacheDir() string {
 }
 
 func getLocalStoreDir() string {
+	if config.Storage.LocalStoreDir != "" {
+		return config.Storage.LocalStoreDir
+	}
 	return filepath.Join(getDataDir(), "localstore")
 }
 
@@ -114,31 +118,30 @@ func pathForFileInCache(path string) string {
 }
 
 func parseFlags() {
-	flag.BoolVar(&flgProdDb, "proddb", false, "use production database when running locally")
+	flag.StringVar(&flgConfigPath, "config", "", "path of config .json file, see config.go. Default is $QUICKNOTES_CONFIG")
+	flag.BoolVar(&flgPrintConfig, "print-config", false, "print effective config, with secrets redacted, and exit")
 	flag.BoolVar(&flgImportStackOverflow, "import-stack-overflow", false, "import stack overflow data")
 	flag.StringVar(&flgImportJSONFile, "import-json", "", "name of .json or .json.bz2 files from which to import notes; also must spcecify -import-user")
 	flag.StringVar(&flgImportJSONUserLogin, "import-user", "", "handle of the user (users.login) for which to import notes e.g. twitter:kjk")
 	flag.BoolVar(&flgListUsers, "list-users", false, "list handles of users in the db")
+	flag.StringVar(&flgMakeAdmin, "make-admin", "", "give admin rights to a user with a given login e.g. twitter:kjk")
+	flag.StringVar(&flgMergeUsers, "merge-users", "", "move notes and logins of one user to another and delete the first, given as logins e.g. google:kjk@gmail.com,twitter:kjk")
 	flag.StringVar(&flgSearchTerm, "search", "", "search notes for a given term")
 	flag.StringVar(&flgSearchLocalTerm, "search-local", "", "search local notes for a given term")
-	flag.StringVar(&flgDbHost, "db-host", "127.0.0.1", "database host")
-	flag.StringVar(&flgDbPort, "db-port", "3306", "database port")
+	flag.StringVar(&flgDbHost, "db-host", "", "database host, overrides host in DbDSN from config")
+	flag.StringVar(&flgDbPort, "db-port", "", "database port, overrides port in DbDSN from config")
 	flag.BoolVar(&flgVerbose, "verbose", false, "enable verbose logging")
 	flag.StringVar(&flgShowNote, "show-note", "", "show a note with a given hashed id")
 	flag.BoolVar(&flgProduction, "production", false, "running in production")
 	flag.BoolVar(&flgUseResourcesZip, "use-resources-zip", false, "use quicknotes_resources.zip for static resources")
-	flag.StringVar(&flgHTTPAddr, "http-addr", "127.0.0.1:5111", "address on which to listen")
+	flag.StringVar(&flgHTTPAddr, "http-addr", "", "address on which to listen, overrides HTTPAddr from config")
+	flag.StringVar(&flgExportSiteUser, "export-site", "", "export public notes of a user with a given login (e.g. twitter:kjk) as a static website")
+	flag.StringVar(&flgExportSiteTag, "export-site-tag", "", "with -export-site, only export notes with this tag")
+	flag.StringVar(&flgExportSiteDir, "export-site-dir", "site", "with -export-site, directory to which to write the website")
+	flag.StringVar(&flgExportSiteURL, "export-site-url", "", "with -export-site, url under which the website will be hosted, used in atom feed")
+	flag.DurationVar(&flgAutoSaveWindow, "autosave-window", defaultAutoSaveWindow, "auto-saves of a note within this time are coalesced into a single version; 0 disables coalescing")
 
 	flag.Parse()
-
-	if flgProduction {
-		flgHTTPAddr = ":80"
-		redirectHTTPToHTTPS = true
-	}
-
-	// in production or in cowboy mode we save notes to google storage as well
-	// TODO: maybe to it always?
-	onlyLocalStorage = !(flgProduction || flgProdDb)
 }
 
 func runGulpAndWaitExit() {
@@ -209,6 +212,8 @@ func logHTTP(r *http.Request, code, nBytesWritten, userID int, dur time.Duration
 
 func dailyTasksLoop() {
 	buildPublicNotesIndex()
+	buildSitemaps()
+	recordDailyStats()
 
 	// tasks we run once a day at 1 am
 	for {
@@ -226,6 +231,11 @@ func dailyTasksLoop() {
 		timeStr := time.Now().Format("2006-01-02 15:04:05")
 		log.Infof("executing daily tasks at %s\n", timeStr)
 		buildPublicNotesIndex()
+		buildSitemaps()
+		recordDailyStats()
+		if err := deleteExpiredAccounts(); err != nil {
+			log.Errorf("deleteExpiredAccounts() failed with '%s'\n", err)
+		}
 	}
 }
 
@@ -256,6 +266,8 @@ func main() {
 	if flgVerbose {
 		log.IncVerbosity()
 	}
+	loadConfigMust()
+	redirectHTTPToHTTPS = config.HTTPSAddr != ""
 
 	initCookieMust()
 	initHashID()
@@ -263,7 +275,7 @@ func main() {
 	verifyDirs()
 	openLogFilesMust()
 
-	log.Infof("production: %v, proddb: %v, sql connection: %s, data dir: %s, httpAddr: %s, verbose: %v\n", flgProduction, flgProdDb, getSQLConnectionSanitized(), getDataDir(), flgHTTPAddr, flgVerbose)
+	log.Infof("production: %v, sql connection: %s, data dir: %s, httpAddr: %s, httpsAddr: %s, verbose: %v\n", flgProduction, getSQLConnectionSanitized(), getDataDir(), config.HTTPAddr, config.HTTPSAddr, flgVerbose)
 
 	if flgSearchLocalTerm != "" {
 		searchLocalNotes(flgSearchLocalTerm, defaultMaxResults)
@@ -295,21 +307,54 @@ func main() {
 		return
 	}
 
+	if flgMakeAdmin != "" {
+		err = makeAdmin(flgMakeAdmin)
+		if err != nil {
+			log.Fatalf("makeAdmin() failed with %s\n", err)
+		}
+		return
+	}
+
 	localStore, err = NewLocalStore(getLocalStoreDir())
 	if err != nil {
 		log.Fatalf("NewLocalStore() failed with %s\n", err)
 	}
 
+	searchIndex, err = OpenSearchIndex(getSearchIndexDir())
+	if err != nil {
+		log.Fatalf("OpenSearchIndex() failed with %s\n", err)
+	}
+
 	if flgShowNote != "" {
 		debugShowNote(flgShowNote)
 		return
 	}
 
+	if flgMergeUsers != "" {
+		parts := strings.Split(flgMergeUsers, ",")
+		if len(parts) != 2 {
+			log.Fatalf("-merge-users must be from,to e.g. google:kjk@gmail.com,twitter:kjk\n")
+		}
+		err = mergeUsers(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Fatalf("mergeUsers() failed with %s\n", err)
+		}
+		return
+	}
+
 	if flgImportJSONFile != "" {
 		importNotesFromJSON(flgImportJSONFile, flgImportJSONUserLogin)
 		return
 	}
 
+	if flgExportSiteUser != "" {
+		err = exportStaticSite(flgExportSiteUser, flgExportSiteTag, flgExportSiteDir, flgExportSiteURL)
+		if err != nil {
+			log.Fatalf("exportStaticSite() failed with %s\n", err)
+		}
+		return
+	}
+
 	if false {
 		testListObjects()
 		return
@@ -324,7 +369,9 @@ func main() {
 		runGulpAsync()
 	}
 
-	initGoogleStorageMust()
+	if !onlyLocalStorage {
+		initGoogleStorageMust()
+	}
 
 	_, err = dbGetOrCreateUser("email:quicknotes@quicknotes.io", "QuickNotes")
 	u.PanicIfErr(err, "dbGetOrCreateUser")
@@ -335,13 +382,12 @@ func main() {
 	var httpsSrv *http.Server
 	var m *autocert.Manager
 
-	if flgProduction {
+	if config.HTTPSAddr != "" {
 		hostPolicy := func(ctx context.Context, host string) error {
-			allowedDomain := "quicknotes.io"
-			if strings.HasSuffix(host, allowedDomain) {
+			if isAllowedHost(host, config.AllowedDomains) {
 				return nil
 			}
-			return fmt.Errorf("acme/autocert: only *.%s hosts are allowed", allowedDomain)
+			return fmt.Errorf("acme/autocert: host '%s' is not in %v", host, config.AllowedDomains)
 		}
 
 		m = &autocert.Manager{
@@ -351,7 +397,7 @@ func main() {
 		}
 
 		httpsSrv := makeHTTPServer()
-		httpsSrv.Addr = ":443"
+		httpsSrv.Addr = config.HTTPSAddr
 		httpsSrv.TLSConfig = &tls.Config{GetCertificate: m.GetCertificate}
 		log.Infof("Starting HTTPS on %s\n", httpsSrv.Addr)
 
@@ -372,7 +418,7 @@ func main() {
 	}
 
 	var httpSrv *http.Server
-	log.Infof("Starting HTTP on %s. Redirect to https: %v, saving to Google Storage: %v\n", flgHTTPAddr, redirectHTTPToHTTPS, !onlyLocalStorage)
+	log.Infof("Starting HTTP on %s. Redirect to https: %v, saving to Google Storage: %v\n", config.HTTPAddr, redirectHTTPToHTTPS, !onlyLocalStorage)
 	if redirectHTTPToHTTPS {
 		httpSrv = makeHTTPToHTTPSRedirectServer()
 	} else {
@@ -381,7 +427,7 @@ func main() {
 	if m != nil {
 		httpSrv.Handler = m.HTTPHandler(httpSrv.Handler)
 	}
-	httpSrv.Addr = flgHTTPAddr
+	httpSrv.Addr = config.HTTPAddr
 
 	go func() {
 		wg.Add(1)
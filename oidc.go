@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"golang.org/x/oauth2"
+)
+
+/*
+Login with OpenID Connect providers configured in config.OIDC.
+
+Flow (authorization code with PKCE):
+- /loginoidc?provider=${name}&redir=${redirect} creates a random state, nonce
+  and PKCE code verifier, remembers them on the server and redirects to
+  authorization endpoint of the provider
+- provider redirects to /loginoidccb?state=${state}&code=${code}. State must
+  be one we created (it can only be used once) in this browser (see
+  setOAuthStateCookie) and we exchange the code, together with code
+  verifier, for tokens
+- we verify the ID token (RS256 signature with keys from provider's JWKS,
+  issuer, audience, expiration and nonce) and map its claims to users.login
+  (${name}:${LoginClaim}), full_name and email. Claims missing from ID token
+  are taken from userinfo endpoint. Email is only used if email_verified
+  claim is true
+
+Endpoints are discovered from ${IssuerURL}/.well-known/openid-configuration.
+*/
+
+const (
+	oidcStateTimeout     = 10 * time.Minute
+	oidcDiscoveryTimeout = time.Hour
+	// allowed clock difference between us and the provider
+	oidcClockSkew = time.Minute
+)
+
+var (
+	oidcProviders = map[string]*OIDCProvider{}
+
+	oidcStatesMu sync.Mutex
+	// state => login in progress
+	oidcStates = map[string]*oidcLoginState{}
+
+	oidcProviderNameRx = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// OIDCProvider is an OpenID Connect login provider
+type OIDCProvider struct {
+	conf       *OIDCProviderConfig
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	// kid => key
+	keys map[string]*rsa.PublicKey
+}
+
+// subset of https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// login in progress, keyed by state
+type oidcLoginState struct {
+	provider     string
+	nonce        string
+	codeVerifier string
+	redirectURL  string
+	// where to go after login
+	redir     string
+	createdAt time.Time
+}
+
+// OIDCUserInfo is user info mapped from claims
+type OIDCUserInfo struct {
+	Login    string
+	FullName string
+	Email    string
+}
+
+// oidcLoginProvider is shown as a login option in the ui
+type oidcLoginProvider struct {
+	Name        string
+	DisplayName string
+}
+
+var builtInLoginPrefixes = []string{"twitter", "github", "google", "email"}
+
+func validateOIDCProviderConfig(c *OIDCProviderConfig) error {
+	if !oidcProviderNameRx.MatchString(c.Name) {
+		return fmt.Errorf("OIDC: invalid provider name '%s', must be lower-case letters, digits, _ or -", c.Name)
+	}
+	for _, s := range builtInLoginPrefixes {
+		if c.Name == s {
+			return fmt.Errorf("OIDC: provider name '%s' is reserved", c.Name)
+		}
+	}
+	uri, err := url.Parse(c.IssuerURL)
+	if err != nil || uri.Host == "" || (uri.Scheme != "http" && uri.Scheme != "https") {
+		return fmt.Errorf("OIDC %s: invalid IssuerURL '%s'", c.Name, c.IssuerURL)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("OIDC %s: ClientID must be set", c.Name)
+	}
+	return nil
+}
+
+// NewOIDCProvider creates a provider. Nothing is fetched until first login
+func NewOIDCProvider(conf *OIDCProviderConfig, httpClient *http.Client) *OIDCProvider {
+	c := *conf
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	if c.NameClaim == "" {
+		c.NameClaim = "name"
+	}
+	if c.EmailClaim == "" {
+		c.EmailClaim = "email"
+	}
+	if c.DisplayName == "" {
+		c.DisplayName = c.Name
+	}
+	c.IssuerURL = strings.TrimSuffix(c.IssuerURL, "/")
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &OIDCProvider{
+		conf:       &c,
+		httpClient: httpClient,
+	}
+}
+
+func initOIDCProviders(confs []OIDCProviderConfig) {
+	oidcProviders = map[string]*OIDCProvider{}
+	for i := range confs {
+		p := NewOIDCProvider(&confs[i], nil)
+		oidcProviders[p.conf.Name] = p
+	}
+}
+
+// getOIDCLoginProviders returns providers to show in the ui
+func getOIDCLoginProviders() []oidcLoginProvider {
+	res := []oidcLoginProvider{}
+	for _, c := range config.OIDC {
+		p := oidcProviders[c.Name]
+		res = append(res, oidcLoginProvider{Name: p.conf.Name, DisplayName: p.conf.DisplayName})
+	}
+	return res
+}
+
+// pkceChallenge returns S256 code challenge for a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *OIDCProvider) getJSON(uri string, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", uri, resp.StatusCode)
+	}
+	return json.Unmarshal(d, v)
+}
+
+// discover returns provider metadata, fetching it if necessary
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && !timeExpired(p.discoveredAt, oidcDiscoveryTimeout) {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	err := p.getJSON(p.conf.IssuerURL+"/.well-known/openid-configuration", "", &d)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.conf.IssuerURL {
+		return nil, fmt.Errorf("issuer '%s' in discovery document doesn't match '%s'", d.Issuer, p.conf.IssuerURL)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, fmt.Errorf("discovery document of '%s' is missing endpoints", p.conf.IssuerURL)
+	}
+	p.discovery = &d
+	p.discoveredAt = time.Now()
+	p.keys = nil
+	return &d, nil
+}
+
+func parseJWK(k *oidcJWK) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() > 1<<31 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+func (p *OIDCProvider) fetchKeys(jwksURI string) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []*oidcJWK `json:"keys"`
+	}
+	err := p.getJSON(jwksURI, "", &jwks)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			log.Errorf("invalid key '%s' in '%s': %s\n", k.Kid, jwksURI, err)
+			continue
+		}
+		res[k.Kid] = key
+	}
+	return res, nil
+}
+
+// getKey returns signing key with a given id. Keys are re-fetched if kid
+// is not known, in case the provider rotated them
+func (p *OIDCProvider) getKey(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := p.keys[kid]; key != nil {
+		return key, nil
+	}
+	keys, err := p.fetchKeys(d.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if key := keys[kid]; key != nil {
+		return key, nil
+	}
+	// a single key doesn't need kid
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key with kid '%s'", kid)
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+func hasAudience(claims map[string]interface{}, clientID string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyIDToken verifies signature and claims of ID token and returns claims
+func (p *OIDCProvider) verifyIDToken(d *oidcDiscovery, idToken string, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hd, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(hd, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm '%s'", header.Alg)
+	}
+	key, err := p.getKey(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token signature")
+	}
+
+	var claims map[string]interface{}
+	cd, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(cd, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token claims")
+	}
+	if iss := claimString(claims, "iss"); iss != d.Issuer {
+		return nil, fmt.Errorf("ID token issuer '%s' doesn't match '%s'", iss, d.Issuer)
+	}
+	if !hasAudience(claims, p.conf.ClientID) {
+		return nil, fmt.Errorf("ID token is not for client '%s'", p.conf.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("ID token nonce doesn't match")
+	}
+	if claimString(claims, "sub") == "" {
+		return nil, fmt.Errorf("ID token has no 'sub' claim")
+	}
+	return claims, nil
+}
+
+// loginClaim returns the claim that identifies the user. Defaults to sub
+// because preferred_username can be changed by the user and reused by others
+func (p *OIDCProvider) loginClaim(claims map[string]interface{}) string {
+	name := p.conf.LoginClaim
+	if name == "" {
+		name = "sub"
+	}
+	return claimString(claims, name)
+}
+
+// mapClaims maps claims to login, full name and email of the user
+func (p *OIDCProvider) mapClaims(claims map[string]interface{}) (*OIDCUserInfo, error) {
+	login := p.loginClaim(claims)
+	if login == "" {
+		name := p.conf.LoginClaim
+		if name == "" {
+			name = "sub"
+		}
+		return nil, fmt.Errorf("missing '%s' claim", name)
+	}
+	res := &OIDCUserInfo{
+		Login:    p.conf.Name + ":" + login,
+		FullName: claimString(claims, p.conf.NameClaim),
+	}
+	// only use verified emails. Missing email_verified means not verified
+	if verified, _ := claims["email_verified"].(bool); verified {
+		res.Email = claimString(claims, p.conf.EmailClaim)
+	}
+	return res, nil
+}
+
+func (p *OIDCProvider) oauth2Config(d *oidcDiscovery, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.conf.ClientID,
+		ClientSecret: p.conf.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+		RedirectURL: redirectURL,
+		Scopes:      p.conf.Scopes,
+	}
+}
+
+// AuthCodeURL starts a login. redirectURL is our callback url, redir is
+// where to go after login. Returns url of the provider and state of the login
+func (p *OIDCProvider) AuthCodeURL(redirectURL, redir string) (string, string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+	st := &oidcLoginState{
+		provider:     p.conf.Name,
+		nonce:        randomToken(),
+		codeVerifier: randomToken(),
+		redirectURL:  redirectURL,
+		redir:        redir,
+		createdAt:    time.Now(),
+	}
+	state := randomToken()
+	putOIDCLoginState(state, st)
+	conf := p.oauth2Config(d, redirectURL)
+	uri := conf.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", st.nonce),
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(st.codeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	return uri, state, nil
+}
+
+// Exchange finishes a login by exchanging code for tokens and returns info
+// about the user
+func (p *OIDCProvider) Exchange(ctx context.Context, st *oidcLoginState, code string) (*OIDCUserInfo, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.httpClient)
+	conf := p.oauth2Config(d, st.redirectURL)
+	token, err := conf.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", st.codeVerifier))
+	if err != nil {
+		return nil, err
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+	claims, err := p.verifyIDToken(d, idToken, st.nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	needsUserinfo := p.loginClaim(claims) == "" || claims[p.conf.NameClaim] == nil || claims[p.conf.EmailClaim] == nil
+	if needsUserinfo && d.UserinfoEndpoint != "" {
+		var info map[string]interface{}
+		err = p.getJSON(d.UserinfoEndpoint, token.AccessToken, &info)
+		if err != nil {
+			log.Errorf("getting userinfo from '%s' failed with '%s'\n", d.UserinfoEndpoint, err)
+		} else if claimString(info, "sub") == claimString(claims, "sub") {
+			// claims from ID token take precedence
+			for k, v := range info {
+				if _, ok := claims[k]; !ok {
+					claims[k] = v
+				}
+			}
+		}
+	}
+	return p.mapClaims(claims)
+}
+
+func putOIDCLoginState(state string, st *oidcLoginState) {
+	oidcStatesMu.Lock()
+	defer oidcStatesMu.Unlock()
+	for k, v := range oidcStates {
+		if timeExpired(v.createdAt, oidcStateTimeout) {
+			delete(oidcStates, k)
+		}
+	}
+	oidcStates[state] = st
+}
+
+// popOIDCLoginState returns login for a given state and forgets it, so that
+// state can only be used once. Returns nil if there's no such login
+func popOIDCLoginState(state string) *oidcLoginState {
+	oidcStatesMu.Lock()
+	defer oidcStatesMu.Unlock()
+	st := oidcStates[state]
+	delete(oidcStates, state)
+	if st == nil || timeExpired(st.createdAt, oidcStateTimeout) {
+		return nil
+	}
+	return st
+}
+
+// GET /loginoidc?provider=${name}&redir=${redirect}
+func handleLoginOIDC(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("provider")
+	redir := strings.TrimSpace(r.FormValue("redir"))
+	log.Verbosef("provider: '%s', redir: '%s'\n", name, redir)
+	p := oidcProviders[name]
+	if p == nil {
+		httpErrorf(w, "unknown login provider '%s'", name)
+		return
+	}
+	uri, state, err := p.AuthCodeURL(getMyHost(r)+"/loginoidccb", redir)
+	if err != nil {
+		log.Errorf("starting login with '%s' failed with '%s'\n", name, err)
+		httpErrorf(w, "login with %s is not available", p.conf.DisplayName)
+		return
+	}
+	setOAuthStateCookie(w, state)
+	http.Redirect(w, r, uri, http.StatusTemporaryRedirect)
+}
+
+// GET /loginoidccb?state=${state}&code=${code}
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	state := r.FormValue("state")
+	if !checkOAuthStateCookie(w, r, state) {
+		log.Errorf("oidc state '%s' doesn't match state cookie\n", state)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	st := popOIDCLoginState(state)
+	if st == nil {
+		log.Errorf("invalid or expired oidc state, url: '%s'\n", r.URL)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	if errCode := r.FormValue("error"); errCode != "" {
+		log.Errorf("login with '%s' failed with '%s': '%s'\n", st.provider, errCode, r.FormValue("error_description"))
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	p := oidcProviders[st.provider]
+	if p == nil {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	info, err := p.Exchange(r.Context(), st, r.FormValue("code"))
+	if err != nil {
+		log.Errorf("login with '%s' failed with '%s'\n", st.provider, err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	redir := st.redir
+	if redir == "" {
+		redir = "/"
+	}
+	loginUser(w, r, info.Login, info.FullName, info.Email, redir)
+}
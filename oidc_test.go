@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockOIDCServer is a minimal OpenID Connect provider for tests
+type mockOIDCServer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	// set by authorize()
+	code          string
+	codeChallenge string
+	nonce         string
+}
+
+func b64(d []byte) string {
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+func (s *mockOIDCServer) signJWT(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// authorize simulates user logging in at authorization endpoint
+func (s *mockOIDCServer) authorize(t *testing.T, authURL string) (state string) {
+	uri, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := uri.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("missing PKCE, nonce or state in '%s'", authURL)
+	}
+	s.code = "code-" + q.Get("state")
+	s.codeChallenge = q.Get("code_challenge")
+	s.nonce = q.Get("nonce")
+	return q.Get("state")
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mockOIDCServer{key: key}
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"userinfo_endpoint":      s.URL + "/userinfo",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "k1", "use": "sig", "n": b64(key.N.Bytes()), "e": b64(e)},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != s.code || pkceChallenge(r.FormValue("code_verifier")) != s.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   s.URL,
+			"aud":   "qn-client",
+			"sub":   "user-1",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": s.nonce,
+		}
+		for k, v := range s.claims {
+			claims[k] = v
+		}
+		writeJSON(w, map[string]interface{}{
+			"access_token": "access-1",
+			"token_type":   "Bearer",
+			"id_token":     s.signJWT(claims),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"sub":            "user-1",
+			"name":           "Jane Doe",
+			"email":          "jane@acme.com",
+			"email_verified": true,
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func TestOIDCLogin(t *testing.T) {
+	s := newMockOIDCServer(t)
+	defer s.Close()
+	conf := &OIDCProviderConfig{
+		Name:         "acme",
+		IssuerURL:    s.URL,
+		ClientID:     "qn-client",
+		ClientSecret: "qn-secret",
+	}
+	if err := validateOIDCProviderConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	p := NewOIDCProvider(conf, s.Client())
+	ctx := context.Background()
+
+	login := func(claims map[string]interface{}) (*OIDCUserInfo, error) {
+		s.claims = claims
+		authURL, state, err := p.AuthCodeURL("http://localhost/loginoidccb", "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.authorize(t, authURL); got != state {
+			t.Fatalf("expected state '%s', got '%s'", state, got)
+		}
+		st := popOIDCLoginState(state)
+		if st == nil {
+			t.Fatalf("no login state for '%s'", state)
+		}
+		if popOIDCLoginState(state) != nil {
+			t.Fatalf("state can be used twice")
+		}
+		return p.Exchange(ctx, st, s.code)
+	}
+
+	// login is sub, not preferred_username. Name and email come from userinfo
+	info, err := login(map[string]interface{}{"preferred_username": "jane"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := OIDCUserInfo{Login: "acme:user-1", FullName: "Jane Doe", Email: "jane@acme.com"}
+	if *info != exp {
+		t.Fatalf("expected %#v, got %#v", exp, info)
+	}
+
+	// unverified or not known to be verified email is not used
+	for _, claims := range []map[string]interface{}{
+		{"name": "J", "email": "j@acme.com", "email_verified": false},
+		{"name": "J", "email": "j@acme.com"},
+	} {
+		info, err = login(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp = OIDCUserInfo{Login: "acme:user-1", FullName: "J"}
+		if *info != exp {
+			t.Fatalf("expected %#v, got %#v", exp, info)
+		}
+	}
+
+	for _, claims := range []map[string]interface{}{
+		{"nonce": "other"},
+		{"aud": "other-client"},
+		{"iss": "https://evil.com"},
+		{"exp": time.Now().Add(-time.Hour).Unix()},
+	} {
+		if _, err = login(claims); err == nil {
+			t.Fatalf("login with %v should fail", claims)
+		}
+	}
+
+	// code without PKCE verifier is rejected
+	authURL, state, _ := p.AuthCodeURL("http://localhost/loginoidccb", "/")
+	s.authorize(t, authURL)
+	st := popOIDCLoginState(state)
+	st.codeVerifier = "wrong"
+	if _, err = p.Exchange(ctx, st, s.code); err == nil {
+		t.Fatalf("exchange with wrong code verifier should fail")
+	}
+}
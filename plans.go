@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Plans limit how much a user can store. Plan is chosen by users.pro_state:
+IsPro users get Pro limits, everyone else gets Free limits. Limits are set
+in Plans section of config, e.g.:
+
+  "Plans": {
+    "Free": { "MaxNotes": 1000, "MaxContentBytes": 52428800, "MaxNoteBytes": 1048576, "MaxVersions": 50 },
+    "Pro": { "MaxNoteBytes": 10485760 }
+  }
+
+A limit that is not set (0) is not enforced. Notes in trash count towards
+limits until they're permanently deleted.
+
+Limits are checked in dbCreateOrUpdateNote so they apply to editing and
+to imports. Exceeding a limit returns *QuotaError with a Code that is sent
+to the browser as errorCode.
+*/
+
+// quota error codes
+const (
+	quotaMaxNotes        = "quota_max_notes"
+	quotaMaxContentBytes = "quota_max_content_bytes"
+	quotaMaxNoteBytes    = "quota_max_note_bytes"
+)
+
+// PlanLimits are limits of a plan. 0 means no limit
+type PlanLimits struct {
+	MaxNotes int
+	// sum of sizes of current versions of all notes
+	MaxContentBytes int64
+	// size of a single note. Notes don't have separate attachments so this
+	// is also a limit on size of embedded files
+	MaxNoteBytes int64
+	// older versions of a note are deleted when it has more versions
+	MaxVersions int
+}
+
+// PlansConfig has limits of plans, see plans.go
+type PlansConfig struct {
+	// for NotProEligible and CanBePro users
+	Free PlanLimits
+	// for IsPro users
+	Pro PlanLimits
+}
+
+// QuotaError is returned when a change would exceed limits of user's plan
+type QuotaError struct {
+	Code string
+	msg  string
+}
+
+func (e *QuotaError) Error() string {
+	return e.msg
+}
+
+// UserUsage is how much a user stores and what are the limits of their plan
+type UserUsage struct {
+	Plan         string
+	NotesCount   int
+	ContentBytes int64
+	Limits       PlanLimits
+}
+
+func validatePlanLimits(name string, l *PlanLimits) error {
+	if l.MaxNotes < 0 || l.MaxContentBytes < 0 || l.MaxNoteBytes < 0 || l.MaxVersions < 0 {
+		return fmt.Errorf("Plans.%s: limits can't be negative", name)
+	}
+	return nil
+}
+
+func userPlan(user *DbUser) (string, *PlanLimits) {
+	if user.ProState == IsPro {
+		return "pro", &config.Plans.Pro
+	}
+	return "free", &config.Plans.Free
+}
+
+func calcUserUsage(user *DbUser, notes []*Note) *UserUsage {
+	plan, limits := userPlan(user)
+	res := &UserUsage{
+		Plan:       plan,
+		NotesCount: len(notes),
+		Limits:     *limits,
+	}
+	for _, note := range notes {
+		res.ContentBytes += int64(note.Size)
+	}
+	return res
+}
+
+func getUserUsage(userID int) (*UserUsage, error) {
+	i, err := getCachedUserInfo(userID)
+	if err != nil {
+		return nil, err
+	}
+	return calcUserUsage(i.user, i.notes), nil
+}
+
+// checkQuota returns *QuotaError if saving a note with newSize bytes would
+// exceed the limits. existing is nil for new notes
+func checkQuota(usage *UserUsage, existing *Note, newSize int) error {
+	l := &usage.Limits
+	if l.MaxNoteBytes > 0 && int64(newSize) > l.MaxNoteBytes {
+		return &QuotaError{
+			Code: quotaMaxNoteBytes,
+			msg:  fmt.Sprintf("note is %s, your plan allows notes up to %s", formatSize(int64(newSize)), formatSize(l.MaxNoteBytes)),
+		}
+	}
+	if existing == nil && l.MaxNotes > 0 && usage.NotesCount >= l.MaxNotes {
+		return &QuotaError{
+			Code: quotaMaxNotes,
+			msg:  fmt.Sprintf("your plan allows %d notes", l.MaxNotes),
+		}
+	}
+	total := usage.ContentBytes + int64(newSize)
+	if existing != nil {
+		total -= int64(existing.Size)
+	}
+	// allow edits that don't grow the note even if over the limit, so that
+	// users can make room
+	grows := existing == nil || newSize > existing.Size
+	if grows && l.MaxContentBytes > 0 && total > l.MaxContentBytes {
+		return &QuotaError{
+			Code: quotaMaxContentBytes,
+			msg:  fmt.Sprintf("your plan allows %s of notes, you're using %s", formatSize(l.MaxContentBytes), formatSize(usage.ContentBytes)),
+		}
+	}
+	return nil
+}
+
+func dbGetUserUsage(userID int) (notesCount int, contentBytes int64, err error) {
+	db := getDbMust()
+	q := `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM notes WHERE user_id = ?`
+	err = db.QueryRow(q, userID).Scan(&notesCount, &contentBytes)
+	return
+}
+
+func checkUserQuota(userID int, existing *Note, newSize int) error {
+	user, err := dbGetUserByIDCached(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("no user %d", userID)
+	}
+	plan, limits := userPlan(user)
+	if limits.MaxNotes == 0 && limits.MaxContentBytes == 0 && limits.MaxNoteBytes == 0 {
+		return nil
+	}
+	// not using getCachedUserInfo because it's cleared after every change
+	// which would make imports slow
+	usage := &UserUsage{Plan: plan, Limits: *limits}
+	usage.NotesCount, usage.ContentBytes, err = dbGetUserUsage(userID)
+	if err != nil {
+		return err
+	}
+	return checkQuota(usage, existing, newSize)
+}
+
+// dbPruneNoteVersions deletes the oldest versions of a note so that it has
+// at most maxVersions
+func dbPruneNoteVersions(noteID int, maxVersions int) error {
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	q := `
+DELETE FROM versions WHERE note_id = ? AND id NOT IN (
+  SELECT id FROM (SELECT id FROM versions WHERE note_id = ? ORDER BY id DESC LIMIT ?) AS newest
+)`
+	res, err := tx.Exec(q, noteID, noteID, maxVersions)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	q = `UPDATE notes SET versions_count = (SELECT COUNT(*) FROM versions WHERE note_id = ?) WHERE id = ?`
+	_, err = tx.Exec(q, noteID, noteID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+func pruneNoteVersions(userID, noteID int) {
+	user, err := dbGetUserByIDCached(userID)
+	if err != nil || user == nil {
+		return
+	}
+	_, limits := userPlan(user)
+	if limits.MaxVersions <= 0 {
+		return
+	}
+	err = dbPruneNoteVersions(noteID, limits.MaxVersions)
+	if err != nil {
+		log.Errorf("dbPruneNoteVersions(%d) failed with '%s'\n", noteID, err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func quotaCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if qe, ok := err.(*QuotaError); ok {
+		return qe.Code
+	}
+	return err.Error()
+}
+
+func noteWithSize(size int) *Note {
+	n := &Note{}
+	n.Size = size
+	return n
+}
+
+func TestCheckQuota(t *testing.T) {
+	usage := &UserUsage{
+		NotesCount:   10,
+		ContentBytes: 1000,
+		Limits: PlanLimits{
+			MaxNotes:        10,
+			MaxContentBytes: 1000,
+			MaxNoteBytes:    100,
+		},
+	}
+	small := noteWithSize(50)
+	tests := []struct {
+		existing *Note
+		size     int
+		exp      string
+	}{
+		{nil, 10, quotaMaxNotes},
+		{small, 101, quotaMaxNoteBytes},
+		{small, 60, quotaMaxContentBytes},
+		// edits that don't grow a note are allowed so that users can make room
+		{small, 50, ""},
+		{small, 20, ""},
+	}
+	for i, test := range tests {
+		if got := quotaCode(checkQuota(usage, test.existing, test.size)); got != test.exp {
+			t.Errorf("test %d: expected '%s', got '%s'", i, test.exp, got)
+		}
+	}
+
+	usage.NotesCount = 9
+	usage.ContentBytes = 900
+	if err := checkQuota(usage, nil, 100); err != nil {
+		t.Errorf("expected no error, got '%s'", err)
+	}
+	if got := quotaCode(checkQuota(usage, nil, 101)); got != quotaMaxNoteBytes {
+		t.Errorf("expected '%s', got '%s'", quotaMaxNoteBytes, got)
+	}
+
+	// no limits
+	usage.Limits = PlanLimits{}
+	if err := checkQuota(usage, nil, 1<<20); err != nil {
+		t.Errorf("expected no error, got '%s'", err)
+	}
+}
+
+func TestCalcUserUsage(t *testing.T) {
+	config.Plans = PlansConfig{
+		Free: PlanLimits{MaxNotes: 5},
+		Pro:  PlanLimits{MaxNotes: 50},
+	}
+	defer func() { config.Plans = PlansConfig{} }()
+	notes := []*Note{noteWithSize(10), noteWithSize(20)}
+	usage := calcUserUsage(&DbUser{ProState: IsPro}, notes)
+	if usage.Plan != "pro" || usage.NotesCount != 2 || usage.ContentBytes != 30 || usage.Limits.MaxNotes != 50 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	usage = calcUserUsage(&DbUser{ProState: CanBePro}, nil)
+	if usage.Plan != "free" || usage.Limits.MaxNotes != 5 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
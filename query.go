@@ -0,0 +1,573 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+Search query language:
+
+foo bar          - notes that contain both foo and bar (as substrings)
+"foo bar"        - notes that contain exact phrase foo bar
+foo OR bar       - notes that contain foo or bar. OR binds tighter than
+                   implicit AND i.e. a b OR c means a AND (b OR c)
+-foo             - notes that don't contain foo. Can be combined with other
+                   operators e.g. -tag:work
+tag:work         - notes tagged work
+format:md        - notes in a given format: md, txt, html, code, code:go
+is:starred, is:public, is:deleted
+kuberentes~      - typo-tolerant match, allows 0 to 2 edits depending on length
+kube~1           - typo-tolerant match with at most 1 edit
+kube*            - words starting with kube. Can be combined with ~ e.g. kuebr*~
+created:>2017-01-01, updated:<=2017-02-01, created:2017-01-01 - date ranges,
+                   supported operators are <, <=, >, >= and =
+updated:last-7d, created:last-2w - in the last 7 days (2 weeks), today
+                   included
+
+Deleted notes are only searched if the query has is:deleted.
+Matching is case-insensitive.
+
+In regex mode the whole query is a regular expression, see regex.go.
+*/
+
+const (
+	queryText = iota
+	queryTag
+	queryFormat
+	queryIs
+	queryCreated
+	queryUpdated
+	queryRegex
+)
+
+const (
+	queryDateFormat = "2006-01-02"
+)
+
+// QueryTerm is a single term of the query
+type QueryTerm struct {
+	Kind    int
+	Negated bool
+	// text, tag, format or is: value
+	Text string
+	// for text terms, max number of edits for fuzzy matching (see fuzzy.go)
+	Fuzzy int
+	// for text terms, only match at the start of words
+	Prefix bool
+	// for created: and updated:
+	Op   string
+	Date time.Time
+	// for regex terms
+	Regex *QueryRegex
+}
+
+// Query is a parsed search query. Note matches the query if it matches all
+// clauses. Clause matches if any of its terms matches
+type Query struct {
+	Clauses [][]*QueryTerm
+}
+
+// QueryError describes a malformed query
+type QueryError struct {
+	Query string
+	Msg   string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query '%s': %s", e.Query, e.Msg)
+}
+
+// splits query into whitespace-separated parts. Parts in quotes can contain
+// whitespace. Quotes are preserved
+func tokenizeQuery(s string) ([]string, error) {
+	var res []string
+	var curr []rune
+	inQuote := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			curr = append(curr, c)
+		case unicode.IsSpace(c) && !inQuote:
+			if len(curr) > 0 {
+				res = append(res, string(curr))
+			}
+			curr = nil
+		default:
+			curr = append(curr, c)
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("missing closing quote")
+	}
+	if len(curr) > 0 {
+		res = append(res, string(curr))
+	}
+	return res, nil
+}
+
+func unquote(s string) string {
+	return strings.Replace(s, `"`, "", -1)
+}
+
+func parseQueryFormat(s string) (string, error) {
+	switch s {
+	case "markdown":
+		return formatMarkdown, nil
+	case "text":
+		return formatText, nil
+	case "code":
+		return formatCodePrefix, nil
+	}
+	if !isValidFormat(s) {
+		return "", fmt.Errorf("unknown format '%s'", s)
+	}
+	return s, nil
+}
+
+// parses last-Nd and last-Nw. Returns the first day of the range
+func parseQueryRelativeDate(s string) (time.Time, error) {
+	var t time.Time
+	rest := strings.TrimPrefix(s, "last-")
+	if len(rest) < 2 {
+		return t, fmt.Errorf("invalid date '%s', expected e.g. last-7d or last-2w", s)
+	}
+	n, err := strconv.Atoi(rest[:len(rest)-1])
+	if err != nil || n < 1 {
+		return t, fmt.Errorf("invalid date '%s', expected e.g. last-7d or last-2w", s)
+	}
+	switch rest[len(rest)-1] {
+	case 'd':
+	case 'w':
+		n *= 7
+	default:
+		return t, fmt.Errorf("invalid date '%s', expected e.g. last-7d or last-2w", s)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	return today.AddDate(0, 0, 1-n), nil
+}
+
+func parseQueryDate(s string) (string, time.Time, error) {
+	if strings.HasPrefix(s, "last-") {
+		t, err := parseQueryRelativeDate(s)
+		return ">=", t, err
+	}
+	op := "="
+	for _, prefix := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			s = s[len(prefix):]
+			break
+		}
+	}
+	t, err := time.Parse(queryDateFormat, s)
+	if err != nil {
+		return "", t, fmt.Errorf("invalid date '%s', expected YYYY-MM-DD", s)
+	}
+	return op, t, nil
+}
+
+// isAllDigits returns true if s only has ascii digits, including empty s
+func isAllDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parses fuzzy (~, ~N) and prefix (*) suffixes of text term. ~ not at the
+// end of the term (e.g. foo~bar) is searched literally
+func parseQueryTextSuffix(term *QueryTerm) error {
+	s := term.Text
+	if idx := strings.LastIndexByte(s, '~'); idx > 0 && isAllDigits(s[idx+1:]) {
+		n := s[idx+1:]
+		switch n {
+		case "":
+			term.Fuzzy = autoFuzzyEdits(strings.TrimSuffix(s[:idx], "*"))
+		case "0", "1", "2":
+			term.Fuzzy = int(n[0] - '0')
+		default:
+			return fmt.Errorf("invalid '%s', max number of edits must be 0, 1 or 2", s[idx:])
+		}
+		s = s[:idx]
+	}
+	if len(s) > 1 && strings.HasSuffix(s, "*") {
+		term.Prefix = true
+		s = s[:len(s)-1]
+	}
+	term.Text = s
+	return nil
+}
+
+func parseQueryTerm(s string) (*QueryTerm, error) {
+	term := &QueryTerm{Kind: queryText}
+	if len(s) > 1 && s[0] == '-' {
+		term.Negated = true
+		s = s[1:]
+	}
+	if strings.HasPrefix(s, `"`) {
+		term.Text = foldString(unquote(s))
+		if term.Text == "" {
+			return nil, fmt.Errorf("empty phrase")
+		}
+		return term, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		term.Text = foldString(unquote(s))
+		return term, parseQueryTextSuffix(term)
+	}
+	name, val := strings.ToLower(parts[0]), strings.ToLower(unquote(parts[1]))
+	var err error
+	switch name {
+	case "tag":
+		term.Kind = queryTag
+		term.Text = val
+	case "format":
+		term.Kind = queryFormat
+		term.Text, err = parseQueryFormat(val)
+	case "is":
+		term.Kind = queryIs
+		term.Text = val
+		switch val {
+		case "starred", "public", "deleted":
+		default:
+			err = fmt.Errorf("unknown 'is:%s', expected is:starred, is:public or is:deleted", val)
+		}
+	case "created", "updated":
+		term.Kind = queryCreated
+		if name == "updated" {
+			term.Kind = queryUpdated
+		}
+		term.Op, term.Date, err = parseQueryDate(val)
+	default:
+		// not an operator e.g. http://
+		term.Text = foldString(unquote(s))
+		return term, parseQueryTextSuffix(term)
+	}
+	if err == nil && val == "" {
+		err = fmt.Errorf("missing value for '%s:'", name)
+	}
+	return term, err
+}
+
+// parseQuery parses search query. Returns *QueryError for malformed queries
+func parseQuery(s string) (*Query, error) {
+	toks, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, &QueryError{Query: s, Msg: err.Error()}
+	}
+	var q Query
+	afterOr := false
+	for _, tok := range toks {
+		if tok == "OR" {
+			if len(q.Clauses) == 0 || afterOr {
+				return nil, &QueryError{Query: s, Msg: "OR must be between two terms"}
+			}
+			afterOr = true
+			continue
+		}
+		term, err := parseQueryTerm(tok)
+		if err != nil {
+			return nil, &QueryError{Query: s, Msg: err.Error()}
+		}
+		if afterOr {
+			n := len(q.Clauses) - 1
+			q.Clauses[n] = append(q.Clauses[n], term)
+			afterOr = false
+		} else {
+			q.Clauses = append(q.Clauses, []*QueryTerm{term})
+		}
+	}
+	if afterOr {
+		return nil, &QueryError{Query: s, Msg: "OR must be between two terms"}
+	}
+	if len(q.Clauses) == 0 {
+		return nil, &QueryError{Query: s, Msg: "empty query"}
+	}
+	return &q, nil
+}
+
+// isText returns true for terms that match text of notes (as opposed to
+// filters like tag:)
+func (term *QueryTerm) isText() bool {
+	return term.Kind == queryText || term.Kind == queryRegex
+}
+
+// key uniquely identifies text term
+func (term *QueryTerm) key() string {
+	if term.Kind == queryRegex {
+		return "/" + term.Text + "/"
+	}
+	return fmt.Sprintf("%s*%v~%d", term.Text, term.Prefix, term.Fuzzy)
+}
+
+// SetFuzzy makes all text terms without explicit ~ fuzzy
+func (q *Query) SetFuzzy() {
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			if term.Kind == queryText && term.Fuzzy == 0 {
+				term.Fuzzy = autoFuzzyEdits(term.Text)
+			}
+		}
+	}
+}
+
+// SetPrefix makes the last text term a prefix term, for as-you-type search
+func (q *Query) SetPrefix() {
+	clause := q.Clauses[len(q.Clauses)-1]
+	term := clause[len(clause)-1]
+	if term.Kind == queryText && !term.Negated {
+		term.Prefix = true
+	}
+}
+
+// hasDeletedTerm returns true if the query explicitly asks about deleted notes
+func (q *Query) hasDeletedTerm() bool {
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			if term.Kind == queryIs && term.Text == "deleted" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchQueryDate(t time.Time, op string, day time.Time) bool {
+	t = t.UTC()
+	nextDay := day.Add(24 * time.Hour)
+	switch op {
+	case "<":
+		return t.Before(day)
+	case "<=":
+		return t.Before(nextDay)
+	case ">":
+		return !t.Before(nextDay)
+	case ">=":
+		return !t.Before(day)
+	}
+	return !t.Before(day) && t.Before(nextDay)
+}
+
+// matchFilter returns true if note matches a term which is not a text term
+func (term *QueryTerm) matchFilter(note *Note) bool {
+	switch term.Kind {
+	case queryTag:
+		for _, tag := range note.Tags {
+			if strings.ToLower(tag) == term.Text {
+				return true
+			}
+		}
+		return false
+	case queryFormat:
+		if term.Text == formatCodePrefix {
+			return strings.HasPrefix(note.Format, formatCodePrefix)
+		}
+		return note.Format == term.Text
+	case queryIs:
+		switch term.Text {
+		case "starred":
+			return note.IsStarred
+		case "public":
+			return note.IsPublic
+		case "deleted":
+			return note.IsDeleted
+		}
+	case queryCreated:
+		return matchQueryDate(note.CreatedAt, term.Op, term.Date)
+	case queryUpdated:
+		return matchQueryDate(note.UpdatedAt, term.Op, term.Date)
+	}
+	return false
+}
+
+// TextMatcher finds matches of text in a note
+type TextMatcher interface {
+	MatchText(note *Note, term *QueryTerm) *Match
+	// NoteLen returns number of terms in title and body of the note
+	NoteLen(note *Note) (int, int)
+	// DocFreq returns number of notes that match the term, for ranking
+	DocFreq(term *QueryTerm, notes []*Note) int
+}
+
+// countMatchingNotes returns number of notes that match the term
+func countMatchingNotes(m TextMatcher, term *QueryTerm, notes []*Note) int {
+	n := 0
+	for _, note := range notes {
+		if m.MatchText(note, term) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// ScanTextMatcher searches note content
+type ScanTextMatcher struct {
+	folded map[*Note]*foldedNote
+	// QueryTerm.key() => note => match or nil, so that ranking doesn't
+	// search notes again
+	matches map[string]map[*Note]*Match
+}
+
+type foldedNote struct {
+	title *FoldedText
+	body  *FoldedText
+	// number of terms in title and body
+	titleLen int
+	bodyLen  int
+}
+
+func newScanTextMatcher() *ScanTextMatcher {
+	return &ScanTextMatcher{
+		folded:  make(map[*Note]*foldedNote),
+		matches: make(map[string]map[*Note]*Match),
+	}
+}
+
+func (m *ScanTextMatcher) foldNote(note *Note) *foldedNote {
+	res := m.folded[note]
+	if res == nil {
+		res = &foldedNote{
+			title: foldText(note.Title),
+			body:  foldText(note.Content()),
+		}
+		res.titleLen = countTerms(res.title.s)
+		res.bodyLen = countTerms(res.body.s)
+		m.folded[note] = res
+	}
+	return res
+}
+
+// MatchText returns matches of text in note or nil
+func (m *ScanTextMatcher) MatchText(note *Note, term *QueryTerm) *Match {
+	if term.Kind == queryRegex {
+		return term.Regex.matchNote(note)
+	}
+	key := term.key()
+	noteMatches := m.matches[key]
+	if noteMatches == nil {
+		noteMatches = make(map[*Note]*Match)
+		m.matches[key] = noteMatches
+	}
+	if match, ok := noteMatches[note]; ok {
+		return match
+	}
+	fn := m.foldNote(note)
+	var match *Match
+	if term.isWordTerm() {
+		match = searchWordsInTitleAndBody(term, fn.title, fn.body, 16)
+	} else {
+		match = searchFoldedTitleAndBody(term.Text, fn.title, fn.body, 16)
+	}
+	noteMatches[note] = match
+	return match
+}
+
+// DocFreq returns number of notes that match the term. Notes already
+// searched for the term are not searched again
+func (m *ScanTextMatcher) DocFreq(term *QueryTerm, notes []*Note) int {
+	return countMatchingNotes(m, term, notes)
+}
+
+// NoteLen returns number of terms in title and body of the note
+func (m *ScanTextMatcher) NoteLen(note *Note) (int, int) {
+	fn := m.foldNote(note)
+	return fn.titleLen, fn.bodyLen
+}
+
+// matchQueryClause returns nil if note doesn't match the clause. Otherwise
+// returns matches of positive text terms (can be empty)
+func matchQueryClause(clause []*QueryTerm, note *Note, m TextMatcher) *Match {
+	var res *Match
+	for _, term := range clause {
+		if !term.isText() {
+			if term.matchFilter(note) != term.Negated && res == nil {
+				res = &Match{}
+			}
+			continue
+		}
+		match := m.MatchText(note, term)
+		if term.Negated {
+			if match == nil && res == nil {
+				res = &Match{}
+			}
+			continue
+		}
+		if match == nil {
+			continue
+		}
+		if res == nil {
+			res = &Match{}
+		}
+		appendMatch(res, match)
+		res.hits = append(res.hits, TermHits{
+			Term:  term.key(),
+			Title: len(match.titleMatchPos),
+			Body:  len(match.bodyMatchPos),
+		})
+	}
+	return res
+}
+
+// isFilterOnly returns true if clause has no text terms
+func isFilterOnly(clause []*QueryTerm) bool {
+	for _, term := range clause {
+		if term.isText() {
+			return false
+		}
+	}
+	return true
+}
+
+// matchQuery returns nil if note doesn't match the query
+func matchQuery(q *Query, note *Note, m TextMatcher) *Match {
+	if note.IsDeleted && !q.hasDeletedTerm() {
+		return nil
+	}
+	// filters are cheap so check them first
+	for _, clause := range q.Clauses {
+		if isFilterOnly(clause) && matchQueryClause(clause, note, m) == nil {
+			return nil
+		}
+	}
+	res := &Match{note: note}
+	for _, clause := range q.Clauses {
+		if isFilterOnly(clause) {
+			continue
+		}
+		match := matchQueryClause(clause, note, m)
+		if match == nil {
+			return nil
+		}
+		appendMatch(res, match)
+		res.hits = append(res.hits, match.hits...)
+	}
+	sortMatchPositions(res)
+	res.titleMatchPos = mergeOverlappingPosLen(res.titleMatchPos)
+	res.bodyMatchPos = mergeOverlappingPosLen(res.bodyMatchPos)
+	return res
+}
+
+// searchNotesWithQuery returns up to maxResults notes matching q, most
+// relevant first
+func searchNotesWithQuery(q *Query, notes []*Note, maxResults int, m TextMatcher, opts *SearchOptions) []*Match {
+	var matches []*Match
+	for _, n := range notes {
+		match := matchQuery(q, n, m)
+		if match != nil {
+			matches = append(matches, match)
+		}
+	}
+	rankMatches(q, notes, matches, m, opts)
+	if maxResults != -1 && len(matches) > maxResults {
+		matches = matches[:maxResults]
+	}
+	return matches
+}
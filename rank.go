@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+Ranking of search results with BM25F (https://en.wikipedia.org/wiki/Okapi_BM25).
+
+Title and body are separate fields. Term frequency in each field is normalized
+by field length (in terms) relative to average length in searched notes and
+title frequency is boosted. Document frequency is the number of searched notes
+that match the term.
+
+Optionally the score is boosted for recently updated and starred notes.
+*/
+
+const (
+	bm25K1     = 1.2
+	bm25B      = 0.75
+	titleBoost = 2.5
+
+	// recently updated notes get up to recencyBoostMax boost, which
+	// halves every recencyHalfLife
+	recencyBoostMax = 0.5
+	recencyHalfLife = 30 * 24 * time.Hour
+	starredBoost    = 1.25
+)
+
+// SearchOptions are per-query search options
+type SearchOptions struct {
+	// make all terms typo-tolerant
+	Fuzzy bool
+	// match last term as a prefix, for as-you-type search
+	Prefix bool
+	// also search previous versions of notes, see search_history.go
+	History bool
+	// search term is a regular expression, see regex.go
+	Regex bool
+
+	RecencyBoost bool
+	StarredBoost bool
+	// if zero, time.Now()
+	Now time.Time
+}
+
+// TermHits is a number of matches of text term in title and body
+type TermHits struct {
+	// QueryTerm.key()
+	Term  string
+	Title int
+	Body  int
+}
+
+func countTerms(s string) int {
+	n := 0
+	tokenize(s, func(string, int) {
+		n++
+	})
+	return n
+}
+
+// returns unique positive text terms
+func (q *Query) positiveTextTerms() []*QueryTerm {
+	var res []*QueryTerm
+	seen := map[string]bool{}
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			if term.isText() && !term.Negated && !seen[term.key()] {
+				seen[term.key()] = true
+				res = append(res, term)
+			}
+		}
+	}
+	return res
+}
+
+func bm25FieldTf(tf int, fieldLen int, avgLen float64) float64 {
+	if tf == 0 {
+		return 0
+	}
+	norm := 1 - bm25B
+	if avgLen > 0 {
+		norm += bm25B * float64(fieldLen) / avgLen
+	}
+	return float64(tf) / norm
+}
+
+func bm25Idf(nDocs, df int) float64 {
+	n, d := float64(nDocs), float64(df)
+	return math.Log(1 + (n-d+0.5)/(d+0.5))
+}
+
+func recencyBoost(now, updatedAt time.Time) float64 {
+	age := now.Sub(updatedAt)
+	if age < 0 {
+		age = 0
+	}
+	halfLives := float64(age) / float64(recencyHalfLife)
+	return 1 + recencyBoostMax*math.Pow(0.5, halfLives)
+}
+
+// rankMatches sets score of matches and sorts them by score, highest first.
+// notes are all notes that were searched
+func rankMatches(q *Query, notes []*Note, matches []*Match, m TextMatcher, opts *SearchOptions) {
+	if len(matches) == 0 {
+		return
+	}
+	for _, match := range matches {
+		match.score = 1
+	}
+
+	terms := q.positiveTextTerms()
+	if len(terms) > 0 {
+		searchDeleted := q.hasDeletedTerm()
+		var coll []*Note
+		var sumTitleLen, sumBodyLen int
+		for _, note := range notes {
+			if note.IsDeleted && !searchDeleted {
+				continue
+			}
+			coll = append(coll, note)
+			titleLen, bodyLen := m.NoteLen(note)
+			sumTitleLen += titleLen
+			sumBodyLen += bodyLen
+		}
+		nDocs := len(coll)
+		avgTitleLen := float64(sumTitleLen) / float64(nDocs)
+		avgBodyLen := float64(sumBodyLen) / float64(nDocs)
+
+		idf := make(map[string]float64, len(terms))
+		for _, term := range terms {
+			idf[term.key()] = bm25Idf(nDocs, m.DocFreq(term, coll))
+		}
+
+		for _, match := range matches {
+			titleLen, bodyLen := m.NoteLen(match.note)
+			score := 0.0
+			for _, h := range match.hits {
+				tf := titleBoost*bm25FieldTf(h.Title, titleLen, avgTitleLen) + bm25FieldTf(h.Body, bodyLen, avgBodyLen)
+				score += idf[h.Term] * tf * (bm25K1 + 1) / (tf + bm25K1)
+			}
+			match.score = score
+		}
+	}
+
+	if opts != nil {
+		now := opts.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		for _, match := range matches {
+			if opts.RecencyBoost {
+				match.score *= recencyBoost(now, match.note.UpdatedAt)
+			}
+			if opts.StarredBoost && match.note.IsStarred {
+				match.score *= starredBoost
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+/*
+Regular expression search, enabled with SearchOptions.Regex.
+
+In regex mode the whole search term is a single RE2 pattern (see
+https://golang.org/s/re2syntax), matched case-insensitively against the
+original (not folded) title and content of notes. Use (?-i) for
+case-sensitive matching. Regex terms don't use the search index.
+
+RE2 runs in linear time but to keep a single query from hogging the server
+we limit:
+- pattern length to maxRegexLen
+- number of matches per note to maxRegexMatchesPerNote
+- total time of matching to maxRegexSearchTime. Notes that are not searched
+  before the deadline don't match and the query is marked as timed out
+*/
+
+const (
+	maxRegexLen            = 256
+	maxRegexMatchesPerNote = 16
+	maxRegexSearchTime     = 250 * time.Millisecond
+)
+
+// QueryRegex is a compiled regex of a queryRegex term
+type QueryRegex struct {
+	re *regexp.Regexp
+	// set when first note is matched
+	deadline time.Time
+	// true if some notes were not searched because of maxRegexSearchTime
+	timedOut bool
+	// notes are matched twice, for finding matches and for ranking
+	matches map[*Note]*Match
+}
+
+func compileQueryRegex(s string) (*QueryRegex, error) {
+	if len(s) > maxRegexLen {
+		return nil, fmt.Errorf("regex is too long (%d characters, max is %d)", len(s), maxRegexLen)
+	}
+	re, err := regexp.Compile("(?i)" + s)
+	if err != nil {
+		return nil, err
+	}
+	if re.MatchString("") {
+		return nil, fmt.Errorf("regex '%s' matches empty text", s)
+	}
+	return &QueryRegex{
+		re:      re,
+		matches: make(map[*Note]*Match),
+	}, nil
+}
+
+// parseRegexQuery returns query with a single regex term
+func parseRegexQuery(s string) (*Query, error) {
+	r, err := compileQueryRegex(s)
+	if err != nil {
+		return nil, &QueryError{Query: s, Msg: err.Error()}
+	}
+	term := &QueryTerm{
+		Kind:  queryRegex,
+		Text:  s,
+		Regex: r,
+	}
+	return &Query{Clauses: [][]*QueryTerm{{term}}}, nil
+}
+
+// appends positions of non-empty matches of re in s, up to max
+func appendRegexMatches(a []PosLen, re *regexp.Regexp, s string, max int) []PosLen {
+	for _, loc := range re.FindAllStringIndex(s, max) {
+		if loc[1] > loc[0] {
+			a = append(a, PosLen{Pos: loc[0], Len: loc[1] - loc[0]})
+		}
+	}
+	return a
+}
+
+func (r *QueryRegex) matchTitleAndBody(title, body string) *Match {
+	var match Match
+	max := maxRegexMatchesPerNote
+	match.titleMatchPos = appendRegexMatches(nil, r.re, title, max)
+	if n := len(match.titleMatchPos); n < max {
+		match.bodyMatchPos = appendRegexMatches(nil, r.re, body, max-n)
+	}
+	if len(match.titleMatchPos) == 0 && len(match.bodyMatchPos) == 0 {
+		return nil
+	}
+	return &match
+}
+
+// matchNote returns matches of the regex in note or nil
+func (r *QueryRegex) matchNote(note *Note) *Match {
+	if match, ok := r.matches[note]; ok {
+		return match
+	}
+	now := time.Now()
+	if r.deadline.IsZero() {
+		r.deadline = now.Add(maxRegexSearchTime)
+	}
+	if now.After(r.deadline) {
+		r.timedOut = true
+		return nil
+	}
+	match := r.matchTitleAndBody(note.Title, note.Content())
+	r.matches[note] = match
+	return match
+}
+
+// TimedOut returns true if regex matching stopped before all notes were
+// searched
+func (q *Query) TimedOut() bool {
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			if term.Regex != nil && term.Regex.timedOut {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+)
+
+/*
+Server-side rendering of notes to html, used for public note pages so that
+crawlers, feed readers and visitors without JavaScript can see the content.
+
+- markdown is converted with blackfriday (with tables, task lists and fenced
+  code blocks) and then sanitized
+- code blocks and code:<lang> notes are highlighted with chroma. We emit css
+  classes, not inline styles, because sanitizer strips style attributes
+- html notes are sanitized with an allowlist policy
+- text notes are escaped and shown as pre-formatted text
+
+Rendered html only depends on format and content so we cache it by
+content sha1.
+*/
+
+const (
+	highlightStyleName = "github"
+	// rendered html is a derivative of content which is cached anyway
+	// so we don't need a big cache
+	maxRenderedNotesCached = 1024
+)
+
+var (
+	markdownExtensions = blackfriday.CommonExtensions | blackfriday.NoEmptyLineBeforeBlock
+
+	highlightFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.TabWidth(4))
+
+	sanitizePolicy *bluemonday.Policy
+
+	muRenderedNotes    sync.Mutex
+	renderedNotesCache = map[string]template.HTML{}
+
+	highlightCSS template.CSS
+)
+
+func init() {
+	sanitizePolicy = bluemonday.UGCPolicy()
+	// chroma and blackfriday mark elements with classes
+	sanitizePolicy.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)).OnElements("span", "pre", "code", "div")
+	// for task lists
+	sanitizePolicy.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	sanitizePolicy.AllowAttrs("checked", "disabled").OnElements("input")
+}
+
+// getHighlightCSS returns css for syntax-highlighted code
+func getHighlightCSS() template.CSS {
+	muRenderedNotes.Lock()
+	defer muRenderedNotes.Unlock()
+	if highlightCSS != "" {
+		return highlightCSS
+	}
+	var buf bytes.Buffer
+	err := highlightFormatter.WriteCSS(&buf, styles.Get(highlightStyleName))
+	if err != nil {
+		log.Errorf("highlightFormatter.WriteCSS() failed with '%s'\n", err)
+		return ""
+	}
+	highlightCSS = template.CSS(buf.String())
+	return highlightCSS
+}
+
+func getLexer(lang string) chroma.Lexer {
+	lexer := lexers.Get(strings.TrimSpace(lang))
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// writes html for code highlighted according to lang. If lang is
+// unknown, the code is shown as plain text
+func highlightCode(w io.Writer, code string, lang string) {
+	lexer := getLexer(lang)
+	it, err := lexer.Tokenise(nil, code)
+	if err == nil {
+		err = highlightFormatter.Format(w, styles.Get(highlightStyleName), it)
+	}
+	if err != nil {
+		log.Errorf("highlighting '%s' code failed with '%s'\n", lang, err)
+		io.WriteString(w, "<pre>"+html.EscapeString(code)+"</pre>")
+	}
+}
+
+// MarkdownRenderer is blackfriday's html renderer with support for
+// syntax-highlighted code blocks and task lists
+type MarkdownRenderer struct {
+	*blackfriday.HTMLRenderer
+}
+
+func isTaskListText(node *blackfriday.Node) bool {
+	if node.Prev != nil || node.Parent == nil || node.Parent.Type != blackfriday.Paragraph {
+		return false
+	}
+	if node.Parent.Prev != nil || node.Parent.Parent == nil || node.Parent.Parent.Type != blackfriday.Item {
+		return false
+	}
+	s := node.Literal
+	if len(s) < 4 || s[0] != '[' || s[2] != ']' || s[3] != ' ' {
+		return false
+	}
+	switch s[1] {
+	case ' ', 'x', 'X':
+		return true
+	}
+	return false
+}
+
+// RenderNode renders a single node
+func (r *MarkdownRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	switch node.Type {
+	case blackfriday.CodeBlock:
+		lang := string(node.Info)
+		if idx := strings.IndexByte(lang, ' '); idx != -1 {
+			lang = lang[:idx]
+		}
+		highlightCode(w, string(node.Literal), lang)
+		return blackfriday.GoToNext
+	case blackfriday.Text:
+		if isTaskListText(node) {
+			if node.Literal[1] == ' ' {
+				io.WriteString(w, `<input type="checkbox" disabled> `)
+			} else {
+				io.WriteString(w, `<input type="checkbox" checked disabled> `)
+			}
+			node.Literal = node.Literal[4:]
+		}
+	}
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+func markdownToHTML(d []byte) []byte {
+	r := &MarkdownRenderer{
+		HTMLRenderer: blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+			Flags: blackfriday.CommonHTMLFlags,
+		}),
+	}
+	res := blackfriday.Run(d, blackfriday.WithExtensions(markdownExtensions), blackfriday.WithRenderer(r))
+	return sanitizePolicy.SanitizeBytes(res)
+}
+
+func codeToHTML(d []byte, lang string) []byte {
+	var buf bytes.Buffer
+	highlightCode(&buf, string(d), lang)
+	return buf.Bytes()
+}
+
+func textToHTML(d []byte) []byte {
+	s := `<pre class="note-text">` + html.EscapeString(string(d)) + `</pre>`
+	return []byte(s)
+}
+
+// renderToHTML converts content of a given format to safe html
+func renderToHTML(d []byte, format string) template.HTML {
+	var res []byte
+	switch {
+	case format == formatMarkdown:
+		res = markdownToHTML(d)
+	case format == formatHTML:
+		res = sanitizePolicy.SanitizeBytes(d)
+	case strings.HasPrefix(format, formatCodePrefix):
+		res = codeToHTML(d, strings.TrimPrefix(format, formatCodePrefix))
+	default:
+		res = textToHTML(d)
+	}
+	return template.HTML(res)
+}
+
+// renderNoteHTML returns note content rendered as html. The result is
+// cached by content sha1
+func renderNoteHTML(note *Note) (template.HTML, error) {
+	key := note.Format + ":" + string(note.ContentSha1)
+	muRenderedNotes.Lock()
+	res, ok := renderedNotesCache[key]
+	muRenderedNotes.Unlock()
+	if ok {
+		return res, nil
+	}
+
+	d, err := getNoteContent(note)
+	if err != nil {
+		return "", err
+	}
+	res = renderToHTML(d, note.Format)
+
+	muRenderedNotes.Lock()
+	// TODO: smarter eviction
+	if len(renderedNotesCache) >= maxRenderedNotesCached {
+		renderedNotesCache = map[string]template.HTML{}
+	}
+	renderedNotesCache[key] = res
+	muRenderedNotes.Unlock()
+	return res, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testRenderContains(t *testing.T, s, format string, exp []string, notExp []string) {
+	got := string(renderToHTML([]byte(s), format))
+	for _, e := range exp {
+		if !strings.Contains(got, e) {
+			t.Errorf("'%s' rendered as '%s' doesn't contain '%s'", s, got, e)
+		}
+	}
+	for _, e := range notExp {
+		if strings.Contains(got, e) {
+			t.Errorf("'%s' rendered as '%s' shouldn't contain '%s'", s, got, e)
+		}
+	}
+}
+
+func TestRenderToHTML(t *testing.T) {
+	testRenderContains(t, "- [ ] todo\n- [x] done\n", formatMarkdown,
+		[]string{`<input type="checkbox" disabled=""> todo`, `<input type="checkbox" checked="" disabled=""> done`}, nil)
+	testRenderContains(t, "| a | b |\n|---|---|\n| 1 | 2 |\n", formatMarkdown,
+		[]string{"<table>", "<td>1</td>"}, nil)
+	testRenderContains(t, "```go\nfunc main() {}\n```\n", formatMarkdown,
+		[]string{`<pre class="chroma">`, `<span class="kd">func</span>`}, nil)
+	testRenderContains(t, "hi <script>alert(1)</script>", formatMarkdown,
+		[]string{"hi"}, []string{"<script>"})
+	testRenderContains(t, `<p onclick="x()">hi</p><script>x</script>`, formatHTML,
+		[]string{"<p>hi</p>"}, []string{"onclick", "<script>"})
+	testRenderContains(t, "func main() {}", formatCodePrefix+"go",
+		[]string{`<span class="nf">main</span>`}, nil)
+	testRenderContains(t, "a < b", formatText,
+		[]string{"a &lt; b"}, nil)
+}
@@ -14,5 +14,6 @@ go build -race -o quicknotes -ldflags "-X main.sha1ver=`git rev-parse HEAD`"
 #go build -race -o quicknotes -ldflags "-X main.sha1ver=`git rev-parse HEAD`"
 
 echo "starting quicknotes"
-./quicknotes -proddb || true
+# $QUICKNOTES_CONFIG should point to config with production database
+./quicknotes || true
 rm quicknotes
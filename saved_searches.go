@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Saved searches (smart lists) are search queries stored per user, e.g.
+"tag:meeting updated:last-7d". They are evaluated on the server against
+user's notes so that the client can show them as virtual folders with the
+number of matching notes. When notes change, evaluated saved searches are
+sent to all connections of the user as broadcastSavedSearches. Evaluating
+runs every saved search over all notes so after note changes we wait until
+notes stop changing for savedSearchesBroadcastDelay (e.g. editor auto-saves).
+*/
+
+const (
+	maxSavedSearchNameLen  = 255
+	maxSavedSearchQueryLen = 1024
+
+	savedSearchesBroadcastDelay = 2 * time.Second
+)
+
+var (
+	savedSearchesTimersMu sync.Mutex
+	// user id => pending broadcast of saved searches
+	savedSearchesTimers = map[int]*time.Timer{}
+)
+
+// SavedSearch is a search query saved by the user
+type SavedSearch struct {
+	id        int
+	userID    int
+	Name      string
+	Query     string
+	CreatedAt time.Time
+}
+
+// SavedSearchResult is a saved search evaluated against user's notes
+type SavedSearchResult struct {
+	HashID string
+	Name   string
+	Query  string
+	// number of matching notes
+	Count int
+	// matching notes, most relevant first
+	NoteHashIDs []string
+	// set if the query can no longer be evaluated
+	Err string
+}
+
+func dbGetSavedSearches(userID int) ([]*SavedSearch, error) {
+	db := getDbMust()
+	q := `
+SELECT id, name, query, created_at
+FROM saved_searches
+WHERE user_id = ?
+ORDER BY name`
+	rows, err := db.Query(q, userID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*SavedSearch
+	for rows.Next() {
+		s := &SavedSearch{userID: userID}
+		err = rows.Scan(&s.id, &s.Name, &s.Query, &s.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+func validateSavedSearchName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("missing saved search name")
+	}
+	if len(name) > maxSavedSearchNameLen {
+		return "", fmt.Errorf("saved search name is too long (%d characters, max is %d)", len(name), maxSavedSearchNameLen)
+	}
+	return name, nil
+}
+
+func checkUniqueSavedSearchName(userID int, id int, name string) error {
+	searches, err := dbGetSavedSearches(userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range searches {
+		if s.id != id && strings.EqualFold(s.Name, name) {
+			return fmt.Errorf("saved search '%s' already exists", s.Name)
+		}
+	}
+	return nil
+}
+
+func dbCreateSavedSearch(userID int, name, query string) (int, error) {
+	name, err := validateSavedSearchName(name)
+	if err != nil {
+		return 0, err
+	}
+	query = strings.TrimSpace(query)
+	if len(query) > maxSavedSearchQueryLen {
+		return 0, fmt.Errorf("query is too long (%d characters, max is %d)", len(query), maxSavedSearchQueryLen)
+	}
+	if _, err = parseQuery(query); err != nil {
+		return 0, err
+	}
+	if err = checkUniqueSavedSearchName(userID, 0, name); err != nil {
+		return 0, err
+	}
+	db := getDbMust()
+	q := `INSERT INTO saved_searches (user_id, name, query, created_at) VALUES (?, ?, ?, ?)`
+	res, err := db.Exec(q, userID, name, query, time.Now())
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// returns an error if saved search doesn't exist or doesn't belong to user
+func checkSavedSearchUpdated(res sql.Result, id int) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no saved search '%s'", hashInt(id))
+	}
+	return nil
+}
+
+func dbRenameSavedSearch(userID int, id int, name string) error {
+	name, err := validateSavedSearchName(name)
+	if err != nil {
+		return err
+	}
+	if err = checkUniqueSavedSearchName(userID, id, name); err != nil {
+		return err
+	}
+	db := getDbMust()
+	q := `UPDATE saved_searches SET name = ? WHERE id = ? AND user_id = ?`
+	res, err := db.Exec(q, name, id, userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	return checkSavedSearchUpdated(res, id)
+}
+
+func dbDeleteSavedSearch(userID int, id int) error {
+	db := getDbMust()
+	q := `DELETE FROM saved_searches WHERE id = ? AND user_id = ?`
+	res, err := db.Exec(q, id, userID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	return checkSavedSearchUpdated(res, id)
+}
+
+// evalSavedSearch returns notes matching saved search
+func evalSavedSearch(userID int, s *SavedSearch, notes []*Note) *SavedSearchResult {
+	res := &SavedSearchResult{
+		HashID: hashInt(s.id),
+		Name:   s.Name,
+		Query:  s.Query,
+	}
+	q, err := parseQuery(s.Query)
+	if err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	var matches []*Match
+	if searchIndex != nil {
+		matches, err = searchIndex.Search(userID, q, notes, -1, nil)
+		if err != nil {
+			log.Errorf("searchIndex.Search() failed with '%s'\n", err)
+		}
+	}
+	if searchIndex == nil || err != nil {
+		matches = searchNotesWithQuery(q, notes, -1, newScanTextMatcher(), nil)
+	}
+	res.Count = len(matches)
+	res.NoteHashIDs = make([]string, 0, len(matches))
+	for _, match := range matches {
+		res.NoteHashIDs = append(res.NoteHashIDs, match.note.HashID)
+	}
+	return res
+}
+
+// getSavedSearchesEvaluated returns all saved searches of a user evaluated
+// against user's notes
+func getSavedSearchesEvaluated(userID int) (interface{}, error) {
+	searches, err := dbGetSavedSearches(userID)
+	if err != nil {
+		return nil, err
+	}
+	i, err := getCachedUserInfo(userID)
+	if err != nil || i == nil {
+		return nil, fmt.Errorf("getCachedUserInfo('%d') failed with '%s'", userID, err)
+	}
+	res := []*SavedSearchResult{}
+	for _, s := range searches {
+		res = append(res, evalSavedSearch(userID, s, i.notes))
+	}
+	v := struct {
+		SavedSearches []*SavedSearchResult
+	}{
+		SavedSearches: res,
+	}
+	return v, nil
+}
+
+// broadcastSavedSearchesToUser sends evaluated saved searches to all
+// connections of the user
+func broadcastSavedSearchesToUser(userID int) {
+	res, err := getSavedSearchesEvaluated(userID)
+	rsp := wsResponse{
+		ID:     -1,
+		Cmd:    "broadcastSavedSearches",
+		Result: res,
+	}
+	if err != nil {
+		rsp.Err = err.Error()
+		rsp.Result = nil
+		log.Errorf("getSavedSearchesEvaluated() failed with '%s'\n", err)
+	}
+	wsBroadcastToUser(userID, &rsp)
+}
+
+// broadcastSavedSearchesDelayed broadcasts saved searches of the user when
+// notes didn't change for savedSearchesBroadcastDelay
+func broadcastSavedSearchesDelayed(userID int) {
+	savedSearchesTimersMu.Lock()
+	defer savedSearchesTimersMu.Unlock()
+	if t := savedSearchesTimers[userID]; t != nil {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(savedSearchesBroadcastDelay, func() {
+		savedSearchesTimersMu.Lock()
+		isLatest := savedSearchesTimers[userID] == t
+		if isLatest {
+			delete(savedSearchesTimers, userID)
+		}
+		savedSearchesTimersMu.Unlock()
+		if isLatest {
+			broadcastSavedSearchesToUser(userID)
+		}
+	})
+	savedSearchesTimers[userID] = t
+}
+
+func wsGetSavedSearches(ctx *ReqContext) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	return getSavedSearchesEvaluated(ctx.User.id)
+}
+
+func wsCreateSavedSearch(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	name, _ := jsonMapGetString(args, "name")
+	query, _ := jsonMapGetString(args, "query")
+	_, err := dbCreateSavedSearch(ctx.User.id, name, query)
+	if err != nil {
+		return nil, err
+	}
+	return getSavedSearchesEvaluated(ctx.User.id)
+}
+
+func getSavedSearchIDFromArgs(args map[string]interface{}) (int, error) {
+	hashID, err := jsonMapGetString(args, "hashID")
+	if err != nil {
+		return 0, err
+	}
+	return dehashInt(hashID)
+}
+
+func wsRenameSavedSearch(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	id, err := getSavedSearchIDFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := jsonMapGetString(args, "name")
+	err = dbRenameSavedSearch(ctx.User.id, id, name)
+	if err != nil {
+		return nil, err
+	}
+	return getSavedSearchesEvaluated(ctx.User.id)
+}
+
+func wsDeleteSavedSearch(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	id, err := getSavedSearchIDFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = dbDeleteSavedSearch(ctx.User.id, id)
+	if err != nil {
+		return nil, err
+	}
+	return getSavedSearchesEvaluated(ctx.User.id)
+}
@@ -28,6 +28,11 @@ type Match struct {
 	note          *Note
 	titleMatchPos []PosLen
 	bodyMatchPos  []PosLen
+	// for ranking, see rank.go
+	hits  []TermHits
+	score float64
+	// set if the match is in a previous version of the note
+	version *NoteVersion
 }
 
 func matchLess2(m1, m2 *Match) bool {
@@ -101,10 +106,18 @@ func decorate(s string, matchPositions []PosLen) string {
 	return res
 }
 
+// searchTitleAndBody finds occurrences of term, which must be folded (see
+// foldString), in title and body
 func searchTitleAndBody(term, title, body string, maxMatches int) *Match {
-	title = strings.ToLower(title)
-	body = strings.ToLower(body)
+	return searchFoldedTitleAndBody(term, foldText(title), foldText(body), maxMatches)
+}
+
+func searchFoldedTitleAndBody(term string, title, body *FoldedText, maxMatches int) *Match {
+	match := findInTitleAndBody(term, title.s, body.s, maxMatches)
+	return mapMatch(match, title, body)
+}
 
+func findInTitleAndBody(term, title, body string, maxMatches int) *Match {
 	var match Match
 	termLen := len(term)
 	s := title
@@ -166,6 +179,26 @@ func sortMatchPositions(m *Match) {
 	sortByPosLenByPos(m.bodyMatchPos)
 }
 
+// merges overlapping matches (e.g. from searching for "foo OR fo") because
+// highlighting code assumes they don't overlap. a must be sorted by Pos
+func mergeOverlappingPosLen(a []PosLen) []PosLen {
+	if len(a) < 2 {
+		return a
+	}
+	res := a[:1]
+	for _, pl := range a[1:] {
+		last := &res[len(res)-1]
+		if pl.Pos < last.Pos+last.Len {
+			if end := pl.Pos + pl.Len; end > last.Pos+last.Len {
+				last.Len = end - last.Pos
+			}
+			continue
+		}
+		res = append(res, pl)
+	}
+	return res
+}
+
 // search a note for list of terms. This is AND search i.e. all terms
 // must be found
 func searchNote(terms []string, note *Note, maxMatches int) *Match {
@@ -242,7 +275,7 @@ func collapseSameLines(lineMatches []*LineMatch) []*LineMatch {
 }
 
 func splitTerm(term string) []string {
-	term = strings.ToLower(term)
+	term = foldString(term)
 	term = strings.Map(wsToSpace, term)
 	terms := strings.Split(term, " ")
 	return strArrRemoveEmpty(terms)
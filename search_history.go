@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Searching in previous versions of notes, for finding text that was edited
+out of a note.
+
+We search versions of a note whose content is different than the current
+content. Content of versions with the same content_sha1 (also in different
+notes) is searched once, see historyTextMatcher. For each note we only report
+the most recent matching version and only if the current version of the note
+doesn't match.
+
+Versions are read from the database in pages of historySearchPageSize, newest
+first, and we stop when we have enough results.
+*/
+
+const historySearchPageSize = 1000
+
+// NoteVersion is a version of a note from versions table
+type NoteVersion struct {
+	id          int
+	noteID      int
+	CreatedAt   time.Time
+	ContentSha1 []byte
+	Size        int
+	Format      string
+	Title       string
+	Tags        []string
+}
+
+// SearchResultVersion describes a version of a note that matched the query
+type SearchResultVersion struct {
+	HashID    string
+	CreatedAt time.Time
+	// view content of that version
+	ViewURL string
+}
+
+func dbGetVersionsWithQuery(q string, args ...interface{}) ([]*NoteVersion, error) {
+	db := getDbMust()
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*NoteVersion
+	for rows.Next() {
+		var v NoteVersion
+		var tagsSerialized string
+		err = rows.Scan(
+			&v.id,
+			&v.noteID,
+			&v.CreatedAt,
+			&v.ContentSha1,
+			&v.Size,
+			&v.Format,
+			&v.Title,
+			&tagsSerialized)
+		if err != nil {
+			return nil, err
+		}
+		v.Tags = deserializeTags(tagsSerialized)
+		res = append(res, &v)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// dbGetVersionsForUserPage returns up to limit versions of notes of a user
+// with id smaller than beforeID (if not 0), newest first
+func dbGetVersionsForUserPage(userID, beforeID, limit int) ([]*NoteVersion, error) {
+	q := `
+SELECT
+  v.id,
+  v.note_id,
+  v.created_at,
+  v.content_sha1,
+  v.size,
+  v.format,
+  v.title,
+  v.tags
+FROM versions v
+INNER JOIN notes n ON v.note_id = n.id
+WHERE n.user_id = ? AND (? = 0 OR v.id < ?)
+ORDER BY v.id DESC
+LIMIT ?`
+	return dbGetVersionsWithQuery(q, userID, beforeID, beforeID, limit)
+}
+
+// dbGetVersionsForUser returns versions of all notes of a user, newest first
+func dbGetVersionsForUser(userID int) ([]*NoteVersion, error) {
+	q := `
+SELECT
+  v.id,
+  v.note_id,
+  v.created_at,
+  v.content_sha1,
+  v.size,
+  v.format,
+  v.title,
+  v.tags
+FROM versions v
+INNER JOIN notes n ON v.note_id = n.id
+WHERE n.user_id = ?
+ORDER BY v.id DESC`
+	return dbGetVersionsWithQuery(q, userID)
+}
+
+func dbGetNoteVersion(noteID, versionID int) (*NoteVersion, error) {
+	q := `
+SELECT
+  id,
+  note_id,
+  created_at,
+  content_sha1,
+  size,
+  format,
+  title,
+  tags
+FROM versions
+WHERE id = ? AND note_id = ?`
+	versions, err := dbGetVersionsWithQuery(q, versionID, noteID)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no version %d of note %d", versionID, noteID)
+	}
+	return versions[0], nil
+}
+
+// noteAtVersion returns note as it was at a given version
+func noteAtVersion(note *Note, v *NoteVersion) *Note {
+	res := &Note{}
+	res.DbNote = note.DbNote
+	res.HashID = note.HashID
+	res.Title = v.Title
+	res.Format = v.Format
+	res.Tags = v.Tags
+	res.ContentSha1 = v.ContentSha1
+	res.Size = v.Size
+	res.UpdatedAt = v.CreatedAt
+	res.CurrVersionID = v.id
+	return res
+}
+
+func noteVersionViewURL(note *Note, v *NoteVersion) string {
+	return "/raw/n/" + note.HashID + "?v=" + url.QueryEscape(hashInt(v.id))
+}
+
+// historyTextMatcher searches versions of notes. Content is folded and
+// searched once per content_sha1 and matches are attributed to versions
+// with that content. Titles are searched per version
+type historyTextMatcher struct {
+	empty *FoldedText
+	// version note => folded title
+	titles map[*Note]*foldedNote
+	// content_sha1 => folded content
+	bodies map[string]*foldedNote
+	// QueryTerm.key() => content_sha1 => matches in content
+	bodyMatches map[string]map[string]*Match
+}
+
+func newHistoryTextMatcher() *historyTextMatcher {
+	return &historyTextMatcher{
+		empty:       foldText(""),
+		titles:      make(map[*Note]*foldedNote),
+		bodies:      make(map[string]*foldedNote),
+		bodyMatches: make(map[string]map[string]*Match),
+	}
+}
+
+func (m *historyTextMatcher) foldTitle(note *Note) *foldedNote {
+	res := m.titles[note]
+	if res == nil {
+		res = &foldedNote{title: foldText(note.Title)}
+		res.titleLen = countTerms(res.title.s)
+		m.titles[note] = res
+	}
+	return res
+}
+
+func (m *historyTextMatcher) foldBody(note *Note) *foldedNote {
+	key := string(note.ContentSha1)
+	res := m.bodies[key]
+	if res == nil {
+		res = &foldedNote{body: foldText(note.Content())}
+		res.bodyLen = countTerms(res.body.s)
+		m.bodies[key] = res
+	}
+	return res
+}
+
+func matchFolded(term *QueryTerm, title, body *FoldedText) *Match {
+	if term.isWordTerm() {
+		return searchWordsInTitleAndBody(term, title, body, 16)
+	}
+	return searchFoldedTitleAndBody(term.Text, title, body, 16)
+}
+
+// MatchText returns matches of text in note or nil
+func (m *historyTextMatcher) MatchText(note *Note, term *QueryTerm) *Match {
+	if term.Kind == queryRegex {
+		return term.Regex.matchNote(note)
+	}
+	titleMatch := matchFolded(term, m.foldTitle(note).title, m.empty)
+	key := term.key()
+	sha1 := string(note.ContentSha1)
+	bodyMatches := m.bodyMatches[key]
+	if bodyMatches == nil {
+		bodyMatches = make(map[string]*Match)
+		m.bodyMatches[key] = bodyMatches
+	}
+	bodyMatch, ok := bodyMatches[sha1]
+	if !ok {
+		bodyMatch = matchFolded(term, m.empty, m.foldBody(note).body)
+		bodyMatches[sha1] = bodyMatch
+	}
+	if titleMatch == nil && bodyMatch == nil {
+		return nil
+	}
+	res := &Match{}
+	if titleMatch != nil {
+		res.titleMatchPos = titleMatch.titleMatchPos
+	}
+	if bodyMatch != nil {
+		res.bodyMatchPos = bodyMatch.bodyMatchPos
+	}
+	limitMatches(res, 16)
+	return res
+}
+
+// NoteLen returns number of terms in title and body of the note
+func (m *historyTextMatcher) NoteLen(note *Note) (int, int) {
+	return m.foldTitle(note).titleLen, m.foldBody(note).bodyLen
+}
+
+// DocFreq returns number of notes that match the term
+func (m *historyTextMatcher) DocFreq(term *QueryTerm, notes []*Note) int {
+	return countMatchingNotes(m, term, notes)
+}
+
+// searchNotesHistory searches previous versions of notes. Notes in skip are
+// not searched. Returns matches with version set
+func searchNotesHistory(q *Query, notes []*Note, versions []*NoteVersion, skip map[int]bool, m *historyTextMatcher, opts *SearchOptions) []*Match {
+	noteByID := make(map[int]*Note, len(notes))
+	for _, note := range notes {
+		noteByID[note.id] = note
+	}
+	var versionNotes []*Note
+	noteVersion := make(map[*Note]*NoteVersion)
+	seen := make(map[string]bool)
+	for _, v := range versions {
+		note := noteByID[v.noteID]
+		if note == nil || skip[note.id] || bytes.Equal(v.ContentSha1, note.ContentSha1) {
+			continue
+		}
+		key := fmt.Sprintf("%d:%x", note.id, v.ContentSha1)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		vn := noteAtVersion(note, v)
+		versionNotes = append(versionNotes, vn)
+		noteVersion[vn] = v
+	}
+
+	matches := searchNotesWithQuery(q, versionNotes, -1, m, opts)
+	// only keep the most recent matching version of each note
+	newest := make(map[int]*Match)
+	for _, match := range matches {
+		match.version = noteVersion[match.note]
+		prev := newest[match.note.id]
+		if prev == nil || match.version.CreatedAt.After(prev.version.CreatedAt) {
+			newest[match.note.id] = match
+		}
+	}
+	var res []*Match
+	for _, match := range matches {
+		if newest[match.note.id] == match {
+			res = append(res, match)
+		}
+	}
+	return res
+}
+
+// searchUserNotesHistory searches previous versions of user's notes that
+// didn't match the query
+func searchUserNotesHistory(userID int, q *Query, notes []*Note, matches []*Match, opts *SearchOptions) ([]*Match, error) {
+	skip := make(map[int]bool, len(matches))
+	for _, match := range matches {
+		skip[match.note.id] = true
+	}
+	m := newHistoryTextMatcher()
+	var res []*Match
+	beforeID := 0
+	for len(matches)+len(res) < maxSearchResults {
+		versions, err := dbGetVersionsForUserPage(userID, beforeID, historySearchPageSize)
+		if err != nil {
+			return nil, err
+		}
+		pageMatches := searchNotesHistory(q, notes, versions, skip, m, opts)
+		// older versions of notes that already matched are not reported
+		for _, match := range pageMatches {
+			skip[match.note.id] = true
+		}
+		res = append(res, pageMatches...)
+		if len(versions) < historySearchPageSize {
+			break
+		}
+		beforeID = versions[len(versions)-1].id
+	}
+	return res, nil
+}
+
+// getNoteVersionByHashIDs returns a version of user's note
+func getNoteVersionByHashIDs(ctx *ReqContext, noteHashID, versionHashID string) (*Note, *NoteVersion, error) {
+	noteID, err := getUserNoteByHashID(ctx, noteHashID)
+	if err != nil {
+		return nil, nil, err
+	}
+	versionID, err := dehashInt(versionHashID)
+	if err != nil {
+		return nil, nil, err
+	}
+	note, err := dbGetNoteByID(noteID)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := dbGetNoteVersion(noteID, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return note, v, nil
+}
+
+// restores note content, title, format and tags to a given version by
+// creating a new version
+func wsRestoreNoteVersion(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	noteHashID, _ := jsonMapGetString(args, "noteHashID")
+	versionHashID, _ := jsonMapGetString(args, "versionHashID")
+	note, v, err := getNoteVersionByHashIDs(ctx, noteHashID, versionHashID)
+	if err != nil {
+		return nil, err
+	}
+	newNote, err := newNoteFromNote(note)
+	if err != nil {
+		return nil, err
+	}
+	newNote.hashID = note.HashID
+	newNote.title = v.Title
+	newNote.format = v.Format
+	newNote.tags = v.Tags
+	newNote.content, err = getCachedContent(v.ContentSha1)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbCreateOrUpdateNote(ctx.User.id, newNote)
+	if err != nil {
+		return nil, err
+	}
+	return getNoteCompact(ctx, note.id)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Site-wide search of public notes of all users.
+
+Public notes are indexed in the same SearchIndex as notes of each user, under
+a reserved id publicNotesIndexID (ids of users start at 1). A note is in the
+public index if it's public and not deleted. The public index is updated
+together with the index of the user (see updateSearchIndexForNote) so it
+reflects notes becoming public or private via dbMakeNotePublic and
+dbMakeNotePrivate.
+
+List of public notes is cached in memory and invalidated when a public note
+changes or a note stops being public.
+*/
+
+const (
+	publicNotesIndexID   = 0
+	publicSearchPageSize = 20
+)
+
+var (
+	publicNotesMu         sync.Mutex
+	publicNotesCached     []*Note
+	publicNoteIDsCached   map[int]bool
+	publicNotesLastUpdate time.Time
+)
+
+func dbGetPublicNotes() ([]*Note, error) {
+	var notes []*Note
+	db := getDbMust()
+	q := `
+SELECT
+	id,
+	user_id,
+	curr_version_id,
+	is_deleted,
+	is_public,
+	is_starred,
+	created_at,
+	updated_at,
+	size,
+	format,
+	title,
+	content_sha1,
+	tags
+FROM notes
+WHERE is_public = true AND is_deleted = false
+  AND user_id NOT IN (` + sqlHiddenUserIDs + `)`
+	rows, err := db.Query(q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n Note
+		var tagsSerialized string
+		err = rows.Scan(
+			&n.id,
+			&n.userID,
+			&n.CurrVersionID,
+			&n.IsDeleted,
+			&n.IsPublic,
+			&n.IsStarred,
+			&n.CreatedAt,
+			&n.UpdatedAt,
+			&n.Size,
+			&n.Format,
+			&n.Title,
+			&n.ContentSha1,
+			&tagsSerialized)
+		if err != nil {
+			return nil, err
+		}
+		n.Tags = deserializeTags(tagsSerialized)
+		// content is loaded lazily, when searching
+		n.HashID = hashInt(n.id)
+		notes = append(notes, &n)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return notes, nil
+}
+
+func getPublicNotesCached() ([]*Note, error) {
+	publicNotesMu.Lock()
+	defer publicNotesMu.Unlock()
+	if publicNotesCached != nil && !timeExpired(publicNotesLastUpdate, time.Minute*5) {
+		return publicNotesCached, nil
+	}
+	notes, err := dbGetPublicNotes()
+	if err != nil {
+		return nil, err
+	}
+	publicNotesCached = notes
+	publicNoteIDsCached = make(map[int]bool, len(notes))
+	for _, note := range notes {
+		publicNoteIDsCached[note.id] = true
+	}
+	publicNotesLastUpdate = time.Now()
+	return notes, nil
+}
+
+// invalidates cached list of public notes if it's affected by a change
+// of a given note
+func invalidatePublicNotesCache(noteID int, isPublic bool) {
+	publicNotesMu.Lock()
+	if isPublic || publicNoteIDsCached[noteID] {
+		publicNotesCached = nil
+		publicNoteIDsCached = nil
+	}
+	publicNotesMu.Unlock()
+}
+
+// clearPublicNotesCaches forgets all cached public notes e.g. after
+// a user was disabled
+func clearPublicNotesCaches() {
+	publicNotesMu.Lock()
+	publicNotesCached = nil
+	publicNoteIDsCached = nil
+	publicNotesMu.Unlock()
+
+	mu.Lock()
+	recentPublicNotesCached = nil
+	mu.Unlock()
+}
+
+func updatePublicSearchIndexForNote(noteID int, note *NewNote) {
+	isPublic := note.isPublic && !note.isDeleted
+	invalidatePublicNotesCache(noteID, isPublic)
+	if searchIndex == nil {
+		return
+	}
+	var err error
+	if isPublic {
+		err = searchIndex.UpdateNote(publicNotesIndexID, noteID, note.title, note.content, note.contentSha1, false)
+	} else {
+		err = searchIndex.RemoveNote(publicNotesIndexID, noteID)
+	}
+	if err != nil {
+		log.Errorf("updating public search index for note %d failed with '%s'\n", noteID, err)
+	}
+}
+
+func removeNoteFromPublicSearchIndex(noteID int) {
+	invalidatePublicNotesCache(noteID, false)
+	if searchIndex == nil {
+		return
+	}
+	err := searchIndex.RemoveNote(publicNotesIndexID, noteID)
+	if err != nil {
+		log.Errorf("searchIndex.RemoveNote() failed with '%s'\n", err)
+	}
+}
+
+// pageOfMatches returns matches for a given page (starting at 1) and true if
+// there are more pages
+func pageOfMatches(matches []*Match, page int, pageSize int) ([]*Match, bool) {
+	start := (page - 1) * pageSize
+	if start >= len(matches) {
+		return nil, false
+	}
+	end := start + pageSize
+	if end >= len(matches) {
+		return matches[start:], false
+	}
+	return matches[start:end], true
+}
+
+// searchAllPublicNotes returns ranked matches of q in all public notes
+func searchAllPublicNotes(q *Query, opts *SearchOptions) ([]*Match, error) {
+	notes, err := getPublicNotesCached()
+	if err != nil {
+		return nil, err
+	}
+	if searchIndex != nil {
+		matches, err := searchIndex.Search(publicNotesIndexID, q, notes, -1, opts)
+		if err == nil {
+			return matches, nil
+		}
+		log.Errorf("searchIndex.Search() failed with '%s'\n", err)
+	}
+	return searchNotesWithQuery(q, notes, -1, newScanTextMatcher(), opts), nil
+}
@@ -1,6 +1,18 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjk/u"
+)
 
 func TestSearch1(t *testing.T) {
 	term := "quicknotes"
@@ -48,3 +60,513 @@ func TestSearch2(t *testing.T) {
 		}
 	}
 }
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp string
+	}{
+		{`foo  Bar`, `[foo] [bar]`},
+		{`"exact Phrase" x`, `[exact phrase] [x]`},
+		{`a b OR c OR d`, `[a] [b c d]`},
+		{`-foo -tag:work`, `[-foo] [-tag:work]`},
+		{`tag:"my tag" format:markdown format:code`, `[tag:my tag] [format:md] [format:code:]`},
+		{`is:starred is:public is:deleted`, `[is:starred] [is:public] [is:deleted]`},
+		{`created:>2017-01-01 updated:<=2017-02-01 created:2017-03-04`, `[created:>2017-01-01] [updated:<=2017-02-01] [created:=2017-03-04]`},
+		{`http:// - c++`, `[http://] [-] [c++]`},
+		{`kuberentes~ kube~1 kube* kuebr*~ c++~ a*`, `[kuberentes~2] [kube~1] [kube*] [kuebr*~1] [c++] [a*]`},
+		{`foo~bar ~foo foo~1~`, `[foo~bar] [~foo] [foo~1~1]`},
+	}
+	for _, test := range tests {
+		q, err := parseQuery(test.s)
+		if err != nil {
+			t.Fatalf("parseQuery('%s') failed with %s", test.s, err)
+		}
+		var clauses []string
+		for _, clause := range q.Clauses {
+			var terms []string
+			for _, term := range clause {
+				s := term.Text
+				switch term.Kind {
+				case queryTag:
+					s = "tag:" + s
+				case queryFormat:
+					s = "format:" + s
+				case queryIs:
+					s = "is:" + s
+				case queryCreated:
+					s = "created:" + term.Op + term.Date.Format(queryDateFormat)
+				case queryUpdated:
+					s = "updated:" + term.Op + term.Date.Format(queryDateFormat)
+				}
+				if term.Prefix {
+					s += "*"
+				}
+				if term.Fuzzy > 0 {
+					s += fmt.Sprintf("~%d", term.Fuzzy)
+				}
+				if term.Negated {
+					s = "-" + s
+				}
+				terms = append(terms, s)
+			}
+			clauses = append(clauses, "["+strings.Join(terms, " ")+"]")
+		}
+		got := strings.Join(clauses, " ")
+		if got != test.exp {
+			t.Fatalf("parseQuery('%s'): expected '%s', got '%s'", test.s, test.exp, got)
+		}
+	}
+
+	q, err := parseQuery("updated:last-7d")
+	if err != nil {
+		t.Fatalf("parseQuery() failed with %s", err)
+	}
+	term := q.Clauses[0][0]
+	exp := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -6)
+	if term.Op != ">=" || !term.Date.Equal(exp) {
+		t.Fatalf("expected >=%s, got %s%s", exp, term.Op, term.Date)
+	}
+
+	invalid := []string{``, `   `, `"foo`, `OR foo`, `foo OR`, `a OR OR b`, `is:foo`, `format:doc`, `created:>2017-13-01`, `tag:`, `""`, `foo~3`, `updated:last-0d`, `created:last-7y`, `created:last-d`}
+	for _, s := range invalid {
+		_, err := parseQuery(s)
+		if _, ok := err.(*QueryError); !ok {
+			t.Fatalf("parseQuery('%s'): expected QueryError, got %v", s, err)
+		}
+	}
+}
+
+// matches text in title only, so that we don't need note content
+type titleTextMatcher struct{}
+
+func (titleTextMatcher) MatchText(note *Note, term *QueryTerm) *Match {
+	if term.isWordTerm() {
+		return searchWordsInTitleAndBody(term, foldText(note.Title), foldText(""), 16)
+	}
+	return searchTitleAndBody(term.Text, note.Title, "", 16)
+}
+
+func (titleTextMatcher) NoteLen(note *Note) (int, int) {
+	return countTerms(strings.ToLower(note.Title)), 0
+}
+
+func (m titleTextMatcher) DocFreq(term *QueryTerm, notes []*Note) int {
+	return countMatchingNotes(m, term, notes)
+}
+
+func TestMatchQuery(t *testing.T) {
+	mkNote := func(title, format string, tags []string, created string) *Note {
+		n := &Note{}
+		n.Title = title
+		n.Format = format
+		n.Tags = tags
+		n.CreatedAt, _ = time.Parse(queryDateFormat, created)
+		n.UpdatedAt = n.CreatedAt
+		return n
+	}
+	n1 := mkNote("go notes", formatMarkdown, []string{"Work"}, "2017-01-01")
+	n2 := mkNote("rust notes", "code:rust", nil, "2017-02-01")
+	n3 := mkNote("deleted go", formatText, nil, "2017-03-01")
+	n3.IsDeleted = true
+	n2.IsStarred = true
+	notes := []*Note{n1, n2, n3}
+
+	tests := []struct {
+		s   string
+		exp []*Note
+	}{
+		{`notes`, []*Note{n1, n2}},
+		{`go`, []*Note{n1}},
+		{`go is:deleted`, []*Note{n3}},
+		{`go OR rust`, []*Note{n1, n2}},
+		{`notes -rust`, []*Note{n1}},
+		{`tag:work`, []*Note{n1}},
+		{`-tag:work`, []*Note{n2}},
+		{`format:code`, []*Note{n2}},
+		{`format:md OR is:starred`, []*Note{n1, n2}},
+		{`created:>2017-01-01`, []*Note{n2}},
+		{`created:<=2017-01-01`, []*Note{n1}},
+		{`created:2017-02-01`, []*Note{n2}},
+		{`"go notes"`, []*Note{n1}},
+		{`nots~1`, []*Note{n1, n2}},
+		{`nots`, nil},
+		{`rus*`, []*Note{n2}},
+		{`ust*`, nil},
+		{`rsut*~`, []*Note{n2}},
+	}
+	for _, test := range tests {
+		q, err := parseQuery(test.s)
+		if err != nil {
+			t.Fatalf("parseQuery('%s') failed with %s", test.s, err)
+		}
+		var got []*Note
+		for _, note := range notes {
+			if matchQuery(q, note, titleTextMatcher{}) != nil {
+				got = append(got, note)
+			}
+		}
+		if len(got) != len(test.exp) {
+			t.Fatalf("'%s': expected %d notes, got %d", test.s, len(test.exp), len(got))
+		}
+		for i := range got {
+			if got[i] != test.exp[i] {
+				t.Fatalf("'%s': expected note '%s', got '%s'", test.s, test.exp[i].Title, got[i].Title)
+			}
+		}
+	}
+
+	// overlapping matches are merged
+	q, _ := parseQuery(`note OR no`)
+	m := matchQuery(q, n1, titleTextMatcher{})
+	if len(m.titleMatchPos) != 1 || m.titleMatchPos[0] != (PosLen{3, 4}) {
+		t.Fatalf("expected [{3 4}], got %v", m.titleMatchPos)
+	}
+
+	// fuzzy match highlights the whole word
+	q, _ = parseQuery(`nodes~1`)
+	m = matchQuery(q, n1, titleTextMatcher{})
+	if len(m.titleMatchPos) != 1 || m.titleMatchPos[0] != (PosLen{3, 5}) {
+		t.Fatalf("expected [{3 5}], got %v", m.titleMatchPos)
+	}
+}
+
+func TestOsaDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  int
+	}{
+		{"kubernetes", "kubernetes", 0},
+		{"kuberentes", "kubernetes", 1},
+		{"kubrnetes", "kubernetes", 1},
+		{"ca", "abc", 3},
+		{"zażółć", "zazolc", 4},
+	}
+	for _, test := range tests {
+		if got := osaDistance(test.a, test.b); got != test.exp {
+			t.Fatalf("osaDistance('%s', '%s'): expected %d, got %d", test.a, test.b, test.exp, got)
+		}
+	}
+}
+
+func TestRankMatches(t *testing.T) {
+	mkNote := func(title string, updated string) *Note {
+		n := &Note{}
+		n.Title = title
+		n.UpdatedAt, _ = time.Parse(queryDateFormat, updated)
+		return n
+	}
+	n1 := mkNote("a very long title that mentions go somewhere", "2017-01-01")
+	n2 := mkNote("go", "2016-01-01")
+	n3 := mkNote("go go", "2017-06-01")
+	n4 := mkNote("unrelated", "2017-06-01")
+	notes := []*Note{n1, n2, n3, n4}
+
+	search := func(s string, opts *SearchOptions) []*Note {
+		q, err := parseQuery(s)
+		if err != nil {
+			t.Fatalf("parseQuery('%s') failed with %s", s, err)
+		}
+		var res []*Note
+		for _, m := range searchNotesWithQuery(q, notes, -1, titleTextMatcher{}, opts) {
+			res = append(res, m.note)
+		}
+		return res
+	}
+	expectOrder := func(s string, got []*Note, exp ...*Note) {
+		if len(got) != len(exp) {
+			t.Fatalf("'%s': expected %d notes, got %d", s, len(exp), len(got))
+		}
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Fatalf("'%s': expected '%s' at %d, got '%s'", s, exp[i].Title, i, got[i].Title)
+			}
+		}
+	}
+
+	// more matches and shorter titles rank higher
+	expectOrder("go", search("go", nil), n3, n2, n1)
+
+	now, _ := time.Parse(queryDateFormat, "2017-06-02")
+	opts := &SearchOptions{RecencyBoost: true, Now: now}
+	expectOrder("go", search("go", opts), n3, n2, n1)
+
+	// starred notes get a boost
+	q, _ := parseQuery("go")
+	scoreOf := func(opts *SearchOptions) float64 {
+		for _, m := range searchNotesWithQuery(q, notes, -1, titleTextMatcher{}, opts) {
+			if m.note == n1 {
+				return m.score
+			}
+		}
+		return 0
+	}
+	n1.IsStarred = true
+	s1, s2 := scoreOf(nil), scoreOf(&SearchOptions{StarredBoost: true})
+	if s1 <= 0 || math.Abs(s2-s1*starredBoost) > 1e-9 {
+		t.Fatalf("expected starred score %f to be %f * %f", s2, s1, starredBoost)
+	}
+}
+
+func TestFoldText(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp string
+	}{
+		{"Hello", "hello"},
+		{"Résumé", "resume"},
+		{"résumé", "resume"},
+		{"Straße STRASSE", "strasse strasse"},
+		{"İstanbul ılık", "istanbul ilik"},
+		{"ΌΣΟΣ", "οσοσ"},
+		{"ﬁle ＡＢＣ", "file abc"},
+		{"한국어", "한국어"},
+		{"ガ", "ガ"},
+	}
+	for _, test := range tests {
+		if got := foldString(test.s); got != test.exp {
+			t.Fatalf("foldString('%s'): expected '%s', got '%s'", test.s, test.exp, got)
+		}
+	}
+
+	// positions are mapped back to original text
+	posTests := []struct {
+		term  string
+		title string
+		exp   []PosLen
+	}{
+		{"resume", "My Résumé", []PosLen{{3, 8}}},
+		{"resume", "résumé", []PosLen{{0, 10}}},
+		{"s", "Straße", []PosLen{{0, 1}, {4, 2}}},
+		{"京都", "東京都", []PosLen{{3, 6}}},
+	}
+	for _, test := range posTests {
+		m := searchTitleAndBody(test.term, test.title, "", 16)
+		if m == nil || !reflect.DeepEqual(m.titleMatchPos, test.exp) {
+			t.Fatalf("'%s' in '%s': expected %v, got %v", test.term, test.title, test.exp, m)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	var got []string
+	tokenize(foldString("東京都 is 大, コーヒー"), func(term string, pos int) {
+		got = append(got, term)
+	})
+	exp := []string{"東京", "京都", "is", "大", "コー", "ーヒ", "ヒー"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
+
+func TestPageOfMatches(t *testing.T) {
+	matches := make([]*Match, 5)
+	tests := []struct {
+		page    int
+		expLen  int
+		hasMore bool
+	}{
+		{1, 2, true},
+		{2, 2, true},
+		{3, 1, false},
+		{4, 0, false},
+	}
+	for _, test := range tests {
+		got, hasMore := pageOfMatches(matches, test.page, 2)
+		if len(got) != test.expLen || hasMore != test.hasMore {
+			t.Fatalf("page %d: expected %d, %v got %d, %v", test.page, test.expLen, test.hasMore, len(got), hasMore)
+		}
+	}
+}
+
+func TestSearchNotesHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "searchhistory")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	prevLocalStore := localStore
+	localStore, err = NewLocalStore(filepath.Join(dir, "localstore"))
+	u.PanicIfErr(err)
+	defer func() {
+		localStore.Close()
+		localStore = prevLocalStore
+	}()
+
+	putContent := func(s string) []byte {
+		sha1, err := localStore.PutContent([]byte(s))
+		u.PanicIfErr(err)
+		return sha1
+	}
+	day := func(n int) time.Time {
+		return time.Date(2017, 1, n, 0, 0, 0, 0, time.UTC)
+	}
+	n1 := &Note{HashID: "n1"}
+	n1.id = 1
+	n1.Title = "groceries"
+	n1.ContentSha1 = putContent("milk, eggs")
+	n2 := &Note{HashID: "n2"}
+	n2.id = 2
+	n2.Title = "todo"
+	n2.ContentSha1 = putContent("call bob")
+	notes := []*Note{n1, n2}
+
+	v := func(id int, note *Note, created time.Time, content string) *NoteVersion {
+		return &NoteVersion{
+			id:          id,
+			noteID:      note.id,
+			CreatedAt:   created,
+			ContentSha1: putContent(content),
+			Title:       note.Title,
+			Format:      formatText,
+		}
+	}
+	// newest first, as returned by dbGetVersionsForUser
+	versions := []*NoteVersion{
+		v(6, n1, day(6), "milk, eggs"),
+		v(5, n2, day(5), "call bob"),
+		v(4, n1, day(4), "milk, eggs, bread"),
+		v(3, n1, day(3), "milk, bread"),
+		v(2, n1, day(2), "milk, bread"),
+		v(1, n2, day(1), "call alice"),
+	}
+
+	search := func(s string, skip map[int]bool) []*Match {
+		q, err := parseQuery(s)
+		u.PanicIfErr(err)
+		return searchNotesHistory(q, notes, versions, skip, newHistoryTextMatcher(), nil)
+	}
+	matches := search("bread", nil)
+	if len(matches) != 1 || matches[0].version.id != 4 || matches[0].note.HashID != "n1" {
+		t.Fatalf("expected a match in version 4 of n1, got %v", matches)
+	}
+	matches = search("alice OR bread", nil)
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	// current content is not searched
+	if matches = search("eggs", nil); len(matches) != 1 || matches[0].version.id != 4 {
+		t.Fatalf("expected a match in version 4, got %v", matches)
+	}
+	if matches = search("bread", map[int]bool{1: true}); len(matches) != 0 {
+		t.Fatalf("expected no matches, got %v", matches)
+	}
+
+	// the same content in different notes is searched once and matches
+	// in both notes
+	versions = append(versions, v(0, n2, day(1), "milk, bread"))
+	q, _ := parseQuery("bread")
+	m := newHistoryTextMatcher()
+	matches = searchNotesHistory(q, notes, versions, nil, m, nil)
+	searched := m.bodyMatches[q.Clauses[0][0].key()]
+	if len(matches) != 2 || len(searched) != 3 {
+		t.Fatalf("expected 2 matches and 3 searched contents, got %d and %d", len(matches), len(searched))
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "suggest")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	prevLocalStore := localStore
+	localStore, err = NewLocalStore(filepath.Join(dir, "localstore"))
+	u.PanicIfErr(err)
+	defer func() {
+		localStore.Close()
+		localStore = prevLocalStore
+	}()
+
+	newNote := func(hashID, title, content string, tags []string, updated int) *Note {
+		sha1, err := localStore.PutContent([]byte(content))
+		u.PanicIfErr(err)
+		n := &Note{HashID: hashID}
+		n.id = updated
+		n.Title = title
+		n.Tags = tags
+		n.ContentSha1 = sha1
+		n.UpdatedAt = time.Date(2017, 1, updated, 0, 0, 0, 0, time.UTC)
+		return n
+	}
+	deleted := newNote("n4", "Meeting with Bob", "", []string{"meetings"}, 4)
+	deleted.IsDeleted = true
+	notes := []*Note{
+		newNote("n1", "Meeting notes", "agenda for the meeting", []string{"work", "meetings"}, 1),
+		newNote("n2", "Notes on Résumé", "update résumé", []string{"work"}, 2),
+		newNote("n3", "Groceries", "milk, meat", []string{"Home"}, 3),
+		deleted,
+	}
+	idx := buildSuggestIndex(notes, nil)
+
+	s := idx.Suggest("note", 5)
+	if len(s.Titles) != 2 || s.Titles[0].NoteHashID != "n2" || s.Titles[1].NoteHashID != "n1" {
+		t.Fatalf("expected titles n2, n1, got %v", s.Titles)
+	}
+	if s = idx.Suggest("resu", 5); len(s.Titles) != 1 || s.Titles[0].Title != "Notes on Résumé" {
+		t.Fatalf("expected 'Notes on Résumé', got %v", s.Titles)
+	}
+	if len(s.Terms) != 1 || s.Terms[0].Term != "resume" || s.Terms[0].NumNotes != 1 {
+		t.Fatalf("expected term 'resume', got %v", s.Terms)
+	}
+	s = idx.Suggest("tag:WO", 5)
+	if len(s.Tags) != 1 || s.Tags[0].Tag != "work" || s.Tags[0].NumNotes != 2 {
+		t.Fatalf("expected tag 'work', got %v", s.Tags)
+	}
+	s = idx.Suggest("lunch me", 5)
+	if len(s.Titles) != 0 || len(s.Tags) != 0 {
+		t.Fatalf("expected no titles or tags, got %v %v", s.Titles, s.Tags)
+	}
+	if len(s.Terms) != 2 || s.Terms[0].Term != "meat" || s.Terms[1].Term != "meeting" {
+		t.Fatalf("expected terms 'meat', 'meeting', got %v", s.Terms)
+	}
+	if s = idx.Suggest("h", 5); len(s.Tags) != 1 || s.Tags[0].Tag != "Home" {
+		t.Fatalf("expected tag 'Home', got %v", s.Tags)
+	}
+	if s = idx.Suggest(" ", 5); len(s.Titles)+len(s.Tags)+len(s.Terms) != 0 {
+		t.Fatalf("expected no suggestions, got %v", s)
+	}
+
+	// terms from search index are the same as from note content
+	si, err := OpenSearchIndex(filepath.Join(dir, "searchindex"))
+	u.PanicIfErr(err)
+	defer si.Close()
+	noteTerms, err := si.NoteTerms(1, notes)
+	u.PanicIfErr(err)
+	if len(noteTerms) != len(notes) {
+		t.Fatalf("expected terms of %d notes, got %d", len(notes), len(noteTerms))
+	}
+	idx2 := buildSuggestIndex(notes, noteTerms)
+	for _, prefix := range []string{"me", "resu", "not", "mil"} {
+		exp, got := idx.Suggest(prefix, 5).Terms, idx2.Suggest(prefix, 5).Terms
+		if !reflect.DeepEqual(exp, got) {
+			t.Fatalf("'%s': expected terms %v, got %v", prefix, exp, got)
+		}
+	}
+}
+
+func TestRegexQuery(t *testing.T) {
+	for _, s := range []string{`a(`, `x*`, strings.Repeat("a", maxRegexLen+1)} {
+		if _, err := parseRegexQuery(s); err == nil {
+			t.Fatalf("parseRegexQuery('%s') should fail", s)
+		}
+	}
+
+	q, err := parseRegexQuery(`func \w+\(`)
+	u.PanicIfErr(err)
+	r := q.Clauses[0][0].Regex
+	m := r.matchTitleAndBody("helpers", "func foo(a int)\nFUNC Bar()")
+	exp := []PosLen{{0, 9}, {16, 9}}
+	if len(m.titleMatchPos) != 0 || len(m.bodyMatchPos) != 2 || m.bodyMatchPos[0] != exp[0] || m.bodyMatchPos[1] != exp[1] {
+		t.Fatalf("expected %v, got %v", exp, m.bodyMatchPos)
+	}
+	if m = r.matchTitleAndBody("func", "no functions here"); m != nil {
+		t.Fatalf("expected no match, got %v", m)
+	}
+	m = r.matchTitleAndBody("", strings.Repeat("func f(\n", 2*maxRegexMatchesPerNote))
+	if len(m.bodyMatchPos) != maxRegexMatchesPerNote {
+		t.Fatalf("expected %d matches, got %d", maxRegexMatchesPerNote, len(m.bodyMatchPos))
+	}
+
+	// notes are not searched after the deadline
+	r.deadline = time.Now().Add(-time.Second)
+	if m = r.matchNote(&Note{}); m != nil || !q.TimedOut() {
+		t.Fatalf("expected time out, got %v", m)
+	}
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+Per-user inverted index for full-text search, persisted in goleveldb database
+in {dataDir}/searchindex, next to local store.
+
+Text of title and content is folded (see fold.go) and split into terms, which
+are runs of letters and digits or bigrams of CJK characters. For each term we
+remember in which notes it appears and at which byte offsets (in folded text).
+If folding changed byte offsets, positions of matches are mapped back to
+positions in the original text when searching.
+
+Keys in the database:
+- doc:{userID}:{noteID} : json-encoded IndexedDoc
+- term:{userID}:{term}\x00{noteID} : positions of term in title and body,
+  encoded as varints
+
+The index of a user is loaded into memory on first search and is updated
+incrementally when notes are changed. When searching we also re-index notes
+whose content doesn't match the index (e.g. the first search after the index
+was created or notes changed by code that bypasses the index) so the index
+doesn't have to be perfectly maintained to give correct results. Searching
+only adds to the index: callers pass only notes they're allowed to see (e.g.
+public notes of a user) so notes missing from a search are not removed.
+
+Search terms are matched as substrings, same as searchNotes does. For terms
+that consist only of letters and digits we find matches from positions in the
+index. Other terms (e.g. "foo.bar" or CJK text) can span multiple index terms
+so we use the index to find candidate notes and search their content.
+*/
+
+// bump when the way we build the index changes, to force re-indexing
+const searchIndexVersion = 1
+
+var (
+	searchIndex *SearchIndex
+)
+
+// IndexedDoc describes a note in search index
+type IndexedDoc struct {
+	ContentSha1 []byte
+	Title       string
+	IsDeleted   bool
+	Terms       []string
+	// number of terms in title and body, for ranking
+	TitleLen int
+	BodyLen  int
+	// true if positions in folded text are different than in original text
+	Mapped  bool
+	Version int
+}
+
+// Postings are positions of a term in a note
+type Postings struct {
+	title []int
+	body  []int
+}
+
+// UserIndex is an in-memory index of user's notes
+type UserIndex struct {
+	mu     sync.Mutex
+	userID int
+	docs   map[int]*IndexedDoc
+	// term => note id => positions
+	terms map[string]map[int]*Postings
+}
+
+// SearchIndex manages search indexes of all users
+type SearchIndex struct {
+	mu    sync.Mutex
+	db    *leveldb.DB
+	users map[int]*UserIndex
+}
+
+func getSearchIndexDir() string {
+	return filepath.Join(getDataDir(), "searchindex")
+}
+
+// OpenSearchIndex opens (or creates) search index database in dir
+func OpenSearchIndex(dir string) (*SearchIndex, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SearchIndex{
+		db:    db,
+		users: make(map[int]*UserIndex),
+	}, nil
+}
+
+// Close closes the database
+func (si *SearchIndex) Close() {
+	si.db.Close()
+}
+
+func isTermRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c)
+}
+
+// isIndexTerm returns true if s only has characters that are part of
+// (non-CJK) terms
+func isIndexTerm(s string) bool {
+	for _, c := range s {
+		if !isTermRune(c) || isCJKRune(c) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// tokenize calls fn for every term in s and its byte offset. Runs of CJK
+// characters are split into overlapping bigrams
+func tokenize(s string, fn func(term string, pos int)) {
+	start := -1
+	// offset of the previous character in a run of CJK characters
+	cjkPrev := -1
+	cjkRunLen := 0
+	endWord := func(end int) {
+		if start != -1 {
+			fn(s[start:end], start)
+			start = -1
+		}
+	}
+	endCJKRun := func(end int) {
+		if cjkRunLen == 1 {
+			fn(s[cjkPrev:end], cjkPrev)
+		}
+		cjkPrev = -1
+		cjkRunLen = 0
+	}
+	for i, c := range s {
+		switch {
+		case isCJKRune(c):
+			endWord(i)
+			if cjkRunLen > 0 {
+				_, n := utf8.DecodeRuneInString(s[i:])
+				fn(s[cjkPrev:i+n], cjkPrev)
+			}
+			cjkPrev = i
+			cjkRunLen++
+		case isTermRune(c):
+			endCJKRun(i)
+			if start == -1 {
+				start = i
+			}
+		default:
+			endCJKRun(i)
+			endWord(i)
+		}
+	}
+	endCJKRun(len(s))
+	endWord(len(s))
+}
+
+// buildPostings returns postings of terms in folded title and body
+func buildPostings(title, body string) map[string]*Postings {
+	res := make(map[string]*Postings)
+	get := func(term string) *Postings {
+		p := res[term]
+		if p == nil {
+			p = &Postings{}
+			res[term] = p
+		}
+		return p
+	}
+	tokenize(title, func(term string, pos int) {
+		p := get(term)
+		p.title = append(p.title, pos)
+	})
+	tokenize(body, func(term string, pos int) {
+		p := get(term)
+		p.body = append(p.body, pos)
+	})
+	return res
+}
+
+func appendPositions(d []byte, a []int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(a)))
+	d = append(d, buf[:n]...)
+	prev := 0
+	for _, pos := range a {
+		n = binary.PutUvarint(buf[:], uint64(pos-prev))
+		d = append(d, buf[:n]...)
+		prev = pos
+	}
+	return d
+}
+
+func readPositions(d []byte) ([]int, []byte, error) {
+	count, n := binary.Uvarint(d)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid postings")
+	}
+	d = d[n:]
+	res := make([]int, 0, int(count))
+	prev := 0
+	for i := 0; i < int(count); i++ {
+		delta, n := binary.Uvarint(d)
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("invalid postings")
+		}
+		d = d[n:]
+		prev += int(delta)
+		res = append(res, prev)
+	}
+	return res, d, nil
+}
+
+func encodePostings(p *Postings) []byte {
+	d := appendPositions(nil, p.title)
+	return appendPositions(d, p.body)
+}
+
+func decodePostings(d []byte) (*Postings, error) {
+	var p Postings
+	var err error
+	p.title, d, err = readPositions(d)
+	if err != nil {
+		return nil, err
+	}
+	p.body, _, err = readPositions(d)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func searchIndexDocKeyPrefix(userID int) []byte {
+	return []byte(fmt.Sprintf("doc:%d:", userID))
+}
+
+func searchIndexDocKey(userID, noteID int) []byte {
+	return []byte(fmt.Sprintf("doc:%d:%d", userID, noteID))
+}
+
+func searchIndexTermKeyPrefix(userID int) []byte {
+	return []byte(fmt.Sprintf("term:%d:", userID))
+}
+
+func searchIndexTermKey(userID int, term string, noteID int) []byte {
+	return []byte(fmt.Sprintf("term:%d:%s\x00%d", userID, term, noteID))
+}
+
+func (si *SearchIndex) loadUserIndex(userID int) (*UserIndex, error) {
+	idx := &UserIndex{
+		userID: userID,
+		docs:   make(map[int]*IndexedDoc),
+		terms:  make(map[string]map[int]*Postings),
+	}
+
+	prefix := searchIndexDocKeyPrefix(userID)
+	it := si.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for it.Next() {
+		noteID, err := strconv.Atoi(string(it.Key()[len(prefix):]))
+		if err != nil {
+			it.Release()
+			return nil, err
+		}
+		var doc IndexedDoc
+		err = json.Unmarshal(it.Value(), &doc)
+		if err != nil {
+			it.Release()
+			return nil, err
+		}
+		if doc.Version != searchIndexVersion {
+			// force re-indexing
+			doc.ContentSha1 = nil
+		}
+		idx.docs[noteID] = &doc
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	prefix = searchIndexTermKeyPrefix(userID)
+	it = si.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		s := string(it.Key()[len(prefix):])
+		sepIdx := strings.IndexByte(s, 0)
+		if sepIdx == -1 {
+			return nil, fmt.Errorf("invalid search index key '%s'", string(it.Key()))
+		}
+		term := s[:sepIdx]
+		noteID, err := strconv.Atoi(s[sepIdx+1:])
+		if err != nil {
+			return nil, err
+		}
+		p, err := decodePostings(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		idx.addPostings(term, noteID, p)
+	}
+	return idx, it.Error()
+}
+
+// getUserIndex returns index for a given user, loading it from disk if needed
+func (si *SearchIndex) getUserIndex(userID int) (*UserIndex, error) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	idx := si.users[userID]
+	if idx != nil {
+		return idx, nil
+	}
+	idx, err := si.loadUserIndex(userID)
+	if err != nil {
+		return nil, err
+	}
+	log.Verbosef("loaded search index of user %d, %d notes, %d terms\n", userID, len(idx.docs), len(idx.terms))
+	si.users[userID] = idx
+	return idx, nil
+}
+
+func (idx *UserIndex) addPostings(term string, noteID int, p *Postings) {
+	m := idx.terms[term]
+	if m == nil {
+		m = make(map[int]*Postings)
+		idx.terms[term] = m
+	}
+	m[noteID] = p
+}
+
+// must be called with idx.mu locked
+func (idx *UserIndex) removeNote(batch *leveldb.Batch, noteID int) {
+	doc := idx.docs[noteID]
+	if doc == nil {
+		return
+	}
+	for _, term := range doc.Terms {
+		m := idx.terms[term]
+		delete(m, noteID)
+		if len(m) == 0 {
+			delete(idx.terms, term)
+		}
+		batch.Delete(searchIndexTermKey(idx.userID, term, noteID))
+	}
+	delete(idx.docs, noteID)
+	batch.Delete(searchIndexDocKey(idx.userID, noteID))
+}
+
+// must be called with idx.mu locked
+func (idx *UserIndex) updateNote(batch *leveldb.Batch, noteID int, title string, body []byte, contentSha1 []byte, isDeleted bool) {
+	if doc := idx.docs[noteID]; doc != nil && doc.Title == title && bytes.Equal(doc.ContentSha1, contentSha1) {
+		if doc.IsDeleted != isDeleted {
+			doc.IsDeleted = isDeleted
+			d, _ := json.Marshal(doc)
+			batch.Put(searchIndexDocKey(idx.userID, noteID), d)
+		}
+		return
+	}
+
+	idx.removeNote(batch, noteID)
+	foldedTitle, foldedBody := foldText(title), foldText(string(body))
+	postings := buildPostings(foldedTitle.s, foldedBody.s)
+	doc := &IndexedDoc{
+		ContentSha1: contentSha1,
+		Title:       title,
+		IsDeleted:   isDeleted,
+		Mapped:      foldedTitle.isMapped() || foldedBody.isMapped(),
+		Version:     searchIndexVersion,
+	}
+	for term, p := range postings {
+		doc.Terms = append(doc.Terms, term)
+		doc.TitleLen += len(p.title)
+		doc.BodyLen += len(p.body)
+		idx.addPostings(term, noteID, p)
+		batch.Put(searchIndexTermKey(idx.userID, term, noteID), encodePostings(p))
+	}
+	idx.docs[noteID] = doc
+	d, _ := json.Marshal(doc)
+	batch.Put(searchIndexDocKey(idx.userID, noteID), d)
+}
+
+// UpdateNote adds or re-indexes a note
+func (si *SearchIndex) UpdateNote(userID, noteID int, title string, body []byte, contentSha1 []byte, isDeleted bool) error {
+	idx, err := si.getUserIndex(userID)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	batch := new(leveldb.Batch)
+	idx.updateNote(batch, noteID, title, body, contentSha1, isDeleted)
+	return si.db.Write(batch, nil)
+}
+
+// RemoveNote removes a note from the index
+func (si *SearchIndex) RemoveNote(userID, noteID int) error {
+	idx, err := si.getUserIndex(userID)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	batch := new(leveldb.Batch)
+	idx.removeNote(batch, noteID)
+	return si.db.Write(batch, nil)
+}
+
+// sync makes sure that the index reflects notes. If removeMissing is set,
+// notes in the index that are not in notes are removed. Must be called with
+// idx.mu locked
+func (idx *UserIndex) sync(si *SearchIndex, notes []*Note, removeMissing bool) error {
+	batch := new(leveldb.Batch)
+	seen := make(map[int]bool, len(notes))
+	for _, note := range notes {
+		seen[note.id] = true
+		doc := idx.docs[note.id]
+		if doc != nil && doc.IsDeleted == note.IsDeleted && doc.Title == note.Title && bytes.Equal(doc.ContentSha1, note.ContentSha1) {
+			continue
+		}
+		body, err := getNoteContent(note)
+		if err != nil {
+			return err
+		}
+		idx.updateNote(batch, note.id, note.Title, body, note.ContentSha1, note.IsDeleted)
+	}
+	for noteID := range idx.docs {
+		if removeMissing && !seen[noteID] {
+			idx.removeNote(batch, noteID)
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	log.Verbosef("updating search index of user %d with %d changes\n", idx.userID, batch.Len())
+	return si.db.Write(batch, nil)
+}
+
+// DeleteUser deletes index of a user, e.g. after the account was deleted
+func (si *SearchIndex) DeleteUser(userID int) error {
+	idx, err := si.getUserIndex(userID)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	err = idx.sync(si, nil, true)
+	idx.mu.Unlock()
+	si.mu.Lock()
+	delete(si.users, userID)
+	si.mu.Unlock()
+	return err
+}
+
+// Reindex re-indexes all notes, e.g. after changing how notes are indexed
+func (si *SearchIndex) Reindex(userID int, notes []*Note) error {
+	idx, err := si.getUserIndex(userID)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, doc := range idx.docs {
+		// forces sync to re-index the note
+		doc.ContentSha1 = nil
+	}
+	return idx.sync(si, notes, true)
+}
+
+// NoteTerms returns terms of notes (note id => terms), indexing notes that
+// are not yet indexed
+func (si *SearchIndex) NoteTerms(userID int, notes []*Note) (map[int][]string, error) {
+	idx, err := si.getUserIndex(userID)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	err = idx.sync(si, notes, false)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int][]string, len(notes))
+	for _, note := range notes {
+		if doc := idx.docs[note.id]; doc != nil {
+			res[note.id] = doc.Terms
+		}
+	}
+	return res, nil
+}
+
+// returns ids of notes that have a term that contains s
+func (idx *UserIndex) notesWithSubstring(s string) map[int]bool {
+	res := make(map[int]bool)
+	for term, m := range idx.terms {
+		if !strings.Contains(term, s) {
+			continue
+		}
+		for noteID := range m {
+			res[noteID] = true
+		}
+	}
+	return res
+}
+
+// returns ids of notes that might contain s, or nil if s has no terms
+func (idx *UserIndex) candidateNotes(s string) map[int]bool {
+	var res map[int]bool
+	tokenize(s, func(term string, pos int) {
+		notes := idx.notesWithSubstring(term)
+		if res == nil {
+			res = notes
+			return
+		}
+		for noteID := range res {
+			if !notes[noteID] {
+				delete(res, noteID)
+			}
+		}
+	})
+	return res
+}
+
+// appends positions of non-overlapping occurrences of s in term which
+// starts at termPos
+func appendTermMatches(a []PosLen, term string, termPos int, s string) []PosLen {
+	off := 0
+	for {
+		idx := strings.Index(term[off:], s)
+		if idx == -1 {
+			return a
+		}
+		pl := PosLen{
+			Pos: termPos + off + idx,
+			Len: len(s),
+		}
+		a = append(a, pl)
+		off += idx + len(s)
+	}
+}
+
+// matchTerm returns matches of s, which must be an index term, in all notes.
+// The result is the same as searchTitleAndBody(s, ..., maxMatches)
+func (idx *UserIndex) matchTerm(s string, maxMatches int) map[int]*Match {
+	res := make(map[int]*Match)
+	for term, m := range idx.terms {
+		if !strings.Contains(term, s) {
+			continue
+		}
+		for noteID, p := range m {
+			match := res[noteID]
+			if match == nil {
+				match = &Match{}
+				res[noteID] = match
+			}
+			for _, pos := range p.title {
+				match.titleMatchPos = appendTermMatches(match.titleMatchPos, term, pos, s)
+			}
+			for _, pos := range p.body {
+				match.bodyMatchPos = appendTermMatches(match.bodyMatchPos, term, pos, s)
+			}
+		}
+	}
+	for _, match := range res {
+		sortMatchPositions(match)
+		limitMatches(match, maxMatches)
+	}
+	return res
+}
+
+// matchWordTerm returns matches of a fuzzy or prefix term in all notes.
+// The result is the same as searchWordsInTitleAndBody(term, ..., maxMatches)
+func (idx *UserIndex) matchWordTerm(term *QueryTerm, maxMatches int) map[int]*Match {
+	res := make(map[int]*Match)
+	for word, m := range idx.terms {
+		spans := term.matchWord(word)
+		if len(spans) == 0 {
+			continue
+		}
+		for noteID, p := range m {
+			match := res[noteID]
+			if match == nil {
+				match = &Match{}
+				res[noteID] = match
+			}
+			for _, pos := range p.title {
+				for _, pl := range spans {
+					match.titleMatchPos = append(match.titleMatchPos, PosLen{pos + pl.Pos, pl.Len})
+				}
+			}
+			for _, pos := range p.body {
+				for _, pl := range spans {
+					match.bodyMatchPos = append(match.bodyMatchPos, PosLen{pos + pl.Pos, pl.Len})
+				}
+			}
+		}
+	}
+	for _, match := range res {
+		sortMatchPositions(match)
+		limitMatches(match, maxMatches)
+	}
+	return res
+}
+
+// IndexTextMatcher finds matches of text using the index
+type IndexTextMatcher struct {
+	idx *UserIndex
+	// for index terms: note id => matches
+	matches map[string]map[int]*Match
+	// for other texts: ids of notes that might contain the text, nil if
+	// all notes might
+	candidates map[string]map[int]bool
+	// note id => folded title and body
+	folded map[int][2]*FoldedText
+}
+
+func (m *IndexTextMatcher) foldNote(note *Note) [2]*FoldedText {
+	res, ok := m.folded[note.id]
+	if !ok {
+		res = [2]*FoldedText{foldText(note.Title), foldText(note.Content())}
+		m.folded[note.id] = res
+	}
+	return res
+}
+
+// maps positions of matches from index to positions in original text
+func (m *IndexTextMatcher) mapMatch(note *Note, match *Match) *Match {
+	doc := m.idx.docs[note.id]
+	if match == nil || doc == nil || !doc.Mapped {
+		return match
+	}
+	folded := m.foldNote(note)
+	return mapMatch(match, folded[0], folded[1])
+}
+
+// MatchText returns matches of text term in note or nil
+func (m *IndexTextMatcher) MatchText(note *Note, term *QueryTerm) *Match {
+	if term.Kind == queryRegex {
+		return term.Regex.matchNote(note)
+	}
+	if noteMatches := m.termMatches(term); noteMatches != nil {
+		return m.mapMatch(note, noteMatches[note.id])
+	}
+	text := term.Text
+	cand := m.candidateNotes(text)
+	if cand != nil && !cand[note.id] {
+		return nil
+	}
+	folded := m.foldNote(note)
+	return searchFoldedTitleAndBody(text, folded[0], folded[1], 16)
+}
+
+// termMatches returns matches of a term found from the index (note id =>
+// match) or nil if the term can't be matched with the index alone
+func (m *IndexTextMatcher) termMatches(term *QueryTerm) map[int]*Match {
+	if term.isWordTerm() {
+		key := term.key()
+		noteMatches, ok := m.matches[key]
+		if !ok {
+			noteMatches = m.idx.matchWordTerm(term, 16)
+			m.matches[key] = noteMatches
+		}
+		return noteMatches
+	}
+	text := term.Text
+	if !isIndexTerm(text) {
+		return nil
+	}
+	noteMatches, ok := m.matches[text]
+	if !ok {
+		noteMatches = m.idx.matchTerm(text, 16)
+		m.matches[text] = noteMatches
+	}
+	return noteMatches
+}
+
+func (m *IndexTextMatcher) candidateNotes(text string) map[int]bool {
+	cand, ok := m.candidates[text]
+	if !ok {
+		cand = m.idx.candidateNotes(text)
+		m.candidates[text] = cand
+	}
+	return cand
+}
+
+// DocFreq returns number of notes that match the term. For terms matched
+// with the index it's the number of notes in posting lists so we don't
+// have to fold note content
+func (m *IndexTextMatcher) DocFreq(term *QueryTerm, notes []*Note) int {
+	if term.Kind == queryRegex {
+		return countMatchingNotes(m, term, notes)
+	}
+	n := 0
+	if noteMatches := m.termMatches(term); noteMatches != nil {
+		for _, note := range notes {
+			if noteMatches[note.id] != nil {
+				n++
+			}
+		}
+		return n
+	}
+	cand := m.candidateNotes(term.Text)
+	for _, note := range notes {
+		if cand != nil && !cand[note.id] {
+			continue
+		}
+		if m.MatchText(note, term) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// NoteLen returns number of terms in title and body of the note
+func (m *IndexTextMatcher) NoteLen(note *Note) (int, int) {
+	doc := m.idx.docs[note.id]
+	if doc == nil {
+		return 0, 0
+	}
+	return doc.TitleLen, doc.BodyLen
+}
+
+// Search searches notes of a user. notes are notes the caller is allowed
+// to see. The result is the same as searching content of notes. Notes that
+// are not in notes stay in the index
+func (si *SearchIndex) Search(userID int, q *Query, notes []*Note, maxResults int, opts *SearchOptions) ([]*Match, error) {
+	idx, err := si.getUserIndex(userID)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	err = idx.sync(si, notes, false)
+	if err != nil {
+		return nil, err
+	}
+	m := &IndexTextMatcher{
+		idx:        idx,
+		matches:    make(map[string]map[int]*Match),
+		candidates: make(map[string]map[int]bool),
+		folded:     make(map[int][2]*FoldedText),
+	}
+	return searchNotesWithQuery(q, notes, maxResults, m, opts), nil
+}
+
+func updateSearchIndexForNote(userID, noteID int, note *NewNote) {
+	updatePublicSearchIndexForNote(noteID, note)
+	if searchIndex == nil {
+		return
+	}
+	err := searchIndex.UpdateNote(userID, noteID, note.title, note.content, note.contentSha1, note.isDeleted)
+	if err != nil {
+		log.Errorf("searchIndex.UpdateNote() failed with '%s'\n", err)
+	}
+}
+
+func removeNoteFromSearchIndex(userID, noteID int) {
+	removeNoteFromPublicSearchIndex(noteID)
+	if searchIndex == nil {
+		return
+	}
+	err := searchIndex.RemoveNote(userID, noteID)
+	if err != nil {
+		log.Errorf("searchIndex.RemoveNote() failed with '%s'\n", err)
+	}
+}
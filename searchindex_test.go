@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kjk/u"
+)
+
+func notesFromSimpleNotes() []*Note {
+	var res []*Note
+	for i, sn := range loadSimpleNotes() {
+		title, body := noteToTitleContent([]byte(sn.Content))
+		sha1, err := localStore.PutContent(body)
+		u.PanicIfErr(err)
+		note := &Note{HashID: sn.ID}
+		note.id = i + 1
+		note.Title = title
+		note.ContentSha1 = sha1
+		res = append(res, note)
+	}
+	unicodeNotes := [][2]string{
+		{"Mój życiorys", "Résumé, CAFÉ and Straße in İstanbul. ﬁle"},
+		{"東京都の天気", "今日は東京で雨。明日は京都へ行きます。"},
+		{"한국어 노트", "re\u0301sume\u0301 with combining marks"},
+	}
+	for i, un := range unicodeNotes {
+		sha1, err := localStore.PutContent([]byte(un[1]))
+		u.PanicIfErr(err)
+		note := &Note{HashID: fmt.Sprintf("unicode%d", i)}
+		note.id = len(res) + 1
+		note.Title = un[0]
+		note.ContentSha1 = sha1
+		res = append(res, note)
+	}
+	return res
+}
+
+func testSameMatches(t *testing.T, si *SearchIndex, notes []*Note, term string) {
+	q, err := parseQuery(term)
+	if err != nil {
+		t.Fatalf("parseQuery('%s') failed with %s", term, err)
+	}
+	exp := searchNotesWithQuery(q, notes, defaultMaxResults, newScanTextMatcher(), nil)
+	got, err := si.Search(1, q, notes, defaultMaxResults, nil)
+	if err != nil {
+		t.Fatalf("si.Search('%s') failed with %s", term, err)
+	}
+	if len(exp) != len(got) {
+		t.Fatalf("'%s': expected %d matches, got %d", term, len(exp), len(got))
+	}
+	for i := range exp {
+		m1, m2 := exp[i], got[i]
+		if m1.note != m2.note || m1.score != m2.score {
+			t.Fatalf("'%s': match %d, expected note %s (%f), got %s (%f)", term, i, m1.note.HashID, m1.score, m2.note.HashID, m2.score)
+		}
+		if !reflect.DeepEqual(m1.titleMatchPos, m2.titleMatchPos) || !reflect.DeepEqual(m1.bodyMatchPos, m2.bodyMatchPos) {
+			t.Fatalf("'%s': note %s, expected %v %v, got %v %v", term, m1.note.HashID, m1.titleMatchPos, m1.bodyMatchPos, m2.titleMatchPos, m2.bodyMatchPos)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "searchindex")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+
+	prevLocalStore := localStore
+	localStore, err = NewLocalStore(filepath.Join(dir, "localstore"))
+	u.PanicIfErr(err)
+	defer func() {
+		localStore.Close()
+		localStore = prevLocalStore
+	}()
+
+	notes := notesFromSimpleNotes()
+	indexDir := filepath.Join(dir, "searchindex")
+	si, err := OpenSearchIndex(indexDir)
+	u.PanicIfErr(err)
+
+	terms := []string{"quicknotes", "home  dbhero   ", "note", "a", "go", "http://", "c++", "foo.bar", "-", "the and", `"go to"`, "home OR work -the", "note OR no", "quiknotes~", "quick*", "notse~1", "hom*~1", "-nte~1 go*", "resume", "strasse", "s", "zyciorys", "istanbul", "file", "cafe~", "京都", "東", "は東京", "노트"}
+	for _, term := range terms {
+		testSameMatches(t, si, notes, term)
+	}
+
+	// index must be the same after re-loading from disk
+	si.Close()
+	si, err = OpenSearchIndex(indexDir)
+	u.PanicIfErr(err)
+	defer si.Close()
+	idx, err := si.getUserIndex(1)
+	u.PanicIfErr(err)
+	if len(idx.docs) != len(notes) {
+		t.Fatalf("expected %d notes in index, got %d", len(notes), len(idx.docs))
+	}
+	for _, term := range terms {
+		testSameMatches(t, si, notes, term)
+	}
+
+	// searching only some notes (e.g. public notes searched by a visitor)
+	// must not remove other notes from the index
+	q, _ := parseQuery("note")
+	_, err = si.Search(1, q, notes[:2], defaultMaxResults, nil)
+	u.PanicIfErr(err)
+	si.Close()
+	si, err = OpenSearchIndex(indexDir)
+	u.PanicIfErr(err)
+	defer si.Close()
+	idx, err = si.getUserIndex(1)
+	u.PanicIfErr(err)
+	if len(idx.docs) != len(notes) {
+		t.Fatalf("expected %d notes in index after partial search, got %d", len(notes), len(idx.docs))
+	}
+
+	// incremental updates
+	note := notes[0]
+	err = si.UpdateNote(1, note.id, "brand new title", []byte("zyxwvut"), []byte("sha1"), false)
+	u.PanicIfErr(err)
+	if m := idx.matchTerm("zyxwvut", 16); len(m) != 1 || m[note.id] == nil {
+		t.Fatalf("expected a match in note %d, got %v", note.id, m)
+	}
+	err = si.RemoveNote(1, note.id)
+	u.PanicIfErr(err)
+	if m := idx.matchTerm("zyxwvut", 16); len(m) != 0 {
+		t.Fatalf("expected no matches, got %v", m)
+	}
+}
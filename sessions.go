@@ -0,0 +1,458 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+)
+
+/*
+Server-side sessions.
+
+Login cookie (SecureCookieValue) has a random session token. Sessions are
+stored in sessions table (token as sha256) with device (user agent), IP and
+when they were created and last seen. A session is valid until it's revoked
+or not seen for sessionTimeout. Each use (at most every sessionTouchInterval)
+extends the session and the cookie.
+
+Sessions are cached in memory so that we don't hit the database on every
+request. Revoking a session removes it from the cache and closes its
+websocket connections. Expired sessions and revocations are pruned from
+memory when sessions are started or revoked.
+
+Pages:
+GET  /account/sessions          : list of active sessions
+POST /account/sessions/revoke   : revoke session with id, or all=others, all=all
+*/
+
+const (
+	sessionTimeout       = time.Second * weekInSeconds
+	sessionTouchInterval = time.Minute * 5
+	maxUserAgentLen      = 512
+	maxIPLen             = 64
+)
+
+var (
+	sessionsMu sync.Mutex
+	// sha256 of session token => session
+	sessionsByTokenHash = map[string]*Session{}
+	// id of revoked session => when it would have expired at the latest.
+	// Expired entries are removed by pruneSessions
+	revokedSessionIDs = map[int]time.Time{}
+)
+
+// Session is a logged-in session of a user on a device
+type Session struct {
+	ID           int
+	userID       int
+	tokenHash    string
+	UserAgent    string
+	IP           string
+	SecondFactor bool
+	CreatedAt    time.Time
+	LastSeenAt   time.Time
+}
+
+// Device returns short description of session's browser
+func (s *Session) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+// describeUserAgent returns e.g. "Chrome on Windows" for a user agent
+func describeUserAgent(ua string) string {
+	find := func(names [][2]string) string {
+		for _, n := range names {
+			if strings.Contains(ua, n[0]) {
+				return n[1]
+			}
+		}
+		return ""
+	}
+	// order matters e.g. Edge user agent also has Chrome and Safari
+	browser := find([][2]string{
+		{"Electron/", "QuickNotes app"},
+		{"Edg", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	})
+	os := find([][2]string{
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Macintosh", "macOS"},
+		{"Linux", "Linux"},
+	})
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	case ua != "":
+		return ua
+	}
+	return "Unknown device"
+}
+
+func truncateString(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func dbCreateSession(userID int, tokenHash, userAgent, ip string, secondFactor bool) (*Session, error) {
+	db := getDbMust()
+	now := time.Now()
+	// good time to forget expired sessions
+	q := `DELETE FROM sessions WHERE user_id = ? AND last_seen_at < ?`
+	_, err := db.Exec(q, userID, now.Add(-sessionTimeout))
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	s := &Session{
+		userID:       userID,
+		tokenHash:    tokenHash,
+		UserAgent:    truncateString(userAgent, maxUserAgentLen),
+		IP:           truncateString(ip, maxIPLen),
+		SecondFactor: secondFactor,
+		CreatedAt:    now,
+		LastSeenAt:   now,
+	}
+	vals := NewDbVals("sessions", 7)
+	vals.Add("user_id", s.userID)
+	vals.Add("token_hash", s.tokenHash)
+	vals.Add("user_agent", s.UserAgent)
+	vals.Add("ip", s.IP)
+	vals.Add("second_factor", s.SecondFactor)
+	vals.Add("created_at", s.CreatedAt)
+	vals.Add("last_seen_at", s.LastSeenAt)
+	res, err := vals.Insert(db)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	s.ID = int(id)
+	return s, nil
+}
+
+const sessionColumns = `id, user_id, token_hash, user_agent, ip, second_factor, created_at, last_seen_at`
+
+func scanSession(row interface {
+	Scan(dest ...interface{}) error
+}) (*Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.userID, &s.tokenHash, &s.UserAgent, &s.IP, &s.SecondFactor, &s.CreatedAt, &s.LastSeenAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func dbGetSessionByTokenHash(tokenHash string) (*Session, error) {
+	db := getDbMust()
+	q := `SELECT ` + sessionColumns + ` FROM sessions WHERE token_hash = ?`
+	s, err := scanSession(db.QueryRow(q, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("db.QueryRow('%s') failed with '%s'\n", q, err)
+	}
+	return s, err
+}
+
+// dbGetUserSessions returns active sessions of the user, most recently used
+// first
+func dbGetUserSessions(userID int) ([]*Session, error) {
+	db := getDbMust()
+	q := `SELECT ` + sessionColumns + ` FROM sessions WHERE user_id = ? AND last_seen_at >= ? ORDER BY last_seen_at DESC`
+	rows, err := db.Query(q, userID, time.Now().Add(-sessionTimeout))
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func dbTouchSession(s *Session, ip string, t time.Time) error {
+	db := getDbMust()
+	q := `UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?`
+	_, err := db.Exec(q, t, truncateString(ip, maxIPLen), s.ID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+func dbSetSessionSecondFactor(sessionID int) error {
+	db := getDbMust()
+	q := `UPDATE sessions SET second_factor = TRUE WHERE id = ?`
+	_, err := db.Exec(q, sessionID)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+// dbDeleteSessions deletes sessions of the user for which keep returns false
+// and returns their ids
+func dbDeleteSessions(userID int, keep func(sessionID int) bool) ([]int, error) {
+	db := getDbMust()
+	q := `SELECT id FROM sessions WHERE user_id = ?`
+	rows, err := db.Query(q, userID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !keep(id) {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	q = `DELETE FROM sessions WHERE id = ? AND user_id = ?`
+	for _, id := range ids {
+		_, err = db.Exec(q, id, userID)
+		if err != nil {
+			log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// startSession creates a session for the user and sets login cookie
+func startSession(w http.ResponseWriter, r *http.Request, userID int, secondFactor bool) error {
+	token := randomToken()
+	ip := u.RequestGetRemoteAddress(r)
+	s, err := dbCreateSession(userID, hashToken(token), r.UserAgent(), ip, secondFactor)
+	if err != nil {
+		return err
+	}
+	sessionsMu.Lock()
+	pruneSessions()
+	sessionsByTokenHash[s.tokenHash] = s
+	sessionsMu.Unlock()
+	setSecureCookie(w, &SecureCookieValue{UserID: userID, SessionToken: token})
+	return nil
+}
+
+// getSession returns a copy of active session for a token from login cookie
+func getSession(token string) (*Session, error) {
+	h := hashToken(token)
+	sessionsMu.Lock()
+	s := sessionsByTokenHash[h]
+	sessionsMu.Unlock()
+	if s == nil {
+		var err error
+		s, err = dbGetSessionByTokenHash(h)
+		if err != nil || s == nil {
+			return nil, err
+		}
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	// the session might have been revoked after we read it from database
+	if _, ok := revokedSessionIDs[s.ID]; ok {
+		return nil, nil
+	}
+	sessionsByTokenHash[h] = s
+	if timeExpired(s.LastSeenAt, sessionTimeout) {
+		return nil, nil
+	}
+	res := *s
+	return &res, nil
+}
+
+// touchSession marks the session as used now, extending it
+func touchSession(w http.ResponseWriter, r *http.Request, sess *Session, sc *SecureCookieValue) {
+	now := time.Now()
+	ip := truncateString(u.RequestGetRemoteAddress(r), maxIPLen)
+	sessionsMu.Lock()
+	s := sessionsByTokenHash[sess.tokenHash]
+	needsTouch := s != nil && now.Sub(s.LastSeenAt) > sessionTouchInterval
+	if needsTouch {
+		s.LastSeenAt = now
+		s.IP = ip
+	}
+	sessionsMu.Unlock()
+	if !needsTouch {
+		return
+	}
+	dbTouchSession(sess, ip, now)
+	setSecureCookie(w, sc)
+}
+
+// markSessionSecondFactor records that the user of the session provided
+// second factor
+func markSessionSecondFactor(sessionID int) error {
+	err := dbSetSessionSecondFactor(sessionID)
+	if err != nil {
+		return err
+	}
+	sessionsMu.Lock()
+	for _, s := range sessionsByTokenHash {
+		if s.ID == sessionID {
+			s.SecondFactor = true
+		}
+	}
+	sessionsMu.Unlock()
+	return nil
+}
+
+// pruneSessions forgets expired sessions and revocations of sessions that
+// would have expired by now. Must be called with sessionsMu locked
+func pruneSessions() {
+	now := time.Now()
+	for id, expiresAt := range revokedSessionIDs {
+		if now.After(expiresAt) {
+			delete(revokedSessionIDs, id)
+		}
+	}
+	for h, s := range sessionsByTokenHash {
+		if timeExpired(s.LastSeenAt, sessionTimeout) {
+			delete(sessionsByTokenHash, h)
+		}
+	}
+}
+
+// revokeSessions ends sessions of the user for which keep returns false
+// (all if keep is nil) and closes their websocket connections
+func revokeSessions(userID int, keep func(sessionID int) bool) error {
+	if keep == nil {
+		keep = func(int) bool { return false }
+	}
+	ids, err := dbDeleteSessions(userID, keep)
+	if err != nil {
+		return err
+	}
+	revoked := map[int]bool{}
+	for _, id := range ids {
+		revoked[id] = true
+	}
+	// a session read from database before it was deleted is valid for at
+	// most sessionTimeout
+	expiresAt := time.Now().Add(sessionTimeout)
+	sessionsMu.Lock()
+	pruneSessions()
+	for id := range revoked {
+		revokedSessionIDs[id] = expiresAt
+	}
+	for h, s := range sessionsByTokenHash {
+		if s.userID == userID && revoked[s.ID] {
+			delete(sessionsByTokenHash, h)
+		}
+	}
+	sessionsMu.Unlock()
+	wsCloseSessionConnections(userID, revoked)
+	log.Verbosef("revoked %d sessions of user %d\n", len(ids), userID)
+	return nil
+}
+
+func revokeSession(userID, sessionID int) error {
+	return revokeSessions(userID, func(id int) bool { return id != sessionID })
+}
+
+// wsCloseSessionConnections closes websocket connections of sessions
+func wsCloseSessionConnections(userID int, sessionIDs map[int]bool) {
+	var toClose []*websocket.Conn
+	muWsConnections.Lock()
+	for _, c := range wsConnections[userID] {
+		if sessionIDs[c.sessionID] {
+			toClose = append(toClose, c.conn)
+		}
+	}
+	muWsConnections.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+	for _, conn := range toClose {
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.Close()
+	}
+}
+
+// url: GET /account/sessions
+func handleAccountSessions(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	sessions, err := dbGetUserSessions(ctx.User.id)
+	if err != nil {
+		httpErrorf(w, "dbGetUserSessions() failed with '%s'", err)
+		return
+	}
+	model := struct {
+		LoggedUser       *UserSummary
+		Sessions         []*Session
+		CurrentSessionID int
+		CSRFToken        string
+	}{
+		LoggedUser:       ctx.User,
+		Sessions:         sessions,
+		CurrentSessionID: ctx.User.sessionID,
+		CSRFToken:        csrfToken(w, r),
+	}
+	serveTemplate(w, tmplAccountSessions, model)
+}
+
+// url: POST /account/sessions/revoke
+func handleAccountSessionsRevoke(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	userID := ctx.User.id
+	current := ctx.User.sessionID
+	var err error
+	switch all := r.FormValue("all"); all {
+	case "all":
+		err = revokeSessions(userID, nil)
+	case "others":
+		err = revokeSessions(userID, func(id int) bool { return id == current })
+	case "":
+		var id int
+		id, err = strconv.Atoi(r.FormValue("id"))
+		if err == nil {
+			err = revokeSession(userID, id)
+		}
+	default:
+		err = fmt.Errorf("invalid all value '%s'", all)
+	}
+	if err != nil {
+		httpErrorf(w, "revoking sessions failed with '%s'", err)
+		return
+	}
+	if r.FormValue("all") == "all" {
+		deleteSecureCookie(w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/account/sessions", http.StatusFound)
+}
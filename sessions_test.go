@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDescribeUserAgent(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":                  "Chrome on Windows",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0":    "Edge on Windows",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15":               "Safari on macOS",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                           "Firefox on Linux",
+		"curl/8.4.0": "curl/8.4.0",
+		"":           "Unknown device",
+	}
+	for ua, exp := range tests {
+		if got := describeUserAgent(ua); got != exp {
+			t.Fatalf("describeUserAgent('%s'): expected '%s', got '%s'", ua, exp, got)
+		}
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	now := time.Now()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessionsByTokenHash["active"] = &Session{ID: -1, LastSeenAt: now}
+	sessionsByTokenHash["expired"] = &Session{ID: -2, LastSeenAt: now.Add(-sessionTimeout - time.Minute)}
+	revokedSessionIDs[-3] = now.Add(time.Minute)
+	revokedSessionIDs[-4] = now.Add(-time.Minute)
+	pruneSessions()
+	if sessionsByTokenHash["active"] == nil || sessionsByTokenHash["expired"] != nil {
+		t.Fatalf("expected only expired session to be pruned")
+	}
+	if _, ok := revokedSessionIDs[-3]; !ok {
+		t.Fatalf("revocation of session that could still be valid was pruned")
+	}
+	if _, ok := revokedSessionIDs[-4]; ok {
+		t.Fatalf("expired revocation was not pruned")
+	}
+	delete(sessionsByTokenHash, "active")
+	delete(revokedSessionIDs, -3)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+/*
+Sitemaps for public notes, re-generated daily in dailyTasksLoop:
+/sitemap.xml - sitemap index
+/sitemaps/notes-{n}.xml - urls of public notes, at most maxURLsPerSitemap per file
+/robots.txt - points crawlers to /sitemap.xml
+*/
+
+const (
+	// limit from https://www.sitemaps.org/protocol.html
+	maxURLsPerSitemap  = 50000
+	sitemapNS          = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	maxDescriptionSize = 160
+)
+
+var (
+	sitemapMu sync.Mutex
+
+	stripHTMLPolicy = bluemonday.StrictPolicy()
+)
+
+// SitemapURL is a single <url> entry in a sitemap
+type SitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Sitemap is <urlset> sitemap
+type Sitemap struct {
+	XMLName xml.Name      `xml:"urlset"`
+	NS      string        `xml:"xmlns,attr"`
+	URLs    []*SitemapURL `xml:"url"`
+}
+
+// SitemapRef is a single <sitemap> entry in a sitemap index
+type SitemapRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// SitemapIndex is <sitemapindex>
+type SitemapIndex struct {
+	XMLName  xml.Name      `xml:"sitemapindex"`
+	NS       string        `xml:"xmlns,attr"`
+	Sitemaps []*SitemapRef `xml:"sitemap"`
+}
+
+// getSiteURL returns scheme and host under which the site is available
+// e.g. https://quicknotes.io
+func getSiteURL() string {
+	return config.SiteURL
+}
+
+func sitemapIndexPath() string {
+	return pathForFileInCache("sitemap.xml")
+}
+
+func sitemapPath(n int) string {
+	name := fmt.Sprintf("sitemap-notes-%d.xml", n)
+	return pathForFileInCache(name)
+}
+
+func sitemapTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writes the file under a temporary name and renames so that we never
+// serve a partially written file
+func writeXMLFileAtomic(path string, v interface{}) error {
+	d, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	d = append([]byte(xml.Header), d...)
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, d, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// deleteStaleSitemaps deletes sitemaps left over from a previous build that
+// had more than n sitemaps
+func deleteStaleSitemaps(n int) {
+	d := getCacheDir()
+	files, err := ioutil.ReadDir(d)
+	if err != nil {
+		log.Errorf("ioutil.Read('%s') failed with '%s'\n", d, err)
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		var i int
+		_, err = fmt.Sscanf(name, "sitemap-notes-%d.xml", &i)
+		if err == nil && i > n {
+			path := filepath.Join(d, name)
+			err = os.Remove(path)
+			if err != nil {
+				log.Errorf("os.Remove('%s') failed with '%s'\n", path, err)
+			}
+		}
+	}
+}
+
+// unconditionally generate sitemaps for public notes
+func buildSitemaps() error {
+	log.Verbosef("buildSitemaps\n")
+
+	sitemapMu.Lock()
+	defer sitemapMu.Unlock()
+
+	timeStart := time.Now()
+	db := getDbMust()
+	q := `
+SELECT
+  id,
+  title,
+  updated_at
+FROM notes
+WHERE is_public = true AND is_deleted = false AND is_encrypted = false
+  AND user_id NOT IN (` + sqlHiddenUserIDs + `)
+ORDER BY id`
+	rows, err := db.Query(q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	defer rows.Close()
+
+	siteURL := getSiteURL()
+	var sitemaps []*Sitemap
+	var lastMods []time.Time
+	var curr *Sitemap
+	for rows.Next() {
+		var noteID int
+		var title string
+		var updatedAt time.Time
+		err = rows.Scan(&noteID, &title, &updatedAt)
+		if err != nil {
+			return err
+		}
+		if curr == nil || len(curr.URLs) == maxURLsPerSitemap {
+			curr = &Sitemap{NS: sitemapNS}
+			sitemaps = append(sitemaps, curr)
+			lastMods = append(lastMods, time.Time{})
+		}
+		curr.URLs = append(curr.URLs, &SitemapURL{
+			Loc:     siteURL + noteURLPath(hashInt(noteID), title),
+			LastMod: sitemapTime(updatedAt),
+		})
+		if updatedAt.After(lastMods[len(lastMods)-1]) {
+			lastMods[len(lastMods)-1] = updatedAt
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// new sitemaps replace the old ones so that they're available while
+	// we're building them
+	idx := &SitemapIndex{NS: sitemapNS}
+	for i, sitemap := range sitemaps {
+		n := i + 1
+		err = writeXMLFileAtomic(sitemapPath(n), sitemap)
+		if err != nil {
+			log.Errorf("writeXMLFileAtomic('%s') failed with '%s'\n", sitemapPath(n), err)
+			return err
+		}
+		idx.Sitemaps = append(idx.Sitemaps, &SitemapRef{
+			Loc:     fmt.Sprintf("%s/sitemaps/notes-%d.xml", siteURL, n),
+			LastMod: sitemapTime(lastMods[i]),
+		})
+	}
+	err = writeXMLFileAtomic(sitemapIndexPath(), idx)
+	if err != nil {
+		log.Errorf("writeXMLFileAtomic('%s') failed with '%s'\n", sitemapIndexPath(), err)
+		return err
+	}
+	deleteStaleSitemaps(len(sitemaps))
+	log.Verbosef("buildSitemaps, %d sitemaps, took %s\n", len(sitemaps), time.Since(timeStart))
+	return nil
+}
+
+// /sitemap.xml
+func handleSitemapIndex(w http.ResponseWriter, r *http.Request) {
+	serveMaybeGzippedFile(w, r, sitemapIndexPath())
+}
+
+// /sitemaps/notes-{n}.xml
+func handleSitemap(w http.ResponseWriter, r *http.Request) {
+	var n int
+	_, err := fmt.Sscanf(r.URL.Path, "/sitemaps/notes-%d.xml", &n)
+	if err != nil || n < 1 || r.URL.Path != fmt.Sprintf("/sitemaps/notes-%d.xml", n) {
+		http.NotFound(w, r)
+		return
+	}
+	serveMaybeGzippedFile(w, r, sitemapPath(n))
+}
+
+// /robots.txt
+func handleRobotsTxt(w http.ResponseWriter, r *http.Request) {
+	s := `User-agent: *
+Disallow: /api/
+Disallow: /raw/
+Disallow: /dbg/
+
+Sitemap: ` + getSiteURL() + "/sitemap.xml\n"
+	httpOkBytesWithContentType(w, r, "text/plain; charset=utf-8", []byte(s))
+}
+
+// noteDescription returns a plain text summary of the note, suitable for
+// <meta name="description">
+func noteDescription(note *Note) string {
+	// note can be shared via cache so we don't modify it with SetSnippet()
+	snippet, err := localStore.GetSnippet(note.ContentSha1)
+	if err != nil {
+		return ""
+	}
+	d, _ := getShortSnippet(snippet)
+	s := strings.TrimSpace(string(d))
+	if note.Format == formatHTML {
+		s = stripHTMLPolicy.Sanitize(s)
+	}
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= maxDescriptionSize {
+		return s
+	}
+	runes := []rune(s)[:maxDescriptionSize-1]
+	return strings.TrimSpace(string(runes)) + "…"
+}
+
+// noteCanonicalURL returns absolute url of a note page, with title slug
+func noteCanonicalURL(note *Note) string {
+	return getSiteURL() + noteURLPath(note.HashID, note.Title)
+}
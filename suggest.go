@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Autocomplete for the search box.
+
+For each user we build, on first use, sorted lists of:
+- note titles, keyed by folded title starting at each word, so that
+  "notes" completes "Meeting notes"
+- tags, with the number of notes
+- terms with at least minSuggestTermLen characters, with the number of
+  notes they appear in. Terms of notes are taken from the search index so
+  that we don't have to read content of all notes
+
+Finding completions of a prefix is a binary search for the first entry with
+that prefix followed by a scan of entries that have the prefix.
+
+Suggest indexes are part of CachedUserInfo so they are rebuilt after
+clearCachedUserInfo. Other users only get suggestions from public notes.
+*/
+
+const (
+	defaultMaxSuggestions = 5
+	maxMaxSuggestions     = 20
+	minSuggestTermLen     = 3
+)
+
+type suggestEntry struct {
+	// folded text, for matching
+	key string
+	// what we show to the user
+	text   string
+	weight int64
+	note   *Note
+}
+
+// SuggestIndex is an index of titles, tags and terms of notes for completing
+// search queries
+type SuggestIndex struct {
+	titles []suggestEntry
+	tags   []suggestEntry
+	terms  []suggestEntry
+}
+
+// TitleSuggestion is a note whose title matches a prefix
+type TitleSuggestion struct {
+	NoteHashID string
+	Title      string
+}
+
+// TagSuggestion is a tag that matches a prefix
+type TagSuggestion struct {
+	Tag      string
+	NumNotes int
+}
+
+// TermSuggestion is a term from notes that matches a prefix
+type TermSuggestion struct {
+	Term     string
+	NumNotes int
+}
+
+// Suggestions are completions of a prefix
+type Suggestions struct {
+	Prefix string
+	Titles []TitleSuggestion
+	Tags   []TagSuggestion
+	Terms  []TermSuggestion
+}
+
+func sortSuggestEntries(a []suggestEntry) {
+	sort.Slice(a, func(i, j int) bool {
+		return a[i].key < a[j].key
+	})
+}
+
+// buildSuggestIndex builds suggest index of notes. noteTerms are terms of
+// notes from search index (note id => terms), notes missing from it are
+// tokenized
+func buildSuggestIndex(notes []*Note, noteTerms map[int][]string) *SuggestIndex {
+	res := &SuggestIndex{}
+	tagCounts := map[string]int{}
+	tagTexts := map[string]string{}
+	termCounts := map[string]int{}
+	for _, note := range notes {
+		if note.IsDeleted {
+			continue
+		}
+		if note.Title != "" {
+			title := foldString(note.Title)
+			tokenize(title, func(term string, pos int) {
+				e := suggestEntry{
+					key:    title[pos:],
+					text:   note.Title,
+					weight: note.UpdatedAt.Unix(),
+					note:   note,
+				}
+				res.titles = append(res.titles, e)
+			})
+		}
+		for _, tag := range note.Tags {
+			key := foldString(tag)
+			tagCounts[key]++
+			tagTexts[key] = tag
+		}
+		seen := map[string]bool{}
+		countTerm := func(term string, pos int) {
+			if !seen[term] && utf8.RuneCountInString(term) >= minSuggestTermLen {
+				seen[term] = true
+				termCounts[term]++
+			}
+		}
+		if terms, ok := noteTerms[note.id]; ok {
+			for _, term := range terms {
+				countTerm(term, 0)
+			}
+			continue
+		}
+		tokenize(foldString(note.Title), countTerm)
+		tokenize(foldString(note.Content()), countTerm)
+	}
+	for key, n := range tagCounts {
+		res.tags = append(res.tags, suggestEntry{key: key, text: tagTexts[key], weight: int64(n)})
+	}
+	for term, n := range termCounts {
+		res.terms = append(res.terms, suggestEntry{key: term, text: term, weight: int64(n)})
+	}
+	sortSuggestEntries(res.titles)
+	sortSuggestEntries(res.tags)
+	sortSuggestEntries(res.terms)
+	return res
+}
+
+// returns up to max entries whose key starts with prefix, highest weight
+// first. If unique is true, only first entry for a given note is returned
+func findSuggestEntries(a []suggestEntry, prefix string, max int, unique bool) []suggestEntry {
+	i := sort.Search(len(a), func(i int) bool {
+		return a[i].key >= prefix
+	})
+	var res []suggestEntry
+	seen := map[*Note]bool{}
+	for ; i < len(a) && strings.HasPrefix(a[i].key, prefix); i++ {
+		e := a[i]
+		if unique {
+			if seen[e.note] {
+				continue
+			}
+			seen[e.note] = true
+		}
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].weight > res[j].weight
+	})
+	if len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+// Suggest returns completions of prefix
+func (idx *SuggestIndex) Suggest(prefix string, max int) *Suggestions {
+	res := &Suggestions{
+		Prefix: prefix,
+		Titles: []TitleSuggestion{},
+		Tags:   []TagSuggestion{},
+		Terms:  []TermSuggestion{},
+	}
+	s := strings.TrimSpace(foldString(prefix))
+	if s == "" {
+		return res
+	}
+	for _, e := range findSuggestEntries(idx.titles, s, max, true) {
+		res.Titles = append(res.Titles, TitleSuggestion{NoteHashID: e.note.HashID, Title: e.text})
+	}
+	for _, e := range findSuggestEntries(idx.tags, strings.TrimPrefix(s, "tag:"), max, false) {
+		res.Tags = append(res.Tags, TagSuggestion{Tag: e.text, NumNotes: int(e.weight)})
+	}
+	// complete the last word
+	if idx := strings.LastIndexByte(s, ' '); idx != -1 {
+		s = s[idx+1:]
+	}
+	if s != "" {
+		for _, e := range findSuggestEntries(idx.terms, s, max, false) {
+			res.Terms = append(res.Terms, TermSuggestion{Term: e.text, NumNotes: int(e.weight)})
+		}
+	}
+	return res
+}
+
+// getIndexedNoteTerms returns terms of notes from search index or nil
+func getIndexedNoteTerms(userID int, notes []*Note) map[int][]string {
+	if searchIndex == nil {
+		return nil
+	}
+	res, err := searchIndex.NoteTerms(userID, notes)
+	if err != nil {
+		log.Errorf("searchIndex.NoteTerms() failed with '%s'\n", err)
+		return nil
+	}
+	return res
+}
+
+// getSuggestIndex returns suggest index of all or only public notes,
+// building it if necessary
+func (i *CachedUserInfo) getSuggestIndex(onlyPublic bool) *SuggestIndex {
+	i.suggestMu.Lock()
+	defer i.suggestMu.Unlock()
+	if onlyPublic {
+		if i.suggestPublic == nil {
+			var notes []*Note
+			for _, note := range i.notes {
+				if note.IsPublic {
+					notes = append(notes, note)
+				}
+			}
+			i.suggestPublic = buildSuggestIndex(notes, getIndexedNoteTerms(i.user.ID, notes))
+		}
+		return i.suggestPublic
+	}
+	if i.suggestAll == nil {
+		i.suggestAll = buildSuggestIndex(i.notes, getIndexedNoteTerms(i.user.ID, i.notes))
+	}
+	return i.suggestAll
+}
+
+func wsSuggest(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	userIDHash, err := jsonMapGetString(args, "userIDHash")
+	if err != nil {
+		return nil, err
+	}
+	prefix, _ := jsonMapGetString(args, "prefix")
+	max, err := jsonMapGetInt(args, "max")
+	if err != nil || max <= 0 {
+		max = defaultMaxSuggestions
+	}
+	if max > maxMaxSuggestions {
+		max = maxMaxSuggestions
+	}
+	userID, err := dehashInt(userIDHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'userIDHash' arg '%s', err='%s'", userIDHash, err)
+	}
+	i, err := getCachedUserInfo(userID)
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		return nil, fmt.Errorf("No user with userIDHash '%s'", userIDHash)
+	}
+	onlyPublic := ctx.User == nil || ctx.User.id != userID
+	if onlyPublic && i.user.notesHidden() {
+		// public notes of disabled users or users being deleted are hidden
+		return (&SuggestIndex{}).Suggest(prefix, max), nil
+	}
+	return i.getSuggestIndex(onlyPublic).Suggest(prefix, max), nil
+}
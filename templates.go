@@ -16,11 +16,23 @@ import (
 )
 
 var (
-	tmplIndex      = "index.html"
-	tmplNotesIndex = "notes_index.html"
-	templateNames  = []string{tmplIndex, tmplNotesIndex}
-	templatePaths  []string
-	templates      *template.Template
+	tmplIndex           = "index.html"
+	tmplNotesIndex      = "notes_index.html"
+	tmplNote            = "note.html"
+	tmplExportIndex     = "export_index.html"
+	tmplExportNote      = "export_note.html"
+	tmplLoginEmail      = "login_email.html"
+	tmplAccountLogins   = "account_logins.html"
+	tmplLogin2FA        = "login_2fa.html"
+	tmplAccount2FA      = "account_2fa.html"
+	tmplAccountSessions = "account_sessions.html"
+	tmplAdmin           = "admin.html"
+	tmplAdminUsers      = "admin_users.html"
+	tmplAdminUser       = "admin_user.html"
+	tmplAccountData     = "account_data.html"
+	templateNames       = []string{tmplIndex, tmplNotesIndex, tmplNote, tmplExportIndex, tmplExportNote, tmplLoginEmail, tmplAccountLogins, tmplLogin2FA, tmplAccount2FA, tmplAccountSessions, tmplAdmin, tmplAdminUsers, tmplAdminUser, tmplAccountData}
+	templatePaths       []string
+	templates           *template.Template
 
 	reloadTemplates = true
 )
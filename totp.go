@@ -0,0 +1,648 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Optional two-factor authentication with TOTP (RFC 6238) codes from an
+authenticator app, or single-use recovery codes.
+
+Setting up (/account/2fa): we generate a secret (stored in totp_secrets,
+not yet enabled) and show it as otpauth:// provisioning URI, which
+authenticator apps import from a QR code. 2FA is enabled once the user
+enters a valid code. We then show recovery codes once; only their sha256 is
+stored (recovery_codes).
+
+Logging in: all logins go through logInDbUser(). If the user has 2FA, instead
+of setting the login cookie we remember the pending login (for
+secondFactorTimeout, under a random token in qn2fa cookie) and redirect to
+/login2fa. Session is started after a valid code, with SecondFactor set.
+getDbUserFromCookie() ignores sessions without SecondFactor of users with 2FA
+so e.g. websocket connections can't be authorized with a session from before
+2FA was enabled.
+
+A TOTP code can only be used once (totp_secrets.last_used_step).
+After maxSecondFactorAttempts invalid codes the user can't log in with 2FA for
+secondFactorLockout. Failures are counted per user, not per pending login.
+Enabling 2FA ends all other sessions of the user.
+
+Pages:
+GET | POST /login2fa     : enter second factor after logging in
+GET | POST /account/2fa  : set up or disable 2FA, new recovery codes
+*/
+
+const (
+	totpPeriod       = 30
+	totpDigits       = 6
+	totpModulo       = 1000000 // 10^totpDigits
+	totpSecretLen    = 20
+	totpIssuer       = "QuickNotes"
+	totpSkewSteps    = 1
+	numRecoveryCodes = 10
+
+	secondFactorCookieName  = "qn2fa"
+	secondFactorTimeout     = time.Minute * 5
+	maxSecondFactorAttempts = 5
+	secondFactorLockout     = time.Minute * 15
+)
+
+var (
+	base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	// user id => true if 2FA is enabled. Protected by mu
+	userIDToHas2FA = map[int]bool{}
+
+	secondFactorMu sync.Mutex
+	// token from qn2fa cookie => pending login
+	secondFactorStates = map[string]*secondFactorState{}
+	// user id => invalid second factor codes. Protected by secondFactorMu
+	secondFactorFailures = map[int]*secondFactorFailure{}
+)
+
+// secondFactorState is a login waiting for the second factor
+type secondFactorState struct {
+	userID  int
+	redir   string
+	started time.Time
+}
+
+// secondFactorFailure tracks invalid codes for a user across logins so
+// that starting a new login doesn't reset the count
+type secondFactorFailure struct {
+	attempts    int
+	lastAttempt time.Time
+	lockedUntil time.Time
+}
+
+// hotp returns HOTP (RFC 4226) code for a counter
+func hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%totpModulo)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpMatch returns time step for which code is valid at time t (allowing
+// for clock skew) or 0 if code is not valid. Steps up to lastStep were
+// already used
+func totpMatch(secret []byte, code string, t time.Time, lastStep int64) int64 {
+	step := totpStep(t)
+	for i := -totpSkewSteps; i <= totpSkewSteps; i++ {
+		s := step + int64(i)
+		if s <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, s)), []byte(code)) == 1 {
+			return s
+		}
+	}
+	return 0
+}
+
+// totpURI returns otpauth:// provisioning URI understood by authenticator
+// apps, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(secret []byte, account string) string {
+	v := url.Values{}
+	v.Set("secret", base32NoPad.EncodeToString(secret))
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func newTOTPSecret() []byte {
+	secret := make([]byte, totpSecretLen)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// newRecoveryCode returns a code like "k3n9q-x7w2m"
+func newRecoveryCode() string {
+	var d [7]byte
+	_, err := rand.Read(d[:])
+	if err != nil {
+		panic(err)
+	}
+	s := strings.ToLower(base32NoPad.EncodeToString(d[:]))[:10]
+	return s[:5] + "-" + s[5:]
+}
+
+// normalizeSecondFactorCode removes spaces and dashes users might type
+func normalizeSecondFactorCode(s string) string {
+	s = strings.ToLower(s)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func isTOTPCode(s string) bool {
+	if len(s) != totpDigits {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// TOTPSecret is user's TOTP secret
+type TOTPSecret struct {
+	secret   []byte
+	Enabled  bool
+	lastStep int64
+}
+
+func dbGetTOTPSecret(userID int) (*TOTPSecret, error) {
+	db := getDbMust()
+	q := `SELECT secret, enabled_at, last_used_step FROM totp_secrets WHERE user_id = ?`
+	var res TOTPSecret
+	var enabledAt sql.NullTime
+	err := db.QueryRow(q, userID).Scan(&res.secret, &enabledAt, &res.lastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("db.QueryRow('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	res.Enabled = enabledAt.Valid
+	return &res, nil
+}
+
+func setCachedHas2FA(userID int, has2FA bool) {
+	mu.Lock()
+	userIDToHas2FA[userID] = has2FA
+	mu.Unlock()
+}
+
+// userHas2FA returns true if user enabled 2FA. On database errors returns
+// true, to not let anyone in without second factor
+func userHas2FA(userID int) bool {
+	mu.Lock()
+	has2FA, ok := userIDToHas2FA[userID]
+	mu.Unlock()
+	if ok {
+		return has2FA
+	}
+	s, err := dbGetTOTPSecret(userID)
+	if err != nil {
+		return true
+	}
+	has2FA = s != nil && s.Enabled
+	setCachedHas2FA(userID, has2FA)
+	return has2FA
+}
+
+// dbStartTOTPSetup saves a secret which is not yet enabled
+func dbStartTOTPSetup(userID int, secret []byte) error {
+	db := getDbMust()
+	q := `REPLACE INTO totp_secrets (user_id, secret) VALUES (?, ?)`
+	_, err := db.Exec(q, userID, secret)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+	}
+	return err
+}
+
+// dbEnableTOTP enables 2FA and replaces recovery codes
+func dbEnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	q := `UPDATE totp_secrets SET enabled_at = ?, last_used_step = ? WHERE user_id = ? AND enabled_at IS NULL`
+	res, err := tx.Exec(q, time.Now(), step, userID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no 2FA setup in progress for user %d", userID)
+	}
+	err = txSetRecoveryCodes(tx, userID, recoveryCodes)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	if err == nil {
+		setCachedHas2FA(userID, true)
+	}
+	return err
+}
+
+func txSetRecoveryCodes(tx *sql.Tx, userID int, codes []string) error {
+	q := `DELETE FROM recovery_codes WHERE user_id = ?`
+	_, err := tx.Exec(q, userID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+		return err
+	}
+	q = `INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`
+	for _, code := range codes {
+		_, err = tx.Exec(q, userID, hashToken(normalizeSecondFactorCode(code)))
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func dbSetRecoveryCodes(userID int, codes []string) error {
+	db := getDbMust()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	err = txSetRecoveryCodes(tx, userID, codes)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+func dbCountRecoveryCodes(userID int) (int, error) {
+	db := getDbMust()
+	q := `SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`
+	var n int
+	err := db.QueryRow(q, userID).Scan(&n)
+	if err != nil {
+		log.Errorf("db.QueryRow('%s') failed with '%s'\n", q, err)
+	}
+	return n, err
+}
+
+func dbDisableTOTP(userID int) error {
+	db := getDbMust()
+	for _, q := range []string{
+		`DELETE FROM totp_secrets WHERE user_id = ?`,
+		`DELETE FROM recovery_codes WHERE user_id = ?`,
+	} {
+		_, err := db.Exec(q, userID)
+		if err != nil {
+			log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+			return err
+		}
+	}
+	setCachedHas2FA(userID, false)
+	return nil
+}
+
+// dbUseTOTPStep marks time step as used. Returns false if it (or a later
+// one) was already used, which prevents using the same code twice
+func dbUseTOTPStep(userID int, step int64) (bool, error) {
+	db := getDbMust()
+	q := `UPDATE totp_secrets SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?`
+	res, err := db.Exec(q, step, userID, step)
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func dbUseRecoveryCode(userID int, code string) (bool, error) {
+	db := getDbMust()
+	q := `UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1`
+	res, err := db.Exec(q, time.Now(), userID, hashToken(code))
+	if err != nil {
+		log.Errorf("db.Exec('%s') failed with '%s'\n", q, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// verifySecondFactor returns true if code is a valid TOTP code or unused
+// recovery code of the user. Using a code consumes it
+func verifySecondFactor(userID int, code string) (bool, error) {
+	code = normalizeSecondFactorCode(code)
+	if !isTOTPCode(code) {
+		return dbUseRecoveryCode(userID, code)
+	}
+	s, err := dbGetTOTPSecret(userID)
+	if err != nil || s == nil || !s.Enabled {
+		return false, err
+	}
+	step := totpMatch(s.secret, code, time.Now(), s.lastStep)
+	if step == 0 {
+		return false, nil
+	}
+	return dbUseTOTPStep(userID, step)
+}
+
+func newRecoveryCodes() []string {
+	var res []string
+	for i := 0; i < numRecoveryCodes; i++ {
+		res = append(res, newRecoveryCode())
+	}
+	return res
+}
+
+func startSecondFactor(w http.ResponseWriter, r *http.Request, dbUser *DbUser, redir string) {
+	token := randomToken()
+	secondFactorMu.Lock()
+	for k, st := range secondFactorStates {
+		if timeExpired(st.started, secondFactorTimeout) {
+			delete(secondFactorStates, k)
+		}
+	}
+	secondFactorStates[token] = &secondFactorState{
+		userID:  dbUser.ID,
+		redir:   redir,
+		started: time.Now(),
+	}
+	secondFactorMu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     secondFactorCookieName,
+		Value:    token,
+		Path:     "/login2fa",
+		MaxAge:   int(secondFactorTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+	http.Redirect(w, r, "/login2fa", http.StatusFound)
+}
+
+// isSecondFactorLocked returns true if user entered too many invalid codes
+func isSecondFactorLocked(userID int) bool {
+	secondFactorMu.Lock()
+	defer secondFactorMu.Unlock()
+	f := secondFactorFailures[userID]
+	return f != nil && time.Now().Before(f.lockedUntil)
+}
+
+// recordSecondFactorFailure counts an invalid code and returns true if user
+// is now locked out
+func recordSecondFactorFailure(userID int) bool {
+	secondFactorMu.Lock()
+	defer secondFactorMu.Unlock()
+	now := time.Now()
+	for id, f := range secondFactorFailures {
+		if timeExpired(f.lastAttempt, secondFactorLockout) && now.After(f.lockedUntil) {
+			delete(secondFactorFailures, id)
+		}
+	}
+	f := secondFactorFailures[userID]
+	if f == nil {
+		f = &secondFactorFailure{}
+		secondFactorFailures[userID] = f
+	}
+	f.attempts++
+	f.lastAttempt = now
+	if f.attempts < maxSecondFactorAttempts {
+		return false
+	}
+	f.attempts = 0
+	f.lockedUntil = now.Add(secondFactorLockout)
+	return true
+}
+
+func clearSecondFactorFailures(userID int) {
+	secondFactorMu.Lock()
+	delete(secondFactorFailures, userID)
+	secondFactorMu.Unlock()
+}
+
+// getSecondFactorState returns pending login from qn2fa cookie
+func getSecondFactorState(r *http.Request) (string, *secondFactorState) {
+	cookie, err := r.Cookie(secondFactorCookieName)
+	if err != nil {
+		return "", nil
+	}
+	secondFactorMu.Lock()
+	defer secondFactorMu.Unlock()
+	st := secondFactorStates[cookie.Value]
+	if st == nil || timeExpired(st.started, secondFactorTimeout) {
+		delete(secondFactorStates, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, st
+}
+
+func deleteSecondFactorState(w http.ResponseWriter, token string) {
+	secondFactorMu.Lock()
+	delete(secondFactorStates, token)
+	secondFactorMu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:   secondFactorCookieName,
+		Value:  "deleted",
+		Path:   "/login2fa",
+		MaxAge: -1,
+	})
+}
+
+// SecondFactorModel is a model for login_2fa.html and account_2fa.html
+type SecondFactorModel struct {
+	LoggedUser *UserSummary
+	Enabled    bool
+	// set while setting up 2FA
+	SetupSecret string
+	SetupURI    template.URL
+	// shown once after generating
+	RecoveryCodes        []string
+	NumRecoveryCodesLeft int
+	Message              string
+	Error                string
+	CSRFToken            string
+}
+
+// url: GET | POST /login2fa
+func handleLogin2FA(w http.ResponseWriter, r *http.Request) {
+	token, st := getSecondFactorState(r)
+	if st == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	m := &SecondFactorModel{
+		CSRFToken: csrfToken(w, r),
+	}
+	if r.Method != http.MethodPost {
+		serveTemplate(w, tmplLogin2FA, m)
+		return
+	}
+	if !checkCSRF(w, r) {
+		serveCSRFError(w, r, false)
+		return
+	}
+	if isSecondFactorLocked(st.userID) {
+		m.Error = "Too many invalid codes, please try again later"
+		serveTemplate(w, tmplLogin2FA, m)
+		return
+	}
+	ok, err := verifySecondFactor(st.userID, r.FormValue("code"))
+	if err != nil {
+		log.Errorf("verifySecondFactor(%d) failed with '%s'\n", st.userID, err)
+	}
+	if !ok {
+		if recordSecondFactorFailure(st.userID) {
+			log.Infof("too many invalid second factor codes for user %d\n", st.userID)
+			deleteSecondFactorState(w, token)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		m.Error = "Invalid code"
+		serveTemplate(w, tmplLogin2FA, m)
+		return
+	}
+	clearSecondFactorFailures(st.userID)
+	deleteSecondFactorState(w, token)
+	log.Verbosef("user %d logged in with second factor\n", st.userID)
+	err = startSession(w, r, st.userID, true)
+	if err != nil {
+		log.Errorf("startSession(%d) failed with '%s'\n", st.userID, err)
+		httpErrorf(w, "failed to log in")
+		return
+	}
+	http.Redirect(w, r, st.redir, http.StatusFound)
+}
+
+func serveAccount2FA(ctx *ReqContext, w http.ResponseWriter, r *http.Request, m *SecondFactorModel) {
+	m.LoggedUser = ctx.User
+	m.CSRFToken = csrfToken(w, r)
+	m.Enabled = userHas2FA(ctx.User.id)
+	if m.Enabled {
+		n, err := dbCountRecoveryCodes(ctx.User.id)
+		if err == nil {
+			m.NumRecoveryCodesLeft = n
+		}
+	}
+	serveTemplate(w, tmplAccount2FA, m)
+}
+
+// url: GET | POST /account/2fa
+func handleAccount2FA(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	m := &SecondFactorModel{}
+	if r.Method != http.MethodPost {
+		serveAccount2FA(ctx, w, r, m)
+		return
+	}
+	userID := ctx.User.id
+	code := r.FormValue("code")
+	action := r.FormValue("action")
+	switch action {
+	case "start":
+		if userHas2FA(userID) {
+			m.Error = "Two-factor authentication is already enabled"
+			break
+		}
+		secret := newTOTPSecret()
+		err := dbStartTOTPSetup(userID, secret)
+		if err != nil {
+			m.Error = "Something went wrong, please try again."
+			break
+		}
+		m.SetupSecret = base32NoPad.EncodeToString(secret)
+		m.SetupURI = template.URL(totpURI(secret, ctx.User.Handle))
+
+	case "confirm":
+		s, err := dbGetTOTPSecret(userID)
+		if err != nil || s == nil || s.Enabled {
+			m.Error = "Two-factor authentication is not being set up"
+			break
+		}
+		step := totpMatch(s.secret, normalizeSecondFactorCode(code), time.Now(), 0)
+		if step == 0 {
+			m.Error = "Invalid code, please try again"
+			m.SetupSecret = base32NoPad.EncodeToString(s.secret)
+			m.SetupURI = template.URL(totpURI(s.secret, ctx.User.Handle))
+			break
+		}
+		codes := newRecoveryCodes()
+		err = dbEnableTOTP(userID, step, codes)
+		if err != nil {
+			log.Errorf("dbEnableTOTP(%d) failed with '%s'\n", userID, err)
+			m.Error = "Something went wrong, please try again."
+			break
+		}
+		// keep this session logged in, other sessions didn't pass 2FA
+		sessionID := ctx.User.sessionID
+		err = markSessionSecondFactor(sessionID)
+		if err != nil {
+			log.Errorf("markSessionSecondFactor(%d) failed with '%s'\n", sessionID, err)
+		}
+		err = revokeSessions(userID, func(id int) bool { return id == sessionID })
+		if err != nil {
+			log.Errorf("revokeSessions(%d) failed with '%s'\n", userID, err)
+		}
+		m.RecoveryCodes = codes
+		m.Message = "Two-factor authentication is enabled."
+
+	case "recovery-codes", "disable":
+		ok, err := verifySecondFactor(userID, code)
+		if err != nil {
+			log.Errorf("verifySecondFactor(%d) failed with '%s'\n", userID, err)
+		}
+		if !ok {
+			m.Error = "Invalid code"
+			break
+		}
+		if action == "disable" {
+			err = dbDisableTOTP(userID)
+			m.Message = "Two-factor authentication is disabled."
+		} else {
+			codes := newRecoveryCodes()
+			err = dbSetRecoveryCodes(userID, codes)
+			m.RecoveryCodes = codes
+		}
+		if err != nil {
+			m.Message = ""
+			m.RecoveryCodes = nil
+			m.Error = "Something went wrong, please try again."
+		}
+
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+	serveAccount2FA(ctx, w, r, m)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vectors from RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, exp := range vectors {
+		got := hotp(secret, totpStep(time.Unix(unix, 0)))
+		if got != exp {
+			t.Fatalf("code at %d: expected %s, got %s", unix, exp, got)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+	if totpMatch(secret, "005924", now, 0) != step {
+		t.Fatalf("valid code not accepted")
+	}
+	// previous code is accepted because of clock skew, older is not
+	if totpMatch(secret, hotp(secret, step-1), now, 0) != step-1 {
+		t.Fatalf("code from previous step not accepted")
+	}
+	if totpMatch(secret, hotp(secret, step-2), now, 0) != 0 {
+		t.Fatalf("code from 2 steps ago accepted")
+	}
+	// already used
+	if totpMatch(secret, "005924", now, step) != 0 {
+		t.Fatalf("used code accepted again")
+	}
+
+	uri := totpURI(secret, "kjk")
+	if !strings.HasPrefix(uri, "otpauth://totp/QuickNotes:kjk?") || !strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ") {
+		t.Fatalf("unexpected uri '%s'", uri)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code := newRecoveryCode()
+	if len(code) != 11 || code[5] != '-' {
+		t.Fatalf("unexpected recovery code '%s'", code)
+	}
+	typed := " " + strings.ToUpper(code[:5]) + " " + code[6:]
+	if normalizeSecondFactorCode(typed) != normalizeSecondFactorCode(code) {
+		t.Fatalf("'%s' should be the same code as '%s'", typed, code)
+	}
+	if isTOTPCode(normalizeSecondFactorCode(code)) || !isTOTPCode(normalizeSecondFactorCode("123 456")) {
+		t.Fatalf("isTOTPCode() is wrong")
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	userID := -1
+	defer clearSecondFactorFailures(userID)
+	for i := 1; i < maxSecondFactorAttempts; i++ {
+		if recordSecondFactorFailure(userID) || isSecondFactorLocked(userID) {
+			t.Fatalf("locked out after %d attempts", i)
+		}
+	}
+	if !recordSecondFactorFailure(userID) || !isSecondFactorLocked(userID) {
+		t.Fatalf("not locked out after %d attempts", maxSecondFactorAttempts)
+	}
+	clearSecondFactorFailures(userID)
+	if isSecondFactorLocked(userID) {
+		t.Fatalf("still locked out after clearing failures")
+	}
+}
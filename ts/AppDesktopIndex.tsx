@@ -16,6 +16,17 @@ class LogIn extends Component<any, any> {
     const twitterUrl = '/logintwitter?redir=' + redir;
     const googleUrl = '/logingoogle?redir=' + redir;
     const githubUrl = '/logingithub?redir=' + redir;
+    const emailUrl = '/loginemail?redir=' + redir;
+    const oidcLinks = gOIDCProviders.map(p => {
+      const url = '/loginoidc?provider=' + encodeURIComponent(p.Name) + '&redir=' + redir;
+      return (
+        <li key={p.Name}>
+          <a className="oidc" href={url}>
+            Sign in with {p.DisplayName}
+          </a>
+        </li>
+      );
+    });
     return (
       <div style={style}>
         <ul className="log-in">
@@ -34,6 +45,12 @@ class LogIn extends Component<any, any> {
               Sign in with GitHub
             </a>
           </li>
+          {oidcLinks}
+          <li>
+            <a className="email" href={emailUrl}>
+              Sign in with e-mail
+            </a>
+          </li>
         </ul>
       </div>
     );
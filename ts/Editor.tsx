@@ -21,6 +21,10 @@ import * as api from './api';
 const kDragBarDy = 6;
 const kDragBarMin = 64;
 
+// auto-save this many ms after the last change. The server coalesces
+// auto-saves into a single version
+const kAutoSaveDelay = 5000;
+
 const isMac = /Mac/.test(navigator.platform);
 
 const cmOptions = {
@@ -143,9 +147,10 @@ interface NoteJSON {
   Content: string;
   Tags: string[];
   IsPublic: boolean;
+  IsAutoSave: boolean;
 }
 
-function toNewNoteJSON(note: NoteInEditor) {
+function toNewNoteJSON(note: NoteInEditor, isAutoSave = false) {
   const n: NoteJSON = {
     HashID: note.id,
     Title: note.title,
@@ -153,6 +158,7 @@ function toNewNoteJSON(note: NoteInEditor) {
     Content: note.body.trim() + '\n',
     Tags: textToTags(note.tags),
     IsPublic: note.isPublic,
+    IsAutoSave: isAutoSave,
   };
   return JSON.stringify(n);
 }
@@ -550,6 +556,9 @@ interface State {
 
 export default class Editor extends Component<any, State> {
   initialNote: NoteInEditor;
+  // note as of the last save, to skip auto-saves if nothing changed
+  lastSavedNote: NoteInEditor;
+  autoSaveTimer: any;
   cm: any;
   top: number;
   firstRender: boolean;
@@ -560,6 +569,7 @@ export default class Editor extends Component<any, State> {
   constructor(props?: any, context?: any) {
     super(props, context);
 
+    this.autoSave = this.autoSave.bind(this);
     this.handleCancel = this.handleCancel.bind(this);
     this.handleDragBarMoved = this.handleDragBarMoved.bind(this);
     this.handleEditorCreated = this.handleEditorCreated.bind(this);
@@ -591,6 +601,8 @@ export default class Editor extends Component<any, State> {
     this.editNote = this.editNote.bind(this);
     this.escPressed = this.escPressed.bind(this);
     this.isShowingPreview = this.isShowingPreview.bind(this);
+    this.cancelAutoSave = this.cancelAutoSave.bind(this);
+    this.scheduleAutoSave = this.scheduleAutoSave.bind(this);
     this.scheduleTimer = this.scheduleTimer.bind(this);
     this.setupCodeMirror = this.setupCodeMirror.bind(this);
     this.setupScrollSync = this.setupScrollSync.bind(this);
@@ -599,6 +611,8 @@ export default class Editor extends Component<any, State> {
     this.updateCodeMirrorMode = this.updateCodeMirrorMode.bind(this);
 
     this.initialNote = null;
+    this.lastSavedNote = null;
+    this.autoSaveTimer = null;
     this.cm = null;
     this.top = getWindowMiddle();
     this.firstRender = true;
@@ -794,6 +808,7 @@ export default class Editor extends Component<any, State> {
     this.setState({
       note: note,
     });
+    this.scheduleAutoSave();
   }
 
   handleTitleChanged(e: any) {
@@ -803,6 +818,7 @@ export default class Editor extends Component<any, State> {
     this.setState({
       note: note,
     });
+    this.scheduleAutoSave();
   }
 
   handleTagsChanged(e: any) {
@@ -812,9 +828,50 @@ export default class Editor extends Component<any, State> {
     this.setState({
       note: note,
     });
+    this.scheduleAutoSave();
+  }
+
+  scheduleAutoSave() {
+    clearTimeout(this.autoSaveTimer);
+    this.autoSaveTimer = setTimeout(this.autoSave, kAutoSaveDelay);
+  }
+
+  cancelAutoSave() {
+    clearTimeout(this.autoSaveTimer);
+    this.autoSaveTimer = null;
+  }
+
+  // saves the note without closing the editor
+  autoSave() {
+    this.autoSaveTimer = null;
+    const note = this.state.note;
+    if (!this.state.isShowing || !didNoteChange(this.lastSavedNote, note)) {
+      return;
+    }
+    // don't create a note until there's something in it
+    if (!note.id && note.body.trim() === '') {
+      return;
+    }
+    const saved = deepCloneObject(note);
+    api.createOrUpdateNote(toNewNoteJSON(note, true), (err: any, savedNote: any) => {
+      if (err) {
+        if (err.code && err.code.startsWith('quota_')) {
+          action.showTemporaryMessage(`Failed to save the note: ${err.message}.`);
+        }
+        console.log('autoSave: failed with', err);
+        return;
+      }
+      // the next save must update the note created by this one
+      note.id = savedNote.HashID;
+      saved.id = note.id;
+      if (this.state.note === note) {
+        this.lastSavedNote = saved;
+      }
+    });
   }
 
   handleSave(e?: any) {
+    this.cancelAutoSave();
     const note = this.state.note;
     const noteJSON = toNewNoteJSON(note);
     //console.log('handleSave, note=', note, 'noteJSON=', noteJSON);
@@ -824,12 +881,18 @@ export default class Editor extends Component<any, State> {
     });
     action.showTemporaryMessage('Saving note...', 500);
     const isNewNote = note.id;
-    api.createOrUpdateNote(noteJSON, (err: Error, note: any) => {
+    api.createOrUpdateNote(noteJSON, (err: any, savedNote: any) => {
       if (err) {
+        if (err.code && err.code.startsWith('quota_')) {
+          // re-open the editor so that the changes are not lost
+          action.showTemporaryMessage(`Failed to save the note: ${err.message}.`);
+          this.startEditingNote(note);
+          return;
+        }
         action.showTemporaryMessage('Failed to create a note');
         return;
       }
-      const hashID = note.HashID;
+      const hashID = savedNote.HashID;
       let msg = isNewNote
         ? `Updated <a href="/n/${hashID}" target="_blank">the note</a>.`
         : `Created <a href="/n/${hashID}" target="_blank">the note</a>.`;
@@ -838,6 +901,7 @@ export default class Editor extends Component<any, State> {
   }
 
   handleCancel(e: any) {
+    this.cancelAutoSave();
     this.setState({
       isShowing: false,
       note: newEmptyNote(),
@@ -870,6 +934,8 @@ export default class Editor extends Component<any, State> {
     // to communicate with componentDidUpdate
     this.firstRender = true;
     this.initialNote = deepCloneObject(note);
+    this.lastSavedNote = deepCloneObject(note);
+    this.cancelAutoSave();
     this.setState({
       isShowing: true,
       note: note,
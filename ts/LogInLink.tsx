@@ -9,6 +9,24 @@ function showImportSimpleNote(e: React.MouseEvent<HTMLAnchorElement>) {
   action.showHideImportSimpleNote(true);
 }
 
+// logging out changes state so it must be a POST with csrf token
+function logOut(e: React.MouseEvent<HTMLAnchorElement>) {
+  e.preventDefault();
+  const form = document.createElement('form');
+  form.method = 'POST';
+  form.action = '/logout';
+  const fields: any = { csrf: gCSRFToken, redir: window.location.pathname };
+  for (const name of Object.keys(fields)) {
+    const input = document.createElement('input');
+    input.type = 'hidden';
+    input.name = name;
+    input.value = fields[name];
+    form.appendChild(input);
+  }
+  document.body.appendChild(form);
+  form.submit();
+}
+
 function showSettings(e: React.MouseEvent<HTMLAnchorElement>) {
   e.preventDefault();
   console.log('showSettings');
@@ -21,7 +39,6 @@ export class LogOut extends Component<any, any> {
   }
 
   render() {
-    const url = encodeURI('/logout?redir=' + window.location);
     const u = gLoggedUser;
     const userUrl = '/u/' + u.HashID + '/' + u.Handle;
     // TODO: enable when running locally
@@ -48,8 +65,15 @@ export class LogOut extends Component<any, any> {
           <a href="/import" onClick={showImportSimpleNote}>
             Import from Simplenote
           </a>
+          <a href="/account/logins">Login methods</a>
+          <a href="/account/2fa">Two-factor authentication</a>
+          <a href="/account/sessions">Sessions</a>
+          <a href="/account/data">Export or delete account</a>
+          {u.IsAdmin ? <a href="/admin">Admin</a> : null}
           <span className="divider" />
-          <a href={url}>Sign Out</a>
+          <a href="/logout" onClick={logOut}>
+            Sign Out
+          </a>
         </div>
       </div>
     );
@@ -66,6 +90,17 @@ export class LogIn extends Component<any, any> {
     const twitterUrl = '/logintwitter?redir=' + redir;
     const googleUrl = '/logingoogle?redir=' + redir;
     const githubUrl = '/logingithub?redir=' + redir;
+    const emailUrl = '/loginemail?redir=' + redir;
+    const oidcLinks = gOIDCProviders.map(p => {
+      const url = '/loginoidc?provider=' + encodeURIComponent(p.Name) + '&redir=' + redir;
+      return (
+        <li key={p.Name}>
+          <a className="oidc" href={url}>
+            Sign in with {p.DisplayName}
+          </a>
+        </li>
+      );
+    });
     return (
       <div id="login-link">
         <span className="header-link">
@@ -88,6 +123,12 @@ export class LogIn extends Component<any, any> {
                 Sign in with GitHub
               </a>
             </li>
+            {oidcLinks}
+            <li>
+              <a className="email" href={emailUrl}>
+                Sign in with e-mail
+              </a>
+            </li>
           </ul>
         </div>
       </div>
@@ -25,6 +25,7 @@ interface wsResponse {
   cmd: string;
   result: any;
   error?: string;
+  errorCode?: string;
 }
 
 interface WsReq {
@@ -77,7 +78,9 @@ function wsProcessRsp(rsp: wsResponse) {
   }
   if (rsp.error) {
     console.log('error response', rsp, 'for request', req);
-    const err = new Error(rsp.error);
+    const err: any = new Error(rsp.error);
+    // e.g. 'quota_max_notes' if over the limits of user's plan
+    err.code = rsp.errorCode;
     req.cb(err, null);
     return;
   }
@@ -313,6 +316,9 @@ function post(url: string, args: ArgsDict, cb: any, cbErr: any) {
   const params: any = {
     method: 'POST',
     url: url,
+    headers: {
+      'X-CSRF-Token': gCSRFToken,
+    },
   };
   const urlArgs = buildArgs(args);
   if (urlArgs) {
@@ -501,20 +507,99 @@ export function createOrUpdateNote(noteJSON: string, cb: WsCb) {
   wsSendReq('createOrUpdateNote', args, cb, null);
 }
 
-export function searchUserNotes(userIDHash: string, searchTerm: string, cb: WsCb) {
-  const args: any = {
+export interface SearchOptions {
+  fuzzy?: boolean;
+  prefix?: boolean;
+  // also search previous versions of notes. Results from previous versions
+  // have Version set
+  history?: boolean;
+  // search term is a regular expression (RE2 syntax). Result has TimedOut
+  // set if not all notes were searched
+  regex?: boolean;
+  recencyBoost?: boolean;
+  starredBoost?: boolean;
+}
+
+export function searchUserNotes(userIDHash: string, searchTerm: string, cb: WsCb, opts?: SearchOptions) {
+  const args: any = Object.assign({
     userIDHash,
     searchTerm,
-  };
+  }, opts);
   wsSendReq('searchUserNotes', args, cb, null);
 }
 
+// searches public notes of all users, page starts at 1
+export function searchPublicNotes(searchTerm: string, page: number, cb: WsCb, opts?: SearchOptions) {
+  const args: any = Object.assign({
+    searchTerm,
+    page,
+  }, opts);
+  wsSendReq('searchPublicNotes', args, cb, null);
+}
+
+// completions of prefix for the search box. result is
+// {Prefix, Titles: [{NoteHashID, Title}], Tags: [{Tag, NumNotes}], Terms: [{Term, NumNotes}]}
+export function suggest(userIDHash: string, prefix: string, max: number, cb: WsCb) {
+  const args = {
+    userIDHash,
+    prefix,
+    max,
+  };
+  wsSendReq('suggest', args, cb, null);
+}
+
+export function restoreNoteVersion(noteHashID: string, versionHashID: string, cb: WsCb) {
+  const args = {
+    noteHashID,
+    versionHashID,
+  };
+  wsSendReq('restoreNoteVersion', args, cb, null);
+}
+
+export interface SavedSearch {
+  HashID: string;
+  Name: string;
+  Query: string;
+  Count: number;
+  NoteHashIDs: string[];
+  Err?: string;
+}
+
+// results of saved search functions are {SavedSearches: SavedSearch[]}.
+// Updated saved searches are also broadcasted as 'broadcastSavedSearches'
+export function getSavedSearches(cb: WsCb) {
+  wsSendReq('getSavedSearches', {}, cb, null);
+}
+
+export function createSavedSearch(name: string, query: string, cb: WsCb) {
+  const args = {
+    name,
+    query,
+  };
+  wsSendReq('createSavedSearch', args, cb, null);
+}
+
+export function renameSavedSearch(hashID: string, name: string, cb: WsCb) {
+  const args = {
+    hashID,
+    name,
+  };
+  wsSendReq('renameSavedSearch', args, cb, null);
+}
+
+export function deleteSavedSearch(hashID: string, cb: WsCb) {
+  const args = {
+    hashID,
+  };
+  wsSendReq('deleteSavedSearch', args, cb, null);
+}
+
 export function importSimpleNoteStart(email: string, password: string, cb: any, cbErr?: any) {
   const args: ArgsDict = {
     email,
     password,
   };
-  get('/api/import_simplenote_start', args, cb, cbErr);
+  post('/api/import_simplenote_start', args, cb, cbErr);
 }
 
 export function importSimpleNoteStatus(importId: string, cb: any, cbErr?: any) {
@@ -1,6 +1,7 @@
 interface UserInfo {
   HashID: string;
   Handle: string;
+  IsAdmin?: boolean;
 }
 
 declare var gNotesUser: UserInfo;
@@ -8,6 +9,16 @@ declare var gLoggedUser: UserInfo;
 declare var gInitialNote: any;
 declare var gNoteUser: UserInfo;
 declare var gIsDebug: boolean;
+// sent with POST requests, see csrf.go
+declare var gCSRFToken: string;
+
+interface OIDCProvider {
+  Name: string;
+  DisplayName: string;
+}
+
+// OpenID Connect login providers configured on the server
+declare var gOIDCProviders: OIDCProvider[];
 
 interface Window {
   tryWsReconnect: any;
@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"mime"
 	"path/filepath"
@@ -261,3 +263,13 @@ func getFirstLine(d []byte) []byte {
 		d = d[advance:]
 	}
 }
+
+// randomToken returns a random, url-safe string with 256 bits of entropy
+func randomToken() string {
+	var d [32]byte
+	_, err := rand.Read(d[:])
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(d[:])
+}